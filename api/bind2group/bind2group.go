@@ -37,7 +37,10 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		systemId = inputData.SystemId
 	}
 
-	servers.AddClient2Group(systemId, inputData.GroupName, inputData.ClientId, inputData.UserId, inputData.Extend)
+	if err := servers.AddClient2Group(systemId, inputData.GroupName, inputData.ClientId, inputData.UserId, inputData.Extend); err != nil {
+		api.Render(w, retcode.QuotaErrCode, err.Error(), []string{})
+		return
+	}
 
 	api.Render(w, retcode.SUCCESS, "success", []string{})
 }
@@ -0,0 +1,44 @@
+package clientgroups
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+type inputData struct {
+	SystemId string `json:"systemId"`
+	ClientId string `json:"clientId" validate:"required"`
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	groupList := servers.GetClientGroupList(systemId, inputData.ClientId)
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
+		"count": len(groupList),
+		"list":  groupList,
+	})
+	return
+}
@@ -54,6 +54,13 @@ func Render(w http.ResponseWriter, code int, msg string, data interface{}) (str
 	return
 }
 
+//返回指定的http状态码
+func RenderStatus(w http.ResponseWriter, status int, code int, msg string, data interface{}) (str string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return Render(w, code, msg, data)
+}
+
 func Validate(inputData interface{}) error {
 
 	validate := validator.New()
@@ -0,0 +1,49 @@
+package dissolvegroup
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+type inputData struct {
+	SystemId   string `json:"systemId"`
+	SendUserId string `json:"sendUserId"`
+	GroupName  string `json:"groupName" validate:"required"`
+	Notify     bool   `json:"notify"` // 是否通知被移出分组的客户端
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	messageId, count, result := servers.DissolveGroup(systemId, inputData.SendUserId, inputData.GroupName, inputData.Notify)
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
+		"messageId": messageId,
+		"count":     count,
+		"nodes":     result.Nodes,
+		"reached":   result.Reached,
+		"failed":    result.Failed,
+	})
+	return
+}
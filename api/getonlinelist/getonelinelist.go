@@ -14,6 +14,11 @@ type Controller struct {
 type inputData struct {
 	SystemId  string      `json:"systemId"`
 	GroupName string      `json:"groupName" validate:"required"`
+	Cursor    string      `json:"cursor"`
+	Limit     int         `json:"limit" validate:"min=0"`
+	Dedupe    bool        `json:"dedupe"`
+	CountOnly bool        `json:"countOnly"`
+	Detail    bool        `json:"detail"`
 	Code      int         `json:"code"`
 	Msg       string      `json:"msg"`
 	Data      interface{} `json:"data"`
@@ -37,7 +42,14 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		systemId = inputData.SystemId
 	}
 
-	ret := servers.GetOnlineList(&systemId, &inputData.GroupName)
+	ret := servers.GetOnlineList(servers.MemberQuery{
+		SystemId:  systemId,
+		GroupName: inputData.GroupName,
+		Cursor:    inputData.Cursor,
+		Limit:     inputData.Limit,
+		Dedupe:    inputData.Dedupe,
+		CountOnly: inputData.CountOnly,
+	}, inputData.Detail)
 
 	api.Render(w, retcode.SUCCESS, "success", ret)
 	return
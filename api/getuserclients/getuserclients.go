@@ -15,6 +15,10 @@ type inputData struct {
 	SystemId  string      `json:"systemId"`
 	GroupName string      `json:"groupName"`
 	UserId    string      `json:"userId" validate:"required"`
+	Cursor    string      `json:"cursor"`
+	Limit     int         `json:"limit" validate:"min=0"`
+	CountOnly bool        `json:"countOnly"`
+	Detail    bool        `json:"detail"`
 	Code      int         `json:"code"`
 	Msg       string      `json:"msg"`
 	Data      interface{} `json:"data"`
@@ -38,7 +42,14 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		systemId = inputData.SystemId
 	}
 
-	ret := servers.GetUserList(&systemId, &inputData.GroupName, &inputData.UserId)
+	ret := servers.GetUserList(servers.MemberQuery{
+		SystemId:  systemId,
+		GroupName: inputData.GroupName,
+		UserId:    inputData.UserId,
+		Cursor:    inputData.Cursor,
+		Limit:     inputData.Limit,
+		CountOnly: inputData.CountOnly,
+	}, inputData.Detail)
 
 	api.Render(w, retcode.SUCCESS, "success", ret)
 	return
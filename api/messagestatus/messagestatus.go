@@ -0,0 +1,46 @@
+package messagestatus
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+type inputData struct {
+	SystemId  string `json:"systemId"`
+	ClientId  string `json:"clientId" validate:"required"`
+	MessageId string `json:"messageId" validate:"required"`
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	status, ok := servers.GetMessageStatus(systemId, inputData.ClientId, inputData.MessageId)
+	if !ok {
+		api.Render(w, retcode.MessageIdErrCode, "消息不存在或已过期", []string{})
+		return
+	}
+
+	api.Render(w, retcode.SUCCESS, "success", status)
+	return
+}
@@ -0,0 +1,50 @@
+package presenceonline
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+type inputData struct {
+	SystemId string   `json:"systemId"` // 管理接口中为空时查询所有系统
+	UserIds  []string `json:"userIds" validate:"required"`
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	//超过单次查询的userIds数量上限
+	if err := servers.CheckUserIds(inputData.UserIds); err != nil {
+		api.Render(w, retcode.QuotaErrCode, err.Error(), []string{})
+		return
+	}
+
+	list := servers.GetPresence(systemId, inputData.UserIds)
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
+		"count": len(list),
+		"list":  list,
+	})
+	return
+}
@@ -0,0 +1,47 @@
+package presenceuser
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+type inputData struct {
+	SystemId string `json:"systemId"` // 管理接口中为空时查询所有系统
+	UserId   string `json:"userId" validate:"required"`
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	presence, devices := servers.GetUserDevices(systemId, inputData.UserId)
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
+		"userId":   presence.UserId,
+		"online":   presence.Online,
+		"count":    presence.Count,
+		"lastSeen": presence.LastSeen,
+		"devices":  devices,
+	})
+	return
+}
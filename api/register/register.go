@@ -12,7 +12,10 @@ type Controller struct {
 }
 
 type inputData struct {
-	SystemId string `json:"systemId" validate:"required"`
+	SystemId       string `json:"systemId" validate:"required"`
+	OfflineMessage bool   `json:"offlineMessage"` // 是否保存发送给离线用户的消息
+	OfflineTTL     int64  `json:"offlineTTL"`     // 离线消息保存时间，单位：秒
+	RequireToken   bool   `json:"requireToken"`   // 连接时是否必须携带连接凭证
 }
 
 func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
@@ -28,12 +31,16 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = servers.Register(inputData.SystemId)
+	credential, err := servers.Register(inputData.SystemId, servers.RegisterOptions{
+		OfflineMessage: inputData.OfflineMessage,
+		OfflineTTL:     inputData.OfflineTTL,
+		RequireToken:   inputData.RequireToken,
+	})
 	if err != nil {
 		api.Render(w, retcode.FAIL, err.Error(), []string{})
 		return
 	}
 
-	api.Render(w, retcode.SUCCESS, "success", []string{})
+	api.Render(w, retcode.SUCCESS, "success", credential)
 	return
 }
@@ -0,0 +1,75 @@
+package rotatekey
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	ClientURL string
+}
+
+type retMessage struct {
+	Code int                `json:"code"`
+	Msg  string             `json:"msg"`
+	Data servers.Credential `json:"data"`
+}
+
+func newServer(t *testing.T) *testServer {
+	var s testServer
+	setting.Default()
+
+	controller := &Controller{}
+	s.Server = httptest.NewServer(http.HandlerFunc(controller.Run))
+	s.ClientURL = s.Server.URL + "/api/key/rotate"
+	return &s
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	credential, _ := servers.Register("rotateKeySystem", servers.RegisterOptions{})
+	defer servers.SystemMap.Delete("rotateKeySystem")
+
+	testContent := `{"systemId":"rotateKeySystem"}`
+
+	resp, err := http.Post(s.ClientURL, "application/json", strings.NewReader(testContent))
+	Convey("测试轮换API密钥", t, func() {
+		Convey("是否有报错", func() {
+			So(err, ShouldBeNil)
+		})
+	})
+	defer resp.Body.Close()
+
+	retMessage := retMessage{}
+	message, err := ioutil.ReadAll(resp.Body)
+
+	err = json.Unmarshal(message, &retMessage)
+
+	Convey("验证json解析返回的内容", t, func() {
+		err := json.Unmarshal(message, &retMessage)
+		Convey("是否解析成功", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Code格式", func() {
+			So(retMessage.Code, ShouldEqual, 0)
+		})
+
+		Convey("返回新的密钥", func() {
+			So(retMessage.Data.ApiKey, ShouldNotBeEmpty)
+			So(retMessage.Data.ApiKey, ShouldNotEqual, credential.ApiKey)
+			So(retMessage.Data.ApiSecret, ShouldNotBeEmpty)
+		})
+
+	})
+}
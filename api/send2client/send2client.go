@@ -18,6 +18,7 @@ type inputData struct {
 	Code       int    `json:"code"`
 	Msg        string `json:"msg"`
 	Data       string `json:"data"`
+	NeedAck    bool   `json:"needAck"` //是否需要客户端确认,客户端未确认时重新投递
 }
 
 func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
@@ -38,8 +39,19 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	//超过系统的消息大小上限或调用频率上限
+	if err := servers.CheckSendQuota(systemId, len(inputData.Data)); err != nil {
+		api.Render(w, servers.QuotaCode(err), err.Error(), []string{})
+		return
+	}
+
 	//发送信息
-	messageId := servers.SendMessage2Client(inputData.ClientId, inputData.SendUserId, inputData.Code, inputData.Msg, &inputData.Data)
+	messageId := servers.SendMessage2Client(systemId, inputData.ClientId, inputData.SendUserId, inputData.Code, inputData.Msg, &inputData.Data, inputData.NeedAck)
 
 	api.Render(w, retcode.SUCCESS, "success", map[string]string{
 		"messageId": messageId,
@@ -20,6 +20,7 @@ type inputData struct {
 	Code       int      `json:"code"`
 	Msg        string   `json:"msg"`
 	Data       string   `json:"data"`
+	NeedAck    bool     `json:"needAck"` //是否需要客户端确认,客户端未确认时重新投递
 }
 
 func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
@@ -34,6 +35,23 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		api.Render(w, retcode.FAIL, err.Error(), []string{})
 		return
 	}
+
+	systemId := r.Header.Get("SystemId")
+	if len(inputData.SystemId) > 0 {
+		systemId = inputData.SystemId
+	}
+
+	if err := servers.CheckClientIds(inputData.ClientIds); err != nil {
+		api.Render(w, retcode.QuotaErrCode, err.Error(), []string{})
+		return
+	}
+
+	//超过系统的消息大小上限或调用频率上限
+	if err := servers.CheckSendQuota(systemId, len(inputData.Data)); err != nil {
+		api.Render(w, servers.QuotaCode(err), err.Error(), []string{})
+		return
+	}
+
 	messages := make([]string, len(inputData.ClientIds))
 	for _, clientId := range inputData.ClientIds {
 		if len(inputData.SendUserId) > 0 && inputData.SendUserId == clientId {
@@ -41,7 +59,7 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		//发送信息
-		msgId := servers.SendMessage2Client(clientId, inputData.SendUserId, inputData.Code, inputData.Msg, &inputData.Data)
+		msgId := servers.SendMessage2Client(systemId, clientId, inputData.SendUserId, inputData.Code, inputData.Msg, &inputData.Data, inputData.NeedAck)
 		messages = append(messages, msgId)
 	}
 
@@ -39,10 +39,19 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		systemId = inputData.SystemId
 	}
 
-	messageId := servers.SendMessage2Group(systemId, inputData.SendUserId, inputData.GroupName, inputData.Code, inputData.Msg, &inputData.Data)
+	//超过系统的消息大小上限或调用频率上限
+	if err := servers.CheckSendQuota(systemId, len(inputData.Data)); err != nil {
+		api.Render(w, servers.QuotaCode(err), err.Error(), []string{})
+		return
+	}
+
+	messageId, result := servers.SendMessage2Group(systemId, inputData.SendUserId, inputData.GroupName, inputData.Code, inputData.Msg, &inputData.Data)
 
-	api.Render(w, retcode.SUCCESS, "success", map[string]string{
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
 		"messageId": messageId,
+		"nodes":     result.Nodes,
+		"reached":   result.Reached,
+		"failed":    result.Failed,
 	})
 	return
 }
@@ -38,10 +38,20 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 	if len(inputData.SystemId) > 0 {
 		systemId = inputData.SystemId
 	}
-	messageId := servers.SendMessage2User(systemId, inputData.SendUserId, inputData.GroupName, inputData.UserId, inputData.Code, inputData.Msg, &inputData.Data)
 
-	api.Render(w, retcode.SUCCESS, "success", map[string]string{
+	//超过系统的消息大小上限或调用频率上限
+	if err := servers.CheckSendQuota(systemId, len(inputData.Data)); err != nil {
+		api.Render(w, servers.QuotaCode(err), err.Error(), []string{})
+		return
+	}
+
+	messageId, result := servers.SendMessage2User(systemId, inputData.SendUserId, inputData.GroupName, inputData.UserId, inputData.Code, inputData.Msg, &inputData.Data)
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
 		"messageId": messageId,
+		"nodes":     result.Nodes,
+		"reached":   result.Reached,
+		"failed":    result.Failed,
 	})
 	return
 }
@@ -0,0 +1,65 @@
+package systemdelete
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	ClientURL string
+}
+
+type retMessage struct {
+	Code int      `json:"code"`
+	Msg  string   `json:"msg"`
+	Data []string `json:"data"`
+}
+
+func newServer(t *testing.T) *testServer {
+	var s testServer
+	setting.Default()
+
+	controller := &Controller{}
+	s.Server = httptest.NewServer(http.HandlerFunc(controller.Run))
+	s.ClientURL = s.Server.URL + "/api/system/delete"
+	return &s
+}
+
+func post(url, content string) (retMessage retMessage, err error) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(content))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(message, &retMessage)
+	return
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	_, _ = servers.Register("deleteSystem", servers.RegisterOptions{})
+	defer servers.SystemMap.Delete("deleteSystem")
+
+	Convey("测试删除系统", t, func() {
+		retMessage, err := post(s.ClientURL, `{"systemId":"deleteSystem"}`)
+		So(err, ShouldBeNil)
+		So(retMessage.Code, ShouldEqual, 0)
+		So(servers.CheckSystem("deleteSystem"), ShouldEqual, servers.ErrSystemNotRegistered)
+
+		retMessage, err = post(s.ClientURL, `{"systemId":"deleteSystem"}`)
+		So(err, ShouldBeNil)
+		So(retMessage.Code, ShouldNotEqual, 0)
+	})
+}
@@ -0,0 +1,25 @@
+package systemlist
+
+import (
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	systems, err := servers.ListSystems()
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	api.Render(w, retcode.SUCCESS, "success", map[string]interface{}{
+		"count": len(systems),
+		"list":  systems,
+	})
+	return
+}
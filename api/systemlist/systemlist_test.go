@@ -0,0 +1,70 @@
+package systemlist
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	ClientURL string
+}
+
+type retMessage struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Count int                  `json:"count"`
+		List  []servers.SystemInfo `json:"list"`
+	} `json:"data"`
+}
+
+func newServer(t *testing.T) *testServer {
+	var s testServer
+	setting.Default()
+
+	controller := &Controller{}
+	s.Server = httptest.NewServer(http.HandlerFunc(controller.Run))
+	s.ClientURL = s.Server.URL + "/api/system/list"
+	return &s
+}
+
+func post(url, content string) (retMessage retMessage, err error) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(content))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(message, &retMessage)
+	return
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	_, _ = servers.Register("listSystem", servers.RegisterOptions{})
+	defer servers.SystemMap.Delete("listSystem")
+
+	Convey("测试获取系统列表", t, func() {
+		retMessage, err := post(s.ClientURL, `{}`)
+		So(err, ShouldBeNil)
+		So(retMessage.Code, ShouldEqual, 0)
+		So(retMessage.Data.Count, ShouldEqual, len(retMessage.Data.List))
+
+		systemIds := make([]string, 0, len(retMessage.Data.List))
+		for _, system := range retMessage.Data.List {
+			systemIds = append(systemIds, system.SystemId)
+		}
+		So(systemIds, ShouldContain, "listSystem")
+	})
+}
@@ -0,0 +1,62 @@
+package systemsuspend
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	ClientURL string
+}
+
+type retMessage struct {
+	Code int                `json:"code"`
+	Msg  string             `json:"msg"`
+	Data servers.SystemInfo `json:"data"`
+}
+
+func newServer(t *testing.T) *testServer {
+	var s testServer
+	setting.Default()
+
+	controller := &Controller{}
+	s.Server = httptest.NewServer(http.HandlerFunc(controller.Run))
+	s.ClientURL = s.Server.URL + "/api/system/suspend"
+	return &s
+}
+
+func post(url, content string) (retMessage retMessage, err error) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(content))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(message, &retMessage)
+	return
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	_, _ = servers.Register("suspendSystem", servers.RegisterOptions{})
+	defer servers.SystemMap.Delete("suspendSystem")
+
+	Convey("测试停用系统", t, func() {
+		retMessage, err := post(s.ClientURL, `{"systemId":"suspendSystem"}`)
+		So(err, ShouldBeNil)
+		So(retMessage.Code, ShouldEqual, 0)
+		So(retMessage.Data.Status, ShouldEqual, servers.SystemStatusSuspended)
+		So(servers.CheckSystem("suspendSystem"), ShouldEqual, servers.ErrSystemSuspended)
+	})
+}
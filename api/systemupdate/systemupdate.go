@@ -0,0 +1,51 @@
+package systemupdate
+
+import (
+	"encoding/json"
+	"github.com/woodylan/go-websocket/api"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers"
+	"net/http"
+)
+
+type Controller struct {
+}
+
+//未传的字段保持不变
+type inputData struct {
+	SystemId       string                `json:"systemId" validate:"required"`
+	OfflineMessage *bool                 `json:"offlineMessage"` // 是否保存发送给离线用户的消息
+	OfflineTTL     *int64                `json:"offlineTTL"`     // 离线消息保存时间，单位：秒
+	RequireToken   *bool                 `json:"requireToken"`   // 连接时是否必须携带连接凭证
+	Policy         *servers.SystemPolicy `json:"policy"`         // 系统的策略和配额，传入时整体替换
+	Webhook        *servers.Webhook      `json:"webhook"`        // 回调业务系统的配置，传入时整体替换
+}
+
+func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
+	var inputData inputData
+	if err := json.NewDecoder(r.Body).Decode(&inputData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := api.Validate(inputData)
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	info, err := servers.UpdateSystem(inputData.SystemId, servers.UpdateOptions{
+		OfflineMessage: inputData.OfflineMessage,
+		OfflineTTL:     inputData.OfflineTTL,
+		RequireToken:   inputData.RequireToken,
+		Policy:         inputData.Policy,
+		Webhook:        inputData.Webhook,
+	})
+	if err != nil {
+		api.Render(w, retcode.FAIL, err.Error(), []string{})
+		return
+	}
+
+	api.Render(w, retcode.SUCCESS, "success", info)
+	return
+}
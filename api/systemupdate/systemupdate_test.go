@@ -0,0 +1,69 @@
+package systemupdate
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	*httptest.Server
+	ClientURL string
+}
+
+type retMessage struct {
+	Code int                `json:"code"`
+	Msg  string             `json:"msg"`
+	Data servers.SystemInfo `json:"data"`
+}
+
+func newServer(t *testing.T) *testServer {
+	var s testServer
+	setting.Default()
+
+	controller := &Controller{}
+	s.Server = httptest.NewServer(http.HandlerFunc(controller.Run))
+	s.ClientURL = s.Server.URL + "/api/system/update"
+	return &s
+}
+
+func post(url, content string) (retMessage retMessage, err error) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(content))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(message, &retMessage)
+	return
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	_, _ = servers.Register("updateSystem", servers.RegisterOptions{})
+	defer servers.SystemMap.Delete("updateSystem")
+
+	Convey("测试修改系统配置", t, func() {
+		retMessage, err := post(s.ClientURL, `{"systemId":"updateSystem","offlineMessage":true,"offlineTTL":60}`)
+		So(err, ShouldBeNil)
+		So(retMessage.Code, ShouldEqual, 0)
+		So(retMessage.Data.OfflineMessage, ShouldBeTrue)
+		So(retMessage.Data.OfflineTTL, ShouldEqual, 60)
+
+		Convey("未传的字段保持不变", func() {
+			retMessage, err := post(s.ClientURL, `{"systemId":"updateSystem","requireToken":true}`)
+			So(err, ShouldBeNil)
+			So(retMessage.Data.RequireToken, ShouldBeTrue)
+			So(retMessage.Data.OfflineMessage, ShouldBeTrue)
+		})
+	})
+}
@@ -5,4 +5,14 @@ const (
 	ETcdServerList = "/gws/servers/"
 	//账号信息前缀
 	ETcdPrefixAccountInfo = "/gws/account/"
+	//分组所在节点的索引前缀,key为前缀+systemId:groupName/节点地址
+	ETcdPrefixGroupNodes = "/gws/groups/"
+	//接口请求nonce前缀,用于防止重放
+	ETcdPrefixNonce = "/gws/nonce/"
+	//Redis中节点接收请求的频道前缀,频道为前缀+节点地址
+	RedisChannelNode = "gws:node:"
+	//Redis中节点接收响应的频道前缀,频道为前缀+节点地址
+	RedisChannelReply = "gws:reply:"
+	//Redis中在线节点的有序集合,分数为最后一次心跳的毫秒时间戳
+	RedisKeyNodes = "gws:nodes"
 )
@@ -2,14 +2,28 @@ package retcode
 
 const (
 	//错误响应码都 < 0
-	ETcdErrCode     = -1002 //ETcd服务器错误
-	SystemIdErrCode = -1001 //系统ID无效
-	FAIL            = -1    //请求出错
+	ForbiddenErrCode = -1011 //客户端事件未被授权
+	RateLimitErrCode = -1010 //请求过于频繁
+	QuotaErrCode     = -1009 //超过系统配额
+	AdminErrCode     = -1008 //管理凭证无效
+	SuspendedErrCode = -1007 //系统已停用
+	DrainingErrCode  = -1006 //服务器正在关闭,请连接其他服务器
+	SignErrCode      = -1005 //请求签名无效
+	TokenErrCode     = -1004 //连接凭证无效
+	MessageIdErrCode = -1003 //消息不存在或已过期
+	ETcdErrCode      = -1002 //ETcd服务器错误
+	SystemIdErrCode  = -1001 //系统ID无效
+	FAIL             = -1    //请求出错
 
 	//成功响应码都 >= 0
-	SUCCESS        = 0    //请求成功
-	OnLineMsgCode  = 1001 //客户端上线
-	OffLineMsgCode = 1002 //客户端下线
+	SUCCESS         = 0    //请求成功
+	OnLineMsgCode   = 1001 //客户端上线
+	OffLineMsgCode  = 1002 //客户端下线
+	ReconnectCode   = 1003 //服务器即将关闭,客户端需要重新连接
+	LeaveGroupCode  = 1004 //客户端离开分组
+	DissolveCode    = 1005 //分组已解散
+	UserOnLineCode  = 1006 //订阅的用户上线
+	UserOffLineCode = 1007 //订阅的用户下线
 
 	MultiSignOnCode = 2000 //业务端同意用户多点登录通知
 )
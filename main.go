@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/woodylan/go-websocket/define"
-	"github.com/woodylan/go-websocket/pkg/etcd"
 	"github.com/woodylan/go-websocket/pkg/setting"
 	"github.com/woodylan/go-websocket/routers"
 	"github.com/woodylan/go-websocket/servers"
 	"github.com/woodylan/go-websocket/tools/log"
 	"github.com/woodylan/go-websocket/tools/util"
-	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func init() {
@@ -23,11 +25,21 @@ func init() {
 
 func main() {
 
-	//初始化RPC服务
-	initRPCServer()
+	//校验clientId的密钥配置
+	if err := util.CheckClientIdKeys(); err != nil {
+		panic(err)
+	}
+
+	//初始化离线消息存储
+	if err := servers.InitOfflineStore(); err != nil {
+		panic(err)
+	}
+
+	//集群模式下监听etcd中的系统账号,查询时使用本地缓存
+	servers.InitSystems()
 
-	//将服务器地址、端口注册到eTcd中
-	registerServer()
+	//初始化集群通信,grpc方式会将服务器地址、端口注册到eTcd中
+	initBackplane()
 
 	//初始化路由
 	routers.Init()
@@ -35,45 +47,63 @@ func main() {
 	//启动一个定时器用来发送心跳
 	servers.PingTimer()
 
+	server := &http.Server{Addr: ":" + setting.CommonSetting.HttpPort}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
 	fmt.Printf("服务器启动成功，端口号：%s\n", setting.CommonSetting.HttpPort)
 
-	if err := http.ListenAndServe(":"+setting.CommonSetting.HttpPort, nil); err != nil {
-		panic(err)
-	}
-}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 
-func initRPCServer() {
-	//如果是集群，则启用RPC进行通讯
-	if util.IsCluster() {
-		//初始化RPC服务
-		servers.InitGRpcServer()
-		fmt.Printf("启动RPC，端口号：%s\n", setting.CommonSetting.RPCPort)
-	}
+	fmt.Println("服务器正在关闭")
+	shutdown(server)
+	fmt.Println("服务器已关闭")
 }
 
-//eTcd注册发现GRpc服务
-func registerServer() {
-	if util.IsCluster() {
-		//注册租约
-		ser, err := etcd.NewServiceReg(setting.EtcdSetting.Endpoints, 5)
-		if err != nil {
-			panic(err)
-		}
+//按顺序关闭：离开集群、通知客户端重连、停止接收请求、等待集群调用完成、关闭剩余的连接、等待回调发送完成
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(setting.CommonSetting.ShutdownWait)*time.Second)
+	defer cancel()
 
-		hostPort := net.JoinHostPort(setting.GlobalSetting.LocalHost, setting.CommonSetting.RPCPort)
-		//添加key
-		err = ser.PutService(define.ETcdServerList+hostPort, hostPort)
-		if err != nil {
-			panic(err)
+	//先从集群中移除,其他节点不再把消息转发到本机
+	if servers.Cluster != nil {
+		if err := servers.Cluster.Leave(); err != nil {
+			fmt.Printf("离开集群失败：%v\n", err)
 		}
+	}
 
-		cli, err := etcd.NewClientDis(setting.EtcdSetting.Endpoints)
-		if err != nil {
-			panic(err)
+	servers.Drain(ctx)
+
+	//websocket连接已经被接管,不会阻塞http服务的关闭
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("关闭http服务失败：%v\n", err)
+	}
+
+	if servers.Cluster != nil {
+		if err := servers.Cluster.Close(); err != nil {
+			fmt.Printf("关闭集群通信失败：%v\n", err)
 		}
-		_, err = cli.GetService(define.ETcdServerList)
-		if err != nil {
+	}
+
+	servers.CloseClients(ctx)
+
+	//等待断开连接的回调发送完成
+	if !servers.Webhooks.Flush(ctx) {
+		fmt.Println("等待回调发送超时")
+	}
+}
+
+//如果是集群，则初始化节点之间的通信
+func initBackplane() {
+	if util.IsCluster() {
+		if err := servers.InitBackplane(); err != nil {
 			panic(err)
 		}
+		fmt.Printf("启动集群通信：%s\n", setting.BackplaneSetting.Type)
 	}
 }
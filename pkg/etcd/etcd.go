@@ -37,7 +37,69 @@ func Put(key, value string) error {
 	return err
 }
 
+//key不存在时写入,返回是否写入成功和写入后的版本号
+func Create(key, value string) (bool, int64, error) {
+	resp, err := GetInstance().Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+//key的修改版本号没有变化时写入,返回是否写入成功和写入后的版本号
+func PutIfModRevision(key, value string, modRevision int64) (bool, int64, error) {
+	resp, err := GetInstance().Txn(context.Background()).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+//key不存在时写入并设置过期时间,返回是否写入成功
+func PutIfNotExist(key, value string, ttl int64) (bool, error) {
+	client := GetInstance()
+	lease, err := client.Grant(context.Background(), ttl)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		//没有写入时释放租约,避免租约一直留到过期
+		_, _ = client.Revoke(context.Background(), lease.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
 func Get(key string) (resp *clientv3.GetResponse, err error) {
 	resp, err = GetInstance().Get(context.Background(), key)
 	return resp, err
 }
+
+func Delete(key string) error {
+	_, err := GetInstance().Delete(context.Background(), key)
+	return err
+}
+
+//获取前缀下的所有key
+func GetPrefix(prefix string) (resp *clientv3.GetResponse, err error) {
+	resp, err = GetInstance().Get(context.Background(), prefix, clientv3.WithPrefix())
+	return resp, err
+}
+
+//从指定版本开始监听前缀下的变化
+func WatchPrefix(ctx context.Context, prefix string, rev int64) clientv3.WatchChan {
+	return GetInstance().Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev))
+}
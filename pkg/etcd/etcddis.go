@@ -10,7 +10,8 @@ import (
 )
 
 type ClientDis struct {
-	client *clientv3.Client
+	client   *clientv3.Client
+	OnDelete func(addr string) // 服务下线或者地址变更时的回调,用于关闭到该服务的连接
 }
 
 func NewClientDis(addr []string) (*ClientDis, error) {
@@ -68,14 +69,24 @@ func (this *ClientDis) extractAddrs(resp *clientv3.GetResponse) []string {
 
 func (this *ClientDis) SetServiceList(key, val string) {
 	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
+	old, ok := setting.GlobalSetting.ServerList[key]
 	setting.GlobalSetting.ServerList[key] = val
+	setting.GlobalSetting.ServerListLock.Unlock()
 	log.Info("发现服务：", key, " 地址:", val)
+
+	if ok && old != val && this.OnDelete != nil {
+		this.OnDelete(old)
+	}
 }
 
 func (this *ClientDis) DelServiceList(key string) {
 	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
+	addr, ok := setting.GlobalSetting.ServerList[key]
 	delete(setting.GlobalSetting.ServerList, key)
+	setting.GlobalSetting.ServerListLock.Unlock()
 	log.Println("服务下线:", key)
+
+	if ok && this.OnDelete != nil {
+		this.OnDelete(addr)
+	}
 }
@@ -87,6 +87,13 @@ func (this *ServiceReg) PutService(key, val string) error {
 	return err
 }
 
+//删除注册的key
+func (this *ServiceReg) DelService(key string) error {
+	kv := clientv3.NewKV(this.client)
+	_, err := kv.Delete(context.TODO(), key)
+	return err
+}
+
 //撤销租约
 func (this *ServiceReg) RevokeLease() error {
 	this.canclefunc()
@@ -0,0 +1,343 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 默认的耗时分布区间，单位：秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 一条带标签的数据
+type Sample struct {
+	Labels []string // 标签值，顺序与定义时的标签名一致
+	Value  float64
+}
+
+// 指标，按Prometheus文本格式输出
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// 指标注册表
+type Registry struct {
+	lock       sync.RWMutex
+	names      map[string]bool
+	collectors []collector
+}
+
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// 按注册顺序输出所有指标
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.RLock()
+	collectors := append([]collector{}, r.collectors...)
+	r.lock.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// 输出指标的http处理函数
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+func (d desc) writeSample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	_, _ = w.WriteString(d.name + suffix)
+	pairs := make([]string, 0, len(d.labels)+1)
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	if len(extra) > 0 {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	_, _ = w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func (d desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(n int, key func(i int) string) []int {
+	index := make([]int, n)
+	for i := range index {
+		index[i] = i
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return key(index[i]) < key(index[j])
+	})
+	return index
+}
+
+// 只增不减的计数
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// 按标签区分的计数
+type CounterVec struct {
+	desc
+	lock   sync.RWMutex
+	values map[string]*Counter
+	labels map[string][]string
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*Counter),
+		labels: make(map[string][]string),
+	}
+	r.register(name, c)
+	return c
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// 获取标签值对应的计数，不存在则创建
+func (c *CounterVec) With(values ...string) *Counter {
+	c.check(values)
+	key := labelKey(values)
+
+	c.lock.RLock()
+	counter, ok := c.values[key]
+	c.lock.RUnlock()
+	if ok {
+		return counter
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if counter, ok = c.values[key]; !ok {
+		counter = &Counter{}
+		c.values[key] = counter
+		c.labels[key] = append([]string{}, values...)
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	c.writeHeader(w)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.writeSample(w, "", c.labels[key], "", float64(c.values[key].Value()))
+	}
+}
+
+// 输出时才计算的数值，例如当前的连接数
+type GaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name: name, help: help, typ: "gauge", labels: labels},
+		fn:   fn,
+	}
+	r.register(name, g)
+	return g
+}
+
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+	return Default.NewGaugeFunc(name, help, labels, fn)
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	samples := g.fn()
+	g.writeHeader(w)
+	for _, i := range sortedKeys(len(samples), func(i int) string { return labelKey(samples[i].Labels) }) {
+		g.check(samples[i].Labels)
+		g.writeSample(w, "", samples[i].Labels, "", samples[i].Value)
+	}
+}
+
+// 数值的分布
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// 按标签区分的分布
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.RWMutex
+	values  map[string]*Histogram
+	labels  map[string][]string
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*Histogram),
+		labels:  make(map[string][]string),
+	}
+	r.register(name, h)
+	return h
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// 获取标签值对应的分布，不存在则创建
+func (h *HistogramVec) With(values ...string) *Histogram {
+	h.check(values)
+	key := labelKey(values)
+
+	h.lock.RLock()
+	histogram, ok := h.values[key]
+	h.lock.RUnlock()
+	if ok {
+		return histogram
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if histogram, ok = h.values[key]; !ok {
+		histogram = &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = histogram
+		h.labels[key] = append([]string{}, values...)
+	}
+	return histogram
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		histogram := h.values[key]
+		values := h.labels[key]
+
+		histogram.lock.Lock()
+		for i, upper := range histogram.buckets {
+			h.writeSample(w, "_bucket", values, `le="`+formatFloat(upper)+`"`, float64(histogram.counts[i]))
+		}
+		h.writeSample(w, "_bucket", values, `le="+Inf"`, float64(histogram.count))
+		h.writeSample(w, "_sum", values, "", histogram.sum)
+		h.writeSample(w, "_count", values, "", float64(histogram.count))
+		histogram.lock.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func output(r *Registry) string {
+	buf := &bytes.Buffer{}
+	_ = r.Write(buf)
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	Convey("测试计数", t, func() {
+		r := NewRegistry()
+		counter := r.NewCounterVec("gws_test_total", "测试计数", "reason")
+		counter.With("kicked").Inc()
+		counter.With("kicked").Add(2)
+		counter.With(`a"b`).Inc()
+
+		So(counter.With("kicked").Value(), ShouldEqual, 3)
+		So(output(r), ShouldEqual, "# HELP gws_test_total 测试计数\n"+
+			"# TYPE gws_test_total counter\n"+
+			`gws_test_total{reason="a\"b"} 1`+"\n"+
+			`gws_test_total{reason="kicked"} 3`+"\n")
+
+		So(func() { counter.With() }, ShouldPanic)
+		So(func() { r.NewCounterVec("gws_test_total", "重复") }, ShouldPanic)
+	})
+}
+
+func TestGaugeFunc(t *testing.T) {
+	Convey("测试输出时计算的数值", t, func() {
+		r := NewRegistry()
+		r.NewGaugeFunc("gws_test_connections", "连接数", []string{"system_id"}, func() []Sample {
+			return []Sample{{Labels: []string{"b"}, Value: 2}, {Labels: []string{"a"}, Value: 1}}
+		})
+
+		So(output(r), ShouldEqual, "# HELP gws_test_connections 连接数\n"+
+			"# TYPE gws_test_connections gauge\n"+
+			`gws_test_connections{system_id="a"} 1`+"\n"+
+			`gws_test_connections{system_id="b"} 2`+"\n")
+	})
+}
+
+func TestHistogramVec(t *testing.T) {
+	Convey("测试分布", t, func() {
+		r := NewRegistry()
+		histogram := r.NewHistogramVec("gws_test_seconds", "耗时", []float64{1, 0.1}, "method")
+		histogram.With("Send2Group").Observe(0.05)
+		histogram.With("Send2Group").Observe(0.5)
+		histogram.With("Send2Group").Observe(5)
+
+		So(output(r), ShouldEqual, "# HELP gws_test_seconds 耗时\n"+
+			"# TYPE gws_test_seconds histogram\n"+
+			`gws_test_seconds_bucket{method="Send2Group",le="0.1"} 1`+"\n"+
+			`gws_test_seconds_bucket{method="Send2Group",le="1"} 2`+"\n"+
+			`gws_test_seconds_bucket{method="Send2Group",le="+Inf"} 3`+"\n"+
+			`gws_test_seconds_sum{method="Send2Group"} 5.55`+"\n"+
+			`gws_test_seconds_count{method="Send2Group"} 3`+"\n")
+	})
+}
+
+func TestHandler(t *testing.T) {
+	Convey("测试输出接口", t, func() {
+		r := NewRegistry()
+		r.NewCounterVec("gws_test_total", "测试计数").With().Inc()
+
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		So(w.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+		So(strings.HasSuffix(w.Body.String(), "gws_test_total 1\n"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,170 @@
+package offline
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var bucketName = []byte("offline")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// 每个用户一个子bucket,key为自增序号,保证按保存顺序取出
+func (s *boltStore) Save(msg Message) error {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketName).CreateBucketIfNotExists([]byte(userKey(msg.SystemId, msg.UserId)))
+		if err != nil {
+			return err
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, value)
+	})
+}
+
+func (s *boltStore) Peek(systemId, userId string) (messages []Message, err error) {
+	now := time.Now().Unix()
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName).Bucket([]byte(userKey(systemId, userId)))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if msg.ExpireTime > now {
+				messages = append(messages, msg)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func (s *boltStore) Delete(systemId, userId string, messageIds []string) error {
+	deleted := make(map[string]struct{}, len(messageIds))
+	for _, messageId := range messageIds {
+		deleted[messageId] = struct{}{}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketName)
+		key := []byte(userKey(systemId, userId))
+		bucket := root.Bucket(key)
+		if bucket == nil {
+			return nil
+		}
+
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if _, ok := deleted[msg.MessageId]; ok {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if bucket.Stats().KeyN == 0 {
+			return root.DeleteBucket(key)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Purge(now int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketName)
+
+		var emptyBuckets [][]byte
+		err := root.ForEach(func(name, _ []byte) error {
+			bucket := root.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+
+			var expired [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				var msg Message
+				if err := json.Unmarshal(v, &msg); err != nil || msg.ExpireTime <= now {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			if bucket.Stats().KeyN == 0 {
+				emptyBuckets = append(emptyBuckets, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range emptyBuckets {
+			if err := root.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
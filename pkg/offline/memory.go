@@ -0,0 +1,87 @@
+package offline
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	lock     sync.Mutex
+	messages map[string][]Message // key为systemId:userId
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		messages: make(map[string][]Message),
+	}
+}
+
+func (s *memoryStore) Save(msg Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := userKey(msg.SystemId, msg.UserId)
+	s.messages[key] = append(s.messages[key], msg)
+	return nil
+}
+
+func (s *memoryStore) Peek(systemId, userId string) (messages []Message, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().Unix()
+	for _, msg := range s.messages[userKey(systemId, userId)] {
+		if msg.ExpireTime > now {
+			messages = append(messages, msg)
+		}
+	}
+	return
+}
+
+func (s *memoryStore) Delete(systemId, userId string, messageIds []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deleted := make(map[string]struct{}, len(messageIds))
+	for _, messageId := range messageIds {
+		deleted[messageId] = struct{}{}
+	}
+
+	key := userKey(systemId, userId)
+	var remain []Message
+	for _, msg := range s.messages[key] {
+		if _, ok := deleted[msg.MessageId]; !ok {
+			remain = append(remain, msg)
+		}
+	}
+	if len(remain) == 0 {
+		delete(s.messages, key)
+	} else {
+		s.messages[key] = remain
+	}
+	return nil
+}
+
+func (s *memoryStore) Purge(now int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, list := range s.messages {
+		var remain []Message
+		for _, msg := range list {
+			if msg.ExpireTime > now {
+				remain = append(remain, msg)
+			}
+		}
+		if len(remain) == 0 {
+			delete(s.messages, key)
+		} else {
+			s.messages[key] = remain
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package offline
+
+import (
+	"errors"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"strconv"
+)
+
+// 离线消息
+type Message struct {
+	MessageId  string `json:"messageId"`
+	SystemId   string `json:"systemId"`
+	UserId     string `json:"userId"`
+	SendUserId string `json:"sendUserId"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Data       string `json:"data"`
+	CreateTime int64  `json:"createTime"` // 保存时间，单位：纳秒，用于排序
+	ExpireTime int64  `json:"expireTime"` // 过期时间，单位：秒
+}
+
+// 离线消息存储
+type Store interface {
+	// 保存一条离线消息
+	Save(msg Message) error
+	// 按保存顺序返回用户所有未过期的离线消息，不删除
+	Peek(systemId, userId string) ([]Message, error)
+	// 删除已经投递的离线消息
+	Delete(systemId, userId string, messageIds []string) error
+	// 清理所有过期的离线消息
+	Purge(now int64) error
+	Close() error
+}
+
+const (
+	// 使用bolt文件存储
+	StoreBolt = "bolt"
+	// 使用内存存储,重启后丢失
+	StoreMemory = "memory"
+)
+
+// 根据配置创建离线消息存储,未配置时返回nil表示不启用
+func New() (Store, error) {
+	switch setting.OfflineSetting.Store {
+	case "":
+		return nil, nil
+	case StoreBolt:
+		return NewBoltStore(setting.OfflineSetting.Path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, errors.New("不支持的离线消息存储方式：" + setting.OfflineSetting.Store)
+	}
+}
+
+// systemId前面加上长度,systemId和userId中包含":"时也不会和其他用户的key相同
+func userKey(systemId, userId string) string {
+	return strconv.Itoa(len(systemId)) + ":" + systemId + ":" + userId
+}
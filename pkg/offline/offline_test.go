@@ -0,0 +1,100 @@
+package offline
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(store Store) {
+	now := time.Now().Unix()
+
+	Convey("按顺序读取未过期的消息,删除之后不再返回", func() {
+		_ = store.Save(Message{MessageId: "1", SystemId: "publishSystem", UserId: "userId", ExpireTime: now + 60})
+		_ = store.Save(Message{MessageId: "2", SystemId: "publishSystem", UserId: "userId", ExpireTime: now - 1})
+		_ = store.Save(Message{MessageId: "3", SystemId: "publishSystem", UserId: "userId", ExpireTime: now + 60})
+
+		messages, err := store.Peek("publishSystem", "userId")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].MessageId, ShouldEqual, "1")
+		So(messages[1].MessageId, ShouldEqual, "3")
+
+		//读取不删除,投递成功之后再删除
+		So(store.Delete("publishSystem", "userId", []string{"1"}), ShouldBeNil)
+		messages, err = store.Peek("publishSystem", "userId")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].MessageId, ShouldEqual, "3")
+	})
+
+	Convey("不同系统的消息互相隔离", func() {
+		_ = store.Save(Message{MessageId: "1", SystemId: "publishSystem", UserId: "userId", ExpireTime: now + 60})
+
+		messages, err := store.Peek("otherSystem", "userId")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 0)
+
+		messages, err = store.Peek("publishSystem", "userId")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 1)
+	})
+
+	Convey("系统ID和用户ID中包含冒号时互相隔离", func() {
+		_ = store.Save(Message{MessageId: "1", SystemId: "a:b", UserId: "c", ExpireTime: now + 60})
+
+		messages, err := store.Peek("a", "b:c")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 0)
+
+		messages, err = store.Peek("a:b", "c")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 1)
+		_ = store.Delete("a:b", "c", []string{"1"})
+	})
+
+	Convey("清理过期的消息", func() {
+		_ = store.Save(Message{MessageId: "1", SystemId: "publishSystem", UserId: "userId", ExpireTime: now - 1})
+		_ = store.Save(Message{MessageId: "2", SystemId: "publishSystem", UserId: "userId", ExpireTime: now + 60})
+
+		So(store.Purge(now), ShouldBeNil)
+		messages, err := store.Peek("publishSystem", "userId")
+		So(err, ShouldBeNil)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].MessageId, ShouldEqual, "2")
+	})
+
+	Reset(func() {
+		_ = store.Delete("publishSystem", "userId", []string{"1", "2", "3"})
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	Convey("测试内存离线消息存储", t, func() {
+		testStore(store)
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	Convey("测试bolt离线消息存储", t, func() {
+		testStore(store)
+	})
+}
@@ -16,10 +16,24 @@ type commonConf struct {
 	HttpPort       string
 	RPCPort        string
 	Cluster        bool
-	CryptoKey      string
+	CryptoKey      string   //旧版clientId的AES-CBC密钥，只用于迁移期间解析旧版clientId，为空则不再解析
+	ClientIdKeys   []string //clientId的密钥列表，格式为 密钥ID:密钥，第一个用于生成新的clientId
 	MaxMessageSize int64
 	ReadBuffer     int
 	WriteBuffer    int
+	SendQueueSize  int    //每个客户端发送队列的长度
+	SlowPolicy     string //发送队列满时的处理策略：dropOldest|dropNewest|disconnect
+	AckTimeout     int    //等待客户端确认消息的超时时间，单位：秒
+	AckMaxRetry    int    //客户端未确认时消息的最大重发次数
+	ResumeWindow   int    //连接断开后保留会话等待重连的时间，单位：秒，为0则不保留
+	ApiSign        bool   //是否校验接口请求签名
+	SignExpire     int    //签名的有效时间，单位：秒，超过该时间的请求会被拒绝
+	ApiKeyGrace    int    //轮换API密钥后旧密钥的保留时间，单位：秒
+	AdminToken     string //管理接口的凭证，为空则不开放管理接口
+	RPCTimeout     int    //调用其他节点的超时时间，单位：秒
+	DrainWindow    int    //关闭时通知客户端重连的最大随机延迟，单位：秒
+	ShutdownWait   int    //关闭服务器的最长等待时间，单位：秒
+	Compression    bool   //是否启用permessage-deflate压缩，客户端也支持时才生效
 }
 
 var CommonSetting = &commonConf{}
@@ -30,6 +44,20 @@ type etcdConf struct {
 
 var EtcdSetting = &etcdConf{}
 
+type backplaneConf struct {
+	Type string //集群节点之间的通信方式：grpc|redis
+}
+
+var BackplaneSetting = &backplaneConf{}
+
+type redisConf struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+var RedisSetting = &redisConf{}
+
 type global struct {
 	LocalHost      string //本机内网IP
 	ServerList     map[string]string
@@ -45,6 +73,46 @@ type logConf struct {
 
 var LogSetting = &logConf{}
 
+type offlineConf struct {
+	Store string //离线消息存储方式：bolt|memory，为空则不启用
+	Path  string //bolt存储的文件路径
+	TTL   int64  //离线消息默认保存时间，单位：秒
+}
+
+var OfflineSetting = &offlineConf{}
+
+type rateLimitConf struct {
+	ClientRate   float64 //每个连接每秒发送事件的次数，为0则不限制
+	ClientBurst  int     //每个连接允许的突发次数，为0则等于每秒的次数
+	UserRate     float64 //同一系统中每个userId的所有连接每秒发送事件的次数
+	UserBurst    int
+	SystemRate   float64 //每个系统的所有连接每秒发送事件的次数
+	SystemBurst  int
+	ApiRate      float64 //每个系统每秒调用发送接口的次数
+	ApiBurst     int
+	MaxClientIds int //单次批量发送的clientIds数量上限，为0则不限制
+	KickAfter    int //连续被限流的次数达到该值时断开连接，为0则不断开
+}
+
+var RateLimitSetting = &rateLimitConf{}
+
+type webhookConf struct {
+	QueueSize int //等待发送的回调数量上限，队列满时丢弃新的回调
+	Workers   int //发送回调的协程数
+	Timeout   int //每次回调的超时时间，单位：秒
+	MaxRetry  int //回调失败后的最大重试次数
+}
+
+var WebhookSetting = &webhookConf{}
+
+type presenceConf struct {
+	LastSeenTTL      int64 //用户最后在线时间的保存时间，单位：秒
+	MaxUserIds       int   //单次批量查询的userIds数量上限，为0则不限制
+	MaxSubscriptions int   //每个连接订阅的用户数上限，为0则不限制
+}
+
+var PresenceSetting = &presenceConf{}
+
 var cfg *ini.File
 
 var (
@@ -71,7 +139,13 @@ func Setup() {
 
 	mapTo("common", CommonSetting)
 	mapTo("etcd", EtcdSetting)
+	mapTo("backplane", BackplaneSetting)
+	mapTo("redis", RedisSetting)
 	mapTo("logfile", LogSetting)
+	mapTo("offline", OfflineSetting)
+	mapTo("ratelimit", RateLimitSetting)
+	mapTo("webhook", WebhookSetting)
+	mapTo("presence", PresenceSetting)
 
 	GlobalSetting = &global{
 		LocalHost:  GetIntranetIp(),
@@ -83,11 +157,22 @@ func Default() {
 	CommonSetting = &commonConf{
 		HttpPort:       "6000",
 		RPCPort:        "7000",
+		RPCTimeout:     3,
 		Cluster:        false,
 		CryptoKey:      "axRArfEfJw7V0te6",
+		ClientIdKeys:   []string{"1:pRDUgcNlLasdfAj0nSuy7K3XqFzTmWbE"},
 		MaxMessageSize: 8192,
 		ReadBuffer:     1024,
 		WriteBuffer:    1024,
+		SendQueueSize:  256,
+		SlowPolicy:     "dropOldest",
+		AckTimeout:     10,
+		AckMaxRetry:    3,
+		ApiSign:        true,
+		SignExpire:     300,
+		ApiKeyGrace:    3600,
+		DrainWindow:    10,
+		ShutdownWait:   30,
 	}
 
 	GlobalSetting = &global{
@@ -95,10 +180,45 @@ func Default() {
 		ServerList: make(map[string]string),
 	}
 
+	BackplaneSetting = &backplaneConf{
+		Type: "grpc",
+	}
+
+	RedisSetting = &redisConf{
+		Addr: "127.0.0.1:6379",
+	}
+
 	LogSetting = &logConf{
 		BasePath: CurrentDirectory(),
 		MaxAge:   30,
 	}
+
+	OfflineSetting = &offlineConf{
+		Store: "",
+		Path:  "offline.db",
+		TTL:   86400,
+	}
+
+	RateLimitSetting = &rateLimitConf{
+		ClientRate:   20,
+		ClientBurst:  40,
+		UserRate:     50,
+		UserBurst:    100,
+		MaxClientIds: 1000,
+	}
+
+	WebhookSetting = &webhookConf{
+		QueueSize: 10000,
+		Workers:   8,
+		Timeout:   3,
+		MaxRetry:  3,
+	}
+
+	PresenceSetting = &presenceConf{
+		LastSeenTTL:      604800,
+		MaxUserIds:       1000,
+		MaxSubscriptions: 1000,
+	}
 }
 
 // mapTo map section
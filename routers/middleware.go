@@ -2,15 +2,16 @@ package routers
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	log "github.com/sirupsen/logrus"
 	"github.com/woodylan/go-websocket/api"
-	"github.com/woodylan/go-websocket/define"
 	"github.com/woodylan/go-websocket/define/retcode"
-	"github.com/woodylan/go-websocket/pkg/etcd"
+	"github.com/woodylan/go-websocket/pkg/setting"
 	"github.com/woodylan/go-websocket/servers"
-	"github.com/woodylan/go-websocket/tools/util"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 type nameSpace struct {
@@ -18,56 +19,108 @@ type nameSpace struct {
 }
 
 func AccessTokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return accessToken(next, false)
+}
+
+//管理密钥的接口总是校验签名,签名关闭时没有密钥的系统只能通过管理接口获取密钥
+func SignedMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return accessToken(next, true)
+}
+
+func accessToken(next http.HandlerFunc, signed bool) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//请求体读取出来,用于校验签名和获取systemId
+		bodyBytes, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+
 		//解析参数
 		systemId := r.FormValue("systemId")
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) //原始请求内容在放到请求体中，后续的处理要用到
 
-		if len(systemId) == 0 {
-			//检查header是否设置SystemId,header中设置或者在请求体中设置都可以
+		//url、header和请求体中都可以设置systemId,同时设置时必须一致,避免签名的系统和实际操作的系统不同
+		headerSystemId := r.Header.Get("SystemId")
+		ns := &nameSpace{}
+		_ = json.Unmarshal(bodyBytes, ns)
+		for _, id := range []string{headerSystemId, ns.SystemId} {
+			if len(id) == 0 {
+				continue
+			}
 			if len(systemId) == 0 {
-				systemId = r.Header.Get("SystemId")
+				systemId = id
+			} else if id != systemId {
+				api.Render(w, retcode.SystemIdErrCode, "系统ID不一致", []string{})
+				return
 			}
+		}
 
+		if len(systemId) == 0 {
 			// 如果请求头和url中都没有systemId参数，则只处理post请求，get请求会报错
 			if r.Method != http.MethodPost {
 				w.WriteHeader(http.StatusMethodNotAllowed)
 				return
 			}
 
-			bodyBytes, _ := ioutil.ReadAll(r.Body) //请求体读取出来,看有没有传systemId
-			//log.Infof("原始请求内容:[%s]" , string(bodyBytes))
-			ns := &nameSpace{}
-			var err error
-			if err = json.Unmarshal(bodyBytes, ns); err == nil {
-				systemId = ns.SystemId
-			}
-			//log.Infof("请求内容反序列化时报错:[%+v]", err)
-			//log.Infof("请求内容反序列化为:[%+v]", ns)
-			r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) //原始请求内容在放到请求体中，后续的处理要用到
+			api.Render(w, retcode.SystemIdErrCode, "系统ID不能为空", []string{})
+			return
 		}
 
-		if len(systemId) == 0 {
-			api.Render(w, retcode.SystemIdErrCode, "系统ID不能为空", []string{})
+		//判断是否被注册以及是否停用,集群模式下使用本地缓存,etcd不可用时使用最后一次同步的状态
+		switch err := servers.CheckSystem(systemId); err {
+		case nil:
+		case servers.ErrSystemNotRegistered:
+			api.Render(w, retcode.SystemIdErrCode, "系统ID无效", []string{})
+			return
+		case servers.ErrSystemSuspended:
+			api.Render(w, retcode.SuspendedErrCode, "系统已停用", []string{})
+			return
+		default:
+			api.Render(w, retcode.FAIL, "etcd服务器错误", []string{})
 			return
 		}
 
-		//判断是否被注册
-		if util.IsCluster() {
-			resp, err := etcd.Get(define.ETcdPrefixAccountInfo + systemId)
-			if err != nil {
-				api.Render(w, retcode.FAIL, "etcd服务器错误", []string{})
+		//校验请求签名,已经有密钥的系统即使关闭了签名也要校验
+		if signed || setting.CommonSetting.ApiSign || servers.HasApiKey(systemId) {
+			if err := servers.CheckApiSignature(systemId, r, bodyBytes); err != nil {
+				log.WithFields(log.Fields{
+					"host":     setting.GlobalSetting.LocalHost,
+					"port":     setting.CommonSetting.HttpPort,
+					"systemId": systemId,
+					"uri":      r.URL.RequestURI(),
+				}).Warn("接口签名校验失败: " + err.Error())
+				if err == servers.ErrNonceUnavailable {
+					api.Render(w, retcode.ETcdErrCode, "etcd服务器错误", []string{})
+					return
+				}
+				api.Render(w, retcode.SignErrCode, err.Error(), []string{})
 				return
 			}
+		}
 
-			if resp.Count == 0 {
-				api.Render(w, retcode.SystemIdErrCode, "系统ID无效", []string{})
-				return
-			}
-		} else {
-			if _, ok := servers.SystemMap.Load(systemId); !ok {
-				api.Render(w, retcode.SystemIdErrCode, "系统ID无效", []string{})
-				return
-			}
+		//后续的处理统一使用校验过的systemId
+		r.Header.Set("SystemId", systemId)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//校验管理接口的凭证,请求头为 Authorization: Bearer <AdminToken>,未配置AdminToken时不开放管理接口
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := setting.CommonSetting.AdminToken
+		if len(adminToken) == 0 {
+			api.RenderStatus(w, http.StatusForbidden, retcode.AdminErrCode, "未开放管理接口", []string{})
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			log.WithFields(log.Fields{
+				"host": setting.GlobalSetting.LocalHost,
+				"port": setting.CommonSetting.HttpPort,
+				"uri":  r.URL.RequestURI(),
+			}).Warn("管理凭证无效")
+			api.RenderStatus(w, http.StatusUnauthorized, retcode.AdminErrCode, "管理凭证无效", []string{})
+			return
 		}
 
 		next.ServeHTTP(w, r)
@@ -2,14 +2,30 @@ package routers
 
 import (
 	"github.com/woodylan/go-websocket/api/bind2group"
+	"github.com/woodylan/go-websocket/api/clientgroups"
 	"github.com/woodylan/go-websocket/api/closeclient"
+	"github.com/woodylan/go-websocket/api/dissolvegroup"
 	"github.com/woodylan/go-websocket/api/getonlinelist"
 	"github.com/woodylan/go-websocket/api/getuserclients"
+	"github.com/woodylan/go-websocket/api/leavegroup"
+	"github.com/woodylan/go-websocket/api/messagestatus"
+	"github.com/woodylan/go-websocket/api/presenceonline"
+	"github.com/woodylan/go-websocket/api/presenceuser"
 	"github.com/woodylan/go-websocket/api/register"
+	"github.com/woodylan/go-websocket/api/revokekey"
+	"github.com/woodylan/go-websocket/api/rotatekey"
 	"github.com/woodylan/go-websocket/api/send2client"
 	"github.com/woodylan/go-websocket/api/send2clients"
 	"github.com/woodylan/go-websocket/api/send2group"
 	"github.com/woodylan/go-websocket/api/send2user"
+	"github.com/woodylan/go-websocket/api/systemactivate"
+	"github.com/woodylan/go-websocket/api/systemdelete"
+	"github.com/woodylan/go-websocket/api/systeminfo"
+	"github.com/woodylan/go-websocket/api/systemlist"
+	"github.com/woodylan/go-websocket/api/systemsuspend"
+	"github.com/woodylan/go-websocket/api/systemupdate"
+	"github.com/woodylan/go-websocket/api/unbindgroup"
+	"github.com/woodylan/go-websocket/pkg/metrics"
 	"github.com/woodylan/go-websocket/servers"
 	"io"
 	"net/http"
@@ -18,6 +34,7 @@ import (
 func Init() {
 
 	http.HandleFunc("/health", Health)
+	http.Handle("/metrics", metrics.Handler())
 
 	//Rest Api
 	registerHandler := &register.Controller{}
@@ -25,13 +42,32 @@ func Init() {
 	sendToClientsHandler := &send2clients.Controller{}
 	sendToGroupHandler := &send2group.Controller{}
 	bindToGroupHandler := &bind2group.Controller{}
+	unbindGroupHandler := &unbindgroup.Controller{}
+	leaveGroupHandler := &leavegroup.Controller{}
+	clientGroupsHandler := &clientgroups.Controller{}
+	dissolveGroupHandler := &dissolvegroup.Controller{}
 	sendToUserHandler := &send2user.Controller{}
 	getGroupListHandler := &getonlinelist.Controller{}
 	getUserClientsHandler := &getuserclients.Controller{}
 	closeClientHandler := &closeclient.Controller{}
+	messageStatusHandler := &messagestatus.Controller{}
+	presenceOnlineHandler := &presenceonline.Controller{}
+	presenceUserHandler := &presenceuser.Controller{}
+	rotateKeyHandler := &rotatekey.Controller{}
+	revokeKeyHandler := &revokekey.Controller{}
+	systemListHandler := &systemlist.Controller{}
+	systemInfoHandler := &systeminfo.Controller{}
+	systemUpdateHandler := &systemupdate.Controller{}
+	systemSuspendHandler := &systemsuspend.Controller{}
+	systemActivateHandler := &systemactivate.Controller{}
+	systemDeleteHandler := &systemdelete.Controller{}
 
 	http.HandleFunc("/api/register", registerHandler.Run)
 	http.HandleFunc("/api/bind/2/group", AccessTokenMiddleware(bindToGroupHandler.Run))
+	http.HandleFunc("/api/group/unbind", AccessTokenMiddleware(unbindGroupHandler.Run))
+	http.HandleFunc("/api/group/leave", AccessTokenMiddleware(leaveGroupHandler.Run))
+	http.HandleFunc("/api/group/dissolve", AccessTokenMiddleware(dissolveGroupHandler.Run))
+	http.HandleFunc("/api/client/groups", AccessTokenMiddleware(clientGroupsHandler.Run))
 	http.HandleFunc("/api/group/list", AccessTokenMiddleware(getGroupListHandler.Run))
 	http.HandleFunc("/api/user/list", AccessTokenMiddleware(getUserClientsHandler.Run))
 	http.HandleFunc("/api/send/2/client", AccessTokenMiddleware(sendToClientHandler.Run))
@@ -39,18 +75,41 @@ func Init() {
 	http.HandleFunc("/api/send/2/group", AccessTokenMiddleware(sendToGroupHandler.Run))
 	http.HandleFunc("/api/send/2/user", AccessTokenMiddleware(sendToUserHandler.Run))
 	http.HandleFunc("/api/close/client", AccessTokenMiddleware(closeClientHandler.Run))
+	http.HandleFunc("/api/message/status", AccessTokenMiddleware(messageStatusHandler.Run))
+	http.HandleFunc("/api/presence/online", AccessTokenMiddleware(presenceOnlineHandler.Run))
+	http.HandleFunc("/api/presence/user", AccessTokenMiddleware(presenceUserHandler.Run))
+	http.HandleFunc("/api/key/rotate", SignedMiddleware(rotateKeyHandler.Run))
+	http.HandleFunc("/api/key/revoke", SignedMiddleware(revokeKeyHandler.Run))
+
+	//管理接口
+	http.HandleFunc("/api/system/list", AdminMiddleware(systemListHandler.Run))
+	http.HandleFunc("/api/system/info", AdminMiddleware(systemInfoHandler.Run))
+	http.HandleFunc("/api/system/update", AdminMiddleware(systemUpdateHandler.Run))
+	http.HandleFunc("/api/system/suspend", AdminMiddleware(systemSuspendHandler.Run))
+	http.HandleFunc("/api/system/activate", AdminMiddleware(systemActivateHandler.Run))
+	http.HandleFunc("/api/system/delete", AdminMiddleware(systemDeleteHandler.Run))
+	//旧系统没有API密钥时通过管理接口生成第一个密钥
+	http.HandleFunc("/api/system/key/rotate", AdminMiddleware(rotateKeyHandler.Run))
+	http.HandleFunc("/api/system/key/revoke", AdminMiddleware(revokeKeyHandler.Run))
+	//不传systemId时查询所有系统
+	http.HandleFunc("/api/system/presence/online", AdminMiddleware(presenceOnlineHandler.Run))
+	http.HandleFunc("/api/system/presence/user", AdminMiddleware(presenceUserHandler.Run))
 
 	//WebSocket Api
 	websocketHandler := &servers.Controller{}
 	http.HandleFunc("/ws", websocketHandler.Run)
 
 	servers.StartWebSocket()
-
-	go servers.WriteMessage()
 }
 
 func Health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	//正在关闭时返回503,负载均衡不再转发新的连接
+	if servers.IsDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "DRAINING")
+		return
+	}
 	_, _ = io.WriteString(w, "OK")
 	return
 }
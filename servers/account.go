@@ -10,50 +10,171 @@ import (
 	"time"
 )
 
+const (
+	// 系统正常
+	SystemStatusActive = "active"
+	// 系统已停用,拒绝连接和接口调用
+	SystemStatusSuspended = "suspended"
+)
+
+// 修改账号信息时的最大重试次数
+const accountUpdateRetry = 5
+
+var (
+	ErrSystemNotRegistered = errors.New("系统ID未注册")
+	ErrSystemSuspended     = errors.New("系统已停用")
+	ErrAccountConflict     = errors.New("系统信息正在被修改,请稍后重试")
+)
+
 type accountInfo struct {
-	SystemId     string `json:"systemId"`
-	RegisterTime int64  `json:"registerTime"`
+	SystemId       string       `json:"systemId"`
+	Status         string       `json:"status"` // 系统状态,旧数据为空时视为正常
+	RegisterTime   int64        `json:"registerTime"`
+	OfflineMessage bool         `json:"offlineMessage"` // 是否保存发送给离线用户的消息
+	OfflineTTL     int64        `json:"offlineTTL"`     // 离线消息保存时间，单位：秒，为0则使用默认配置
+	TokenSecret    string       `json:"tokenSecret"`    // 签发连接凭证的密钥
+	RequireToken   bool         `json:"requireToken"`   // 连接时是否必须携带连接凭证
+	ApiKeys        []apiKey     `json:"apiKeys"`        // 接口签名使用的API密钥,轮换期间新旧密钥同时有效
+	Policy         SystemPolicy `json:"policy"`         // 系统的策略和配额
+	Webhook        Webhook      `json:"webhook"`        // 回调业务系统的配置
+}
+
+// 注册系统时的可选配置
+type RegisterOptions struct {
+	OfflineMessage bool
+	OfflineTTL     int64
+	RequireToken   bool
 }
 
 var SystemMap sync.Map
 
-func Register(systemId string) (err error) {
+func Register(systemId string, options RegisterOptions) (credential Credential, err error) {
 	//校验是否为空
 	if len(systemId) == 0 {
-		return errors.New("系统ID不能为空")
+		return credential, errors.New("系统ID不能为空")
 	}
 
+	key := newApiKey()
+
 	accountInfo := accountInfo{
-		SystemId:     systemId,
-		RegisterTime: time.Now().Unix(),
+		SystemId:       systemId,
+		Status:         SystemStatusActive,
+		RegisterTime:   time.Now().Unix(),
+		OfflineMessage: options.OfflineMessage,
+		OfflineTTL:     options.OfflineTTL,
+		TokenSecret:    util.GenSecret(),
+		RequireToken:   options.RequireToken,
+		ApiKeys:        []apiKey{key},
+	}
+
+	if util.IsCluster() {
+		jsonBytes, _ := json.Marshal(accountInfo)
+
+		//判断是否被注册和注册在同一个事务中,同时注册时只有一个成功
+		ok, revision, err := etcd.Create(define.ETcdPrefixAccountInfo+systemId, string(jsonBytes))
+		if err != nil {
+			return credential, err
+		}
+		if !ok {
+			return credential, errors.New("该系统ID已被注册")
+		}
+		Systems.set(accountInfo, revision)
+	} else {
+		if _, loaded := SystemMap.LoadOrStore(systemId, accountInfo); loaded {
+			return credential, errors.New("该系统ID已被注册")
+		}
+	}
+
+	credential = key.credential()
+	credential.TokenSecret = accountInfo.TokenSecret
+	return credential, nil
+}
+
+// 获取系统的账号信息,集群模式下从本地缓存获取
+func getAccountInfo(systemId string) (info accountInfo, err error) {
+	if util.IsCluster() {
+		return Systems.Get(systemId)
+	}
+
+	value, ok := SystemMap.Load(systemId)
+	if !ok {
+		return info, ErrSystemNotRegistered
+	}
+	return value.(accountInfo), nil
+}
+
+func (a accountInfo) suspended() bool {
+	return a.Status == SystemStatusSuspended
+}
+
+// 校验系统是否可用,etcd不可用且本地没有缓存时返回其他错误
+func CheckSystem(systemId string) error {
+	account, err := getAccountInfo(systemId)
+	if err != nil {
+		return err
 	}
+	if account.suspended() {
+		return ErrSystemSuspended
+	}
+	return nil
+}
 
+// 从etcd读取最新的账号信息,用于修改账号,避免基于缓存中的旧数据修改
+func loadAccountInfo(systemId string) (info accountInfo, err error) {
+	info, _, err = loadAccountRevision(systemId)
+	return
+}
+
+// 读取最新的账号信息和etcd中的修改版本号,单机模式下版本号为0
+func loadAccountRevision(systemId string) (info accountInfo, modRevision int64, err error) {
 	if util.IsCluster() {
-		//判断是否被注册
 		resp, err := etcd.Get(define.ETcdPrefixAccountInfo + systemId)
 		if err != nil {
-			return err
+			return info, 0, err
 		}
 
-		if resp.Count > 0 {
-			return errors.New("该系统ID已被注册")
+		if resp.Count == 0 {
+			return info, 0, ErrSystemNotRegistered
 		}
 
-		jsonBytes, _ := json.Marshal(accountInfo)
+		err = json.Unmarshal(resp.Kvs[0].Value, &info)
+		return info, resp.Kvs[0].ModRevision, err
+	}
+
+	info, err = getAccountInfo(systemId)
+	return info, 0, err
+}
 
-		//注册
-		err = etcd.Put(define.ETcdPrefixAccountInfo+systemId, string(jsonBytes))
+// 读取最新的账号信息,修改后保存
+// 集群模式下只在etcd中的版本号没有变化时写入,其他节点同时修改时重新读取再修改,避免覆盖其他节点的修改
+func updateAccountInfo(systemId string, modify func(account *accountInfo) error) (account accountInfo, err error) {
+	accountLock.Lock()
+	defer accountLock.Unlock()
+
+	for i := 0; i < accountUpdateRetry; i++ {
+		var modRevision int64
+		account, modRevision, err = loadAccountRevision(systemId)
 		if err != nil {
-			panic(err)
-			return err
+			return account, err
 		}
-	} else {
-		if _, ok := SystemMap.Load(systemId); ok {
-			return errors.New("该系统ID已被注册")
+		if err = modify(&account); err != nil {
+			return account, err
 		}
 
-		SystemMap.Store(systemId, accountInfo)
-	}
+		if !util.IsCluster() {
+			SystemMap.Store(systemId, account)
+			return account, nil
+		}
 
-	return nil
+		jsonBytes, _ := json.Marshal(account)
+		ok, revision, err := etcd.PutIfModRevision(define.ETcdPrefixAccountInfo+systemId, string(jsonBytes), modRevision)
+		if err != nil {
+			return account, err
+		}
+		if ok {
+			Systems.set(account, revision)
+			return account, nil
+		}
+	}
+	return account, ErrAccountConflict
 }
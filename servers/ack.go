@@ -0,0 +1,177 @@
+package servers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"sync"
+	"time"
+)
+
+const (
+	// 已进入发送队列
+	AckStatusPending = "pending"
+	// 已写入连接,等待客户端确认
+	AckStatusSent = "sent"
+	// 客户端已确认收到
+	AckStatusAcked = "acked"
+	// 超过重发次数仍未收到确认
+	AckStatusTimeout = "timeout"
+	// 客户端已离线,无法投递
+	AckStatusOffline = "offline"
+)
+
+// 默认等待客户端确认的超时时间
+const defaultAckTimeout = 10 * time.Second
+
+// 投递结束的消息状态保留时长,用于业务端查询
+var ackRetention = 10 * time.Minute
+
+// 消息投递状态
+type MessageStatus struct {
+	MessageId string `json:"messageId"`
+	ClientId  string `json:"clientId"`
+	Status    string `json:"status"`
+	Retries   int    `json:"retries"`
+	SendTime  int64  `json:"sendTime"`
+	AckTime   int64  `json:"ackTime"`
+
+	message  clientInfo // 重发时使用的原始消息
+	deadline time.Time  // 超时重发或者过期清理的时间点
+}
+
+// 是否投递结束
+func (s *MessageStatus) finished() bool {
+	return s.Status == AckStatusAcked || s.Status == AckStatusTimeout || s.Status == AckStatusOffline
+}
+
+// 消息确认管理
+type AckManager struct {
+	lock     sync.RWMutex
+	messages map[string]*MessageStatus // key为messageId
+}
+
+var Acks = NewAckManager()
+
+func NewAckManager() *AckManager {
+	return &AckManager{
+		messages: make(map[string]*MessageStatus, 100),
+	}
+}
+
+func ackTimeout() time.Duration {
+	if setting.CommonSetting.AckTimeout > 0 {
+		return time.Duration(setting.CommonSetting.AckTimeout) * time.Second
+	}
+	return defaultAckTimeout
+}
+
+// 开始跟踪一条需要客户端确认的消息
+func (a *AckManager) Track(info clientInfo) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.messages[info.MessageId] = &MessageStatus{
+		MessageId: info.MessageId,
+		ClientId:  info.ClientId,
+		Status:    AckStatusPending,
+		SendTime:  time.Now().Unix(),
+		message:   info,
+		deadline:  time.Now().Add(ackTimeout()),
+	}
+}
+
+// 消息已写入连接
+func (a *AckManager) Sent(messageId string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if status, ok := a.messages[messageId]; ok && status.Status == AckStatusPending {
+		status.Status = AckStatusSent
+		status.deadline = time.Now().Add(ackTimeout())
+	}
+}
+
+// 客户端确认收到消息,只有消息的接收者才能确认
+func (a *AckManager) Ack(clientId, messageId string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	status, ok := a.messages[messageId]
+	if !ok || status.ClientId != clientId || status.finished() {
+		return false
+	}
+	status.Status = AckStatusAcked
+	status.AckTime = time.Now().Unix()
+	status.deadline = time.Now().Add(ackRetention)
+	return true
+}
+
+// 客户端已离线,消息无法投递
+func (a *AckManager) Offline(messageId string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if status, ok := a.messages[messageId]; ok && !status.finished() {
+		status.Status = AckStatusOffline
+		status.deadline = time.Now().Add(ackRetention)
+	}
+}
+
+// 获取消息投递状态
+func (a *AckManager) Get(messageId string) (MessageStatus, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if status, ok := a.messages[messageId]; ok {
+		return *status, true
+	}
+	return MessageStatus{}, false
+}
+
+// 处理超时未确认的消息,未超过重发次数则重新投递,同时清理过期的状态
+func (a *AckManager) check(now time.Time) {
+	var resend []clientInfo
+
+	a.lock.Lock()
+	for messageId, status := range a.messages {
+		if now.Before(status.deadline) {
+			continue
+		}
+
+		if status.finished() {
+			delete(a.messages, messageId)
+			continue
+		}
+
+		if status.Retries < setting.CommonSetting.AckMaxRetry {
+			status.Retries++
+			status.Status = AckStatusPending
+			status.deadline = now.Add(ackTimeout())
+			resend = append(resend, status.message)
+		} else {
+			status.Status = AckStatusTimeout
+			status.deadline = now.Add(ackRetention)
+			log.WithFields(log.Fields{
+				"host":      setting.GlobalSetting.LocalHost,
+				"port":      setting.CommonSetting.HttpPort,
+				"clientId":  status.ClientId,
+				"messageId": messageId,
+				"retries":   status.Retries,
+			}).Warn("消息超时未收到客户端确认")
+		}
+	}
+	a.lock.Unlock()
+
+	for _, info := range resend {
+		send2LocalClient(info)
+	}
+}
+
+// 启动定时器检查超时未确认的消息
+func (a *AckManager) Start() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.check(now)
+	}
+}
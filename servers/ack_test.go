@@ -0,0 +1,89 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"testing"
+	"time"
+)
+
+func TestAck(t *testing.T) {
+	resetSetting()
+	acks := NewAckManager()
+	acks.Track(clientInfo{ClientId: "clientId", MessageId: "messageId", NeedAck: true})
+
+	Convey("测试消息确认", t, func() {
+		Convey("已发送", func() {
+			acks.Sent("messageId")
+			status, ok := acks.Get("messageId")
+			So(ok, ShouldBeTrue)
+			So(status.Status, ShouldEqual, AckStatusSent)
+		})
+
+		Convey("其他客户端不能确认", func() {
+			So(acks.Ack("otherClientId", "messageId"), ShouldBeFalse)
+		})
+
+		Convey("接收者确认", func() {
+			So(acks.Ack("clientId", "messageId"), ShouldBeTrue)
+			status, _ := acks.Get("messageId")
+			So(status.Status, ShouldEqual, AckStatusAcked)
+		})
+
+		Convey("过期后清理", func() {
+			acks.check(time.Now().Add(ackRetention + time.Second))
+			_, ok := acks.Get("messageId")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestAckResend(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.AckMaxRetry = 1
+	acks := NewAckManager()
+	client := NewClient("ackClientId", "publishSystem", false, &websocket.Conn{})
+	Manager.AddClient(client)
+	defer Manager.DelClient(client)
+	acks.Track(clientInfo{ClientId: client.ClientId, MessageId: "messageId", NeedAck: true})
+
+	Convey("测试超时重发", t, func() {
+		Convey("超时后重新投递", func() {
+			acks.check(time.Now().Add(ackTimeout() + time.Second))
+			status, _ := acks.Get("messageId")
+			So(status.Retries, ShouldEqual, 1)
+			So(status.Status, ShouldEqual, AckStatusPending)
+			So((<-client.sendChan).MessageId, ShouldEqual, "messageId")
+		})
+
+		Convey("超过重发次数", func() {
+			acks.check(time.Now().Add(2*ackTimeout() + time.Second))
+			status, _ := acks.Get("messageId")
+			So(status.Status, ShouldEqual, AckStatusTimeout)
+			So(len(client.sendChan), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestAckOptional(t *testing.T) {
+	resetSetting()
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试不需要确认的消息", t, func() {
+		client := NewClient("noAckClientId", "noAckSystem", false, conn)
+		Manager.AddClient(client)
+		defer Manager.DelClient(client)
+
+		data := "message"
+		messageId := SendMessage2Client("noAckSystem", client.ClientId, "sendUserId", 0, "success", &data, false)
+		So((<-client.sendChan).NeedAck, ShouldBeFalse)
+
+		//不跟踪投递状态,超时后也不会重新投递
+		_, ok := Acks.Get(messageId)
+		So(ok, ShouldBeFalse)
+		Acks.check(time.Now().Add(time.Duration(setting.CommonSetting.AckMaxRetry+1) * (ackTimeout() + time.Second)))
+		So(len(client.sendChan), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,246 @@
+package servers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/etcd"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//接口签名相关的请求头
+const (
+	HeaderApiKey    = "X-Api-Key"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+//系统的API密钥
+type apiKey struct {
+	Key        string `json:"key"`
+	Secret     string `json:"secret"`
+	CreateTime int64  `json:"createTime"`
+	ExpireTime int64  `json:"expireTime"` // 轮换后旧密钥的过期时间,为0则不过期
+}
+
+//返回给业务端的密钥
+type Credential struct {
+	ApiKey      string `json:"apiKey"`
+	ApiSecret   string `json:"apiSecret"`
+	TokenSecret string `json:"tokenSecret,omitempty"` // 签发连接凭证的密钥,只在注册时返回
+}
+
+//本机修改账号信息时加锁,其他节点的修改由etcd的版本号检查
+var accountLock sync.Mutex
+
+//记录nonce失败,和重复的请求区分开
+var ErrNonceUnavailable = errors.New("nonce存储服务不可用")
+
+//已经使用过的nonce,集群模式下作为etcd前面的本地缓存
+var nonces = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+func newApiKey() apiKey {
+	return apiKey{
+		Key:        util.GenUUID(),
+		Secret:     util.GenSecret(),
+		CreateTime: time.Now().Unix(),
+	}
+}
+
+func (k apiKey) credential() Credential {
+	return Credential{ApiKey: k.Key, ApiSecret: k.Secret}
+}
+
+func (k apiKey) expired(now int64) bool {
+	return k.ExpireTime > 0 && k.ExpireTime <= now
+}
+
+//计算请求签名,签名内容为:请求方法\n请求地址\n时间戳\nnonce\n请求体的sha256
+func GenApiSignature(secret, method, uri, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//系统是否有有效的API密钥,读取失败时视为有密钥,由签名校验返回错误
+func HasApiKey(systemId string) bool {
+	account, err := getAccountInfo(systemId)
+	if err != nil {
+		return true
+	}
+
+	now := time.Now().Unix()
+	for _, k := range account.ApiKeys {
+		if !k.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+//校验接口请求签名
+func CheckApiSignature(systemId string, r *http.Request, body []byte) error {
+	key := r.Header.Get(HeaderApiKey)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	signature := r.Header.Get(HeaderSignature)
+	if len(key) == 0 || len(timestamp) == 0 || len(nonce) == 0 || len(signature) == 0 {
+		return errors.New("缺少签名参数")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("时间戳格式错误")
+	}
+
+	now := time.Now().Unix()
+	expire := int64(setting.CommonSetting.SignExpire)
+	if ts < now-expire || ts > now+expire {
+		return errors.New("请求已过期")
+	}
+
+	account, err := getAccountInfo(systemId)
+	if err != nil {
+		return err
+	}
+
+	var secret string
+	for _, k := range account.ApiKeys {
+		if k.Key == key && !k.expired(now) {
+			secret = k.Secret
+			break
+		}
+	}
+	if len(secret) == 0 {
+		return errors.New("API密钥无效")
+	}
+
+	expected := GenApiSignature(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("签名错误")
+	}
+
+	//签名正确之后再记录nonce,避免伪造的请求占用nonce
+	ok, err := useNonce(systemId, nonce, ts+expire)
+	if err != nil {
+		return ErrNonceUnavailable
+	}
+	if !ok {
+		return errors.New("重复的请求")
+	}
+
+	return nil
+}
+
+//记录nonce,已经使用过则返回false
+func useNonce(systemId, nonce string, expireTime int64) (bool, error) {
+	key := systemId + ":" + nonce
+	//本节点已经见过的nonce不需要再访问etcd
+	if !useLocalNonce(key, expireTime) {
+		return false, nil
+	}
+	if !util.IsCluster() {
+		return true, nil
+	}
+
+	ttl := expireTime - time.Now().Unix()
+	if ttl <= 0 {
+		ttl = 1
+	}
+	ok, err := etcd.PutIfNotExist(define.ETcdPrefixNonce+key, "1", ttl)
+	if err != nil {
+		//etcd出错时没有记录成功,允许业务端使用同一个nonce重试
+		nonces.Lock()
+		delete(nonces.m, key)
+		nonces.Unlock()
+		return false, err
+	}
+	return ok, nil
+}
+
+//在本地记录nonce,已经使用过则返回false
+func useLocalNonce(key string, expireTime int64) bool {
+	nonces.Lock()
+	defer nonces.Unlock()
+
+	now := time.Now().Unix()
+	for k, expire := range nonces.m {
+		if expire <= now {
+			delete(nonces.m, k)
+		}
+	}
+
+	if _, ok := nonces.m[key]; ok {
+		return false
+	}
+	nonces.m[key] = expireTime
+	return true
+}
+
+//生成新的API密钥,旧密钥在ApiKeyGrace秒之后失效
+func RotateApiKey(systemId string) (credential Credential, err error) {
+	var key apiKey
+	_, err = updateAccountInfo(systemId, func(account *accountInfo) error {
+		now := time.Now().Unix()
+		keys := make([]apiKey, 0, len(account.ApiKeys)+1)
+		for _, k := range account.ApiKeys {
+			if k.expired(now) {
+				continue
+			}
+			if k.ExpireTime == 0 {
+				k.ExpireTime = now + int64(setting.CommonSetting.ApiKeyGrace)
+			}
+			keys = append(keys, k)
+		}
+
+		key = newApiKey()
+		account.ApiKeys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	return key.credential(), nil
+}
+
+//立即作废指定的API密钥,至少保留一个有效的密钥
+func RevokeApiKey(systemId, key string) error {
+	_, err := updateAccountInfo(systemId, func(account *accountInfo) error {
+		now := time.Now().Unix()
+		keys := make([]apiKey, 0, len(account.ApiKeys))
+		found := false
+		for _, k := range account.ApiKeys {
+			if k.Key == key {
+				found = true
+				continue
+			}
+			if !k.expired(now) {
+				keys = append(keys, k)
+			}
+		}
+
+		if !found {
+			return errors.New("API密钥不存在")
+		}
+		if len(keys) == 0 {
+			return errors.New("不能作废最后一个有效的API密钥")
+		}
+
+		account.ApiKeys = keys
+		return nil
+	})
+	return err
+}
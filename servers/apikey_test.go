@@ -0,0 +1,157 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSignedRequest(credential Credential, body, nonce string, timestamp int64) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/send/2/client", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp, 10)
+	r.Header.Set(HeaderApiKey, credential.ApiKey)
+	r.Header.Set(HeaderTimestamp, ts)
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, GenApiSignature(credential.ApiSecret, r.Method, r.URL.RequestURI(), ts, nonce, []byte(body)))
+	return r
+}
+
+func TestCheckApiSignature(t *testing.T) {
+	resetSetting()
+	credential, _ := Register("signSystem", RegisterOptions{})
+	defer SystemMap.Delete("signSystem")
+	body := `{"clientId":"ade447d79f6489b5"}`
+
+	Convey("测试接口签名校验", t, func() {
+		Convey("签名正确", func() {
+			r := newSignedRequest(credential, body, util.GenUUID(), time.Now().Unix())
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldBeNil)
+		})
+
+		Convey("重复的nonce", func() {
+			nonce := util.GenUUID()
+			r := newSignedRequest(credential, body, nonce, time.Now().Unix())
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldBeNil)
+			r = newSignedRequest(credential, body, nonce, time.Now().Unix())
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldNotBeNil)
+		})
+
+		Convey("记录nonce", func() {
+			nonce := util.GenUUID()
+			expireTime := time.Now().Unix() + int64(setting.CommonSetting.SignExpire)
+			ok, err := useNonce("signSystem", nonce, expireTime)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = useNonce("signSystem", nonce, expireTime)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("请求已过期", func() {
+			r := newSignedRequest(credential, body, util.GenUUID(), time.Now().Unix()-int64(setting.CommonSetting.SignExpire)-1)
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldNotBeNil)
+		})
+
+		Convey("请求体被修改", func() {
+			r := newSignedRequest(credential, body, util.GenUUID(), time.Now().Unix())
+			So(CheckApiSignature("signSystem", r, []byte(`{"clientId":"other"}`)), ShouldNotBeNil)
+		})
+
+		Convey("使用其他系统的密钥", func() {
+			other, _ := Register("otherSignSystem", RegisterOptions{})
+			defer SystemMap.Delete("otherSignSystem")
+			r := newSignedRequest(other, body, util.GenUUID(), time.Now().Unix())
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldNotBeNil)
+		})
+
+		Convey("缺少签名参数", func() {
+			r := httptest.NewRequest(http.MethodPost, "/api/send/2/client", strings.NewReader(body))
+			So(CheckApiSignature("signSystem", r, []byte(body)), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRotateApiKey(t *testing.T) {
+	resetSetting()
+	body := `{}`
+
+	Convey("测试轮换API密钥", t, func() {
+		old, _ := Register("rotateSystem", RegisterOptions{})
+		defer SystemMap.Delete("rotateSystem")
+
+		credential, err := RotateApiKey("rotateSystem")
+		So(err, ShouldBeNil)
+		So(credential.ApiKey, ShouldNotEqual, old.ApiKey)
+
+		Convey("新旧密钥在保留期内都有效", func() {
+			So(CheckApiSignature("rotateSystem", newSignedRequest(old, body, util.GenUUID(), time.Now().Unix()), []byte(body)), ShouldBeNil)
+			So(CheckApiSignature("rotateSystem", newSignedRequest(credential, body, util.GenUUID(), time.Now().Unix()), []byte(body)), ShouldBeNil)
+		})
+
+		Convey("作废旧密钥", func() {
+			So(RevokeApiKey("rotateSystem", old.ApiKey), ShouldBeNil)
+			So(CheckApiSignature("rotateSystem", newSignedRequest(old, body, util.GenUUID(), time.Now().Unix()), []byte(body)), ShouldNotBeNil)
+		})
+
+		Convey("不能作废最后一个密钥", func() {
+			So(RevokeApiKey("rotateSystem", old.ApiKey), ShouldBeNil)
+			So(RevokeApiKey("rotateSystem", credential.ApiKey), ShouldNotBeNil)
+		})
+
+		Convey("保留期过后旧密钥失效", func() {
+			setting.CommonSetting.ApiKeyGrace = -1
+			defer func() {
+				setting.CommonSetting.ApiKeyGrace = 3600
+			}()
+			_, err := RotateApiKey("rotateSystem")
+			So(err, ShouldBeNil)
+			So(CheckApiSignature("rotateSystem", newSignedRequest(credential, body, util.GenUUID(), time.Now().Unix()), []byte(body)), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSendToOtherSystemClient(t *testing.T) {
+	resetSetting()
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试不能发送给其他系统的客户端", t, func() {
+		client := NewClient("isolatedClientId", "ownerSystem", false, conn)
+		Manager.AddClient(client)
+		defer Manager.DelClient(client)
+
+		data := "message"
+		messageId := SendMessage2Client("otherSystem", client.ClientId, "sendUserId", 0, "success", &data, true)
+		So(len(client.sendChan), ShouldEqual, 0)
+		_, ok := GetMessageStatus("otherSystem", client.ClientId, messageId)
+		So(ok, ShouldBeFalse)
+
+		messageId = SendMessage2Client("ownerSystem", client.ClientId, "sendUserId", 0, "success", &data, true)
+		So(len(client.sendChan), ShouldEqual, 1)
+		_, ok = GetMessageStatus("ownerSystem", client.ClientId, messageId)
+		So(ok, ShouldBeTrue)
+		_, ok = GetMessageStatus("otherSystem", client.ClientId, messageId)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestHasApiKey(t *testing.T) {
+	resetSetting()
+
+	Convey("测试系统是否有API密钥", t, func() {
+		_, _ = Register("keySystem", RegisterOptions{})
+		defer SystemMap.Delete("keySystem")
+		So(HasApiKey("keySystem"), ShouldBeTrue)
+
+		//升级之前注册的系统没有密钥
+		SystemMap.Store("legacySystem", accountInfo{SystemId: "legacySystem"})
+		defer SystemMap.Delete("legacySystem")
+		So(HasApiKey("legacySystem"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,81 @@
+package servers
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"strings"
+)
+
+//允许加入所有分组
+const allGroups = "*"
+
+//连接凭证的内容,由业务端使用注册时返回的tokenSecret以HS256签发
+type connectClaims struct {
+	SystemId string   `json:"systemId"`
+	UserId   string   `json:"userId"`
+	Groups   []string `json:"groups"`
+	Extend   string   `json:"extend"`
+	jwt.StandardClaims
+}
+
+//从请求中获取连接凭证,优先使用token参数,其次是Authorization头
+func getConnectToken(r *http.Request) string {
+	if token := r.FormValue("token"); len(token) > 0 {
+		return token
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return ""
+}
+
+//校验连接凭证
+func parseConnectToken(account accountInfo, tokenString string) (*connectClaims, error) {
+	if len(account.TokenSecret) == 0 {
+		return nil, errors.New("系统未配置连接凭证密钥")
+	}
+
+	claims := &connectClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("不支持的签名算法")
+		}
+		return []byte(account.TokenSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("连接凭证无效")
+	}
+
+	//必须设置过期时间
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("连接凭证缺少过期时间")
+	}
+
+	if claims.SystemId != account.SystemId {
+		return nil, errors.New("连接凭证与系统ID不匹配")
+	}
+
+	return claims, nil
+}
+
+//是否允许加入分组
+func (c *connectClaims) allowGroup(groupName string) bool {
+	return groupAllowed(c.Groups, groupName)
+}
+
+func groupAllowed(groups []string, groupName string) bool {
+	for _, group := range groups {
+		if group == allGroups || group == groupName {
+			return true
+		}
+	}
+	return false
+}
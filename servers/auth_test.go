@@ -0,0 +1,126 @@
+package servers
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signConnectToken(secret string, claims connectClaims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	return token
+}
+
+func newConnectClaims(systemId string, expire time.Duration) connectClaims {
+	return connectClaims{
+		SystemId: systemId,
+		UserId:   "tokenUser",
+		Groups:   []string{"tokenGroup"},
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(expire).Unix(),
+		},
+	}
+}
+
+func TestParseConnectToken(t *testing.T) {
+	resetSetting()
+	credential, _ := Register("authSystem", RegisterOptions{})
+	secret := credential.TokenSecret
+	defer SystemMap.Delete("authSystem")
+	account, _ := getAccountInfo("authSystem")
+
+	Convey("测试连接凭证校验", t, func() {
+		Convey("有效的凭证", func() {
+			claims, err := parseConnectToken(account, signConnectToken(secret, newConnectClaims("authSystem", time.Minute)))
+			So(err, ShouldBeNil)
+			So(claims.UserId, ShouldEqual, "tokenUser")
+			So(claims.allowGroup("tokenGroup"), ShouldBeTrue)
+			So(claims.allowGroup("otherGroup"), ShouldBeFalse)
+		})
+
+		Convey("密钥错误", func() {
+			_, err := parseConnectToken(account, signConnectToken("wrongSecret", newConnectClaims("authSystem", time.Minute)))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("凭证已过期", func() {
+			_, err := parseConnectToken(account, signConnectToken(secret, newConnectClaims("authSystem", -time.Minute)))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("缺少过期时间", func() {
+			claims := newConnectClaims("authSystem", time.Minute)
+			claims.ExpiresAt = 0
+			_, err := parseConnectToken(account, signConnectToken(secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("其他系统的凭证", func() {
+			_, err := parseConnectToken(account, signConnectToken(secret, newConnectClaims("otherSystem", time.Minute)))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("允许所有分组", func() {
+			claims := newConnectClaims("authSystem", time.Minute)
+			claims.Groups = []string{allGroups}
+			parsed, err := parseConnectToken(account, signConnectToken(secret, claims))
+			So(err, ShouldBeNil)
+			So(parsed.allowGroup("anyGroup"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestConnectWithToken(t *testing.T) {
+	resetSetting()
+	credential, _ := Register("tokenSystem", RegisterOptions{RequireToken: true})
+	secret := credential.TokenSecret
+	defer SystemMap.Delete("tokenSystem")
+	StartWebSocket()
+
+	s := httptest.NewServer(http.HandlerFunc((&Controller{}).Run))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?systemId=tokenSystem"
+
+	Convey("测试携带凭证建立连接", t, func() {
+		Convey("缺少凭证", func() {
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			So(err, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("凭证无效", func() {
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL+"&token=invalid", nil)
+			So(err, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("不允许加入的分组", func() {
+			token := signConnectToken(secret, newConnectClaims("tokenSystem", time.Minute))
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL+"&groupName=otherGroup&token="+url.QueryEscape(token), nil)
+			So(err, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("通过请求头携带凭证", func() {
+			token := signConnectToken(secret, newConnectClaims("tokenSystem", time.Minute))
+			header := http.Header{}
+			header.Set("Authorization", "Bearer "+token)
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"&groupName=tokenGroup&userId=fakeUser", header)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			var ret resumeRender
+			So(conn.ReadJSON(&ret), ShouldBeNil)
+			client, err := Manager.GetByClientId(ret.Data.ClientId)
+			So(err, ShouldBeNil)
+			So(client.UserId, ShouldEqual, "tokenUser")
+			So(client.authorized, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,603 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/offline"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//集群节点之间的通信方式,覆盖grpc.proto中的所有操作
+type Backplane interface {
+	//发送到客户端所在的节点
+	Send2Client(addr string, req *pb.Send2ClientReq) error
+	CloseClient(addr string, req *pb.CloseClientReq) error
+	BindGroup(addr string, req *pb.BindGroupReq) error
+	GetMessageStatus(addr string, req *pb.GetMessageStatusReq) (MessageStatus, bool)
+	UnbindGroup(addr string, req *pb.UnbindGroupReq) error
+	GetClientGroups(addr string, req *pb.GetClientGroupsReq) []string
+
+	//广播到集群中的节点
+	Send2Group(req *pb.Send2GroupReq) BroadcastResult
+	Send2User(req *pb.Send2UserReq) (online int, result BroadcastResult)
+	Send2System(req *pb.Send2SystemReq) BroadcastResult
+	GetGroupClients(req *pb.GetGroupClientsReq) []string
+	GetUserClients(req *pb.GetUserClientsReq) []string
+	PeekOfflineMessages(req *pb.PeekOfflineMessagesReq) []offline.Message
+	DeleteOfflineMessages(req *pb.DeleteOfflineMessagesReq) BroadcastResult
+	CountSystemClients(req *pb.CountSystemClientsReq) map[string]int
+	LeaveGroup(req *pb.LeaveGroupReq) (count int, result BroadcastResult)
+	DissolveGroup(req *pb.DissolveGroupReq) (count int, result BroadcastResult)
+	GetPresence(req *pb.GetPresenceReq) []UserPresence
+	GetUserDevices(req *pb.GetUserDevicesReq) (devices []Device, lastSeen int64)
+	PresenceChanged(req *pb.PresenceChangedReq) BroadcastResult
+	GetGroupMembers(req *pb.GetGroupMembersReq) (members []Member, count int)
+	StreamGroupClients(req *pb.GetGroupMembersReq) []Member
+
+	//加入集群,开始接收其他节点的调用
+	Start() error
+	//从节点列表中移除本机,其他节点不再发送新的调用,本机仍可以处理进行中的调用
+	Leave() error
+	//等待进行中的调用完成之后停止通信
+	Close() error
+}
+
+//集群模式下使用的通信方式
+var Cluster Backplane
+
+//根据配置创建通信方式
+func NewBackplane() (Backplane, error) {
+	switch setting.BackplaneSetting.Type {
+	case "", "grpc":
+		return NewGrpcBackplane(), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     setting.RedisSetting.Addr,
+			Password: setting.RedisSetting.Password,
+			DB:       setting.RedisSetting.DB,
+		})
+		return NewRedisBackplane(client, localRPCAddr(), &CommonServiceServer{}), nil
+	default:
+		return nil, errors.New("不支持的集群通信方式：" + setting.BackplaneSetting.Type)
+	}
+}
+
+//集群模式下初始化并启动通信
+func InitBackplane() error {
+	if !util.IsCluster() {
+		return nil
+	}
+
+	backplane, err := NewBackplane()
+	if err != nil {
+		return err
+	}
+	if err = backplane.Start(); err != nil {
+		return err
+	}
+	Cluster = backplane
+	return nil
+}
+
+//广播结果
+type BroadcastResult struct {
+	Nodes   int      `json:"nodes"`   // 广播的节点数
+	Reached int      `json:"reached"` // 调用成功的节点数
+	Failed  []string `json:"failed"`  // 调用失败的节点地址
+}
+
+//单机模式下只发送到本机
+func localResult() BroadcastResult {
+	return BroadcastResult{Nodes: 1, Reached: 1, Failed: []string{}}
+}
+
+//调用单个节点的超时时间
+func rpcTimeout() time.Duration {
+	if setting.CommonSetting.RPCTimeout > 0 {
+		return time.Duration(setting.CommonSetting.RPCTimeout) * time.Second
+	}
+	return defaultRPCTimeout
+}
+
+//并发调用指定的节点,每个节点单独设置超时时间,一个节点卡住不影响其他节点
+func broadcastTo(addrs []string, method string, call func(ctx context.Context, addr string) error) BroadcastResult {
+	result := BroadcastResult{Nodes: len(addrs), Failed: []string{}}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout())
+			err := call(ctx, addr)
+			cancel()
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				result.Failed = append(result.Failed, addr)
+				log.WithFields(log.Fields{
+					"host":   setting.GlobalSetting.LocalHost,
+					"port":   setting.CommonSetting.HttpPort,
+					"addr":   addr,
+					"method": method,
+				}).Errorf("failed to call: %v", err)
+				return
+			}
+			result.Reached++
+		}(addr)
+	}
+	wg.Wait()
+
+	return result
+}
+
+//各实现只需要提供节点列表和对单个节点的调用
+type nodeInvoker interface {
+	//集群中的所有节点
+	nodes() []string
+	//有该分组成员的节点
+	groupNodes(systemId, groupName string) []string
+	//调用指定节点上的方法,method为grpc.proto中的方法名
+	invoke(ctx context.Context, addr, method string, req, reply interface{}) error
+}
+
+//支持流式调用的实现,不支持时按页多次调用
+type streamInvoker interface {
+	//调用指定节点上的流式方法,每收到一条响应调用一次recv
+	invokeStream(ctx context.Context, addr, method string, req interface{}, newReply func() interface{}, recv func(reply interface{})) error
+}
+
+//基于nodeInvoker实现Backplane中的消息发送和查询
+type nodeBackplane struct {
+	invoker nodeInvoker
+}
+
+//调用节点并记录耗时
+func (b nodeBackplane) invoke(ctx context.Context, addr, method string, req, reply interface{}) error {
+	start := time.Now()
+	err := b.invoker.invoke(ctx, addr, method, req, reply)
+	observeRPCClient(method, start, err)
+	return err
+}
+
+//调用单个节点
+func (b nodeBackplane) call(addr, method string, req, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout())
+	defer cancel()
+
+	err := b.invoke(ctx, addr, method, req, reply)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":   setting.GlobalSetting.LocalHost,
+			"port":   setting.CommonSetting.HttpPort,
+			"addr":   addr,
+			"method": method,
+		}).Errorf("failed to call: %v", err)
+	}
+	return err
+}
+
+func (b nodeBackplane) Send2Client(addr string, req *pb.Send2ClientReq) error {
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"add":      addr,
+		"clientId": req.ClientId,
+		"msg":      req.Data,
+	}).Info("发送到服务器")
+	return b.call(addr, "Send2Client", req, &pb.Send2ClientReply{})
+}
+
+func (b nodeBackplane) CloseClient(addr string, req *pb.CloseClientReq) error {
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"add":      addr,
+		"clientId": req.ClientId,
+	}).Info("发送关闭连接到服务器")
+	return b.call(addr, "CloseClient", req, &pb.CloseClientReply{})
+}
+
+//绑定分组
+func (b nodeBackplane) BindGroup(addr string, req *pb.BindGroupReq) error {
+	return b.call(addr, "BindGroup", req, &pb.BindGroupReply{})
+}
+
+//获取消息投递状态
+func (b nodeBackplane) GetMessageStatus(addr string, req *pb.GetMessageStatusReq) (status MessageStatus, ok bool) {
+	response := &pb.GetMessageStatusReply{}
+	if err := b.call(addr, "GetMessageStatus", req, response); err != nil {
+		return
+	}
+
+	if len(response.Status) == 0 {
+		return
+	}
+
+	return MessageStatus{
+		MessageId: response.MessageId,
+		ClientId:  response.ClientId,
+		Status:    response.Status,
+		Retries:   int(response.Retries),
+		SendTime:  response.SendTime,
+		AckTime:   response.AckTime,
+	}, true
+}
+
+//从分组中解绑客户端
+func (b nodeBackplane) UnbindGroup(addr string, req *pb.UnbindGroupReq) error {
+	return b.call(addr, "UnbindGroup", req, &pb.UnbindGroupReply{})
+}
+
+//获取客户端加入的分组
+func (b nodeBackplane) GetClientGroups(addr string, req *pb.GetClientGroupsReq) []string {
+	response := &pb.GetClientGroupsReply{}
+	if err := b.call(addr, "GetClientGroups", req, response); err != nil {
+		return nil
+	}
+	return response.List
+}
+
+//发送分组消息,只发送到有该分组成员的节点
+func (b nodeBackplane) Send2Group(req *pb.Send2GroupReq) BroadcastResult {
+	return broadcastTo(b.invoker.groupNodes(req.SystemId, req.GroupName), "Send2Group", func(ctx context.Context, addr string) error {
+		return b.invoke(ctx, addr, "Send2Group", req, &pb.Send2GroupReply{})
+	})
+}
+
+//发送用户消息,返回该用户在所有机器上的有效连接数
+func (b nodeBackplane) Send2User(req *pb.Send2UserReq) (online int, result BroadcastResult) {
+	var lock sync.Mutex
+	result = broadcastTo(b.invoker.nodes(), "Send2User", func(ctx context.Context, addr string) error {
+		response := &pb.Send2UserReply{}
+		if err := b.invoke(ctx, addr, "Send2User", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		online += int(response.Online)
+		lock.Unlock()
+		return nil
+	})
+	return
+}
+
+//发送系统信息
+func (b nodeBackplane) Send2System(req *pb.Send2SystemReq) BroadcastResult {
+	return broadcastTo(b.invoker.nodes(), "Send2System", func(ctx context.Context, addr string) error {
+		return b.invoke(ctx, addr, "Send2System", req, &pb.Send2SystemReply{})
+	})
+}
+
+//获取分组在线的客户端
+func (b nodeBackplane) GetGroupClients(req *pb.GetGroupClientsReq) (clientIdList []string) {
+	var lock sync.Mutex
+	broadcastTo(b.invoker.groupNodes(req.SystemId, req.GroupName), "GetGroupClients", func(ctx context.Context, addr string) error {
+		response := &pb.GetGroupClientsReply{}
+		if err := b.invoke(ctx, addr, "GetGroupClients", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		clientIdList = append(clientIdList, response.List...)
+		lock.Unlock()
+		return nil
+	})
+	return
+}
+
+//获取用户在线的客户端
+func (b nodeBackplane) GetUserClients(req *pb.GetUserClientsReq) (clientIdList []string) {
+	var lock sync.Mutex
+	broadcastTo(b.invoker.nodes(), "GetUserClients", func(ctx context.Context, addr string) error {
+		response := &pb.GetUserClientsReply{}
+		if err := b.invoke(ctx, addr, "GetUserClients", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		clientIdList = append(clientIdList, response.List...)
+		lock.Unlock()
+		return nil
+	})
+	return
+}
+
+//读取所有机器上用户的离线消息,投递之后再调用DeleteOfflineMessages删除
+func (b nodeBackplane) PeekOfflineMessages(req *pb.PeekOfflineMessagesReq) (messages []offline.Message) {
+	var lock sync.Mutex
+	broadcastTo(b.invoker.nodes(), "PeekOfflineMessages", func(ctx context.Context, addr string) error {
+		response := &pb.PeekOfflineMessagesReply{}
+		if err := b.invoke(ctx, addr, "PeekOfflineMessages", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, msg := range response.List {
+			messages = append(messages, offline.Message{
+				MessageId:  msg.MessageId,
+				SystemId:   msg.SystemId,
+				UserId:     msg.UserId,
+				SendUserId: msg.SendUserId,
+				Code:       int(msg.Code),
+				Msg:        msg.Message,
+				Data:       msg.Data,
+				CreateTime: msg.CreateTime,
+				ExpireTime: msg.ExpireTime,
+			})
+		}
+		return nil
+	})
+	return
+}
+
+//删除所有机器上已经投递的离线消息,消息ID全局唯一,没有这些消息的机器忽略
+func (b nodeBackplane) DeleteOfflineMessages(req *pb.DeleteOfflineMessagesReq) BroadcastResult {
+	return broadcastTo(b.invoker.nodes(), "DeleteOfflineMessages", func(ctx context.Context, addr string) error {
+		return b.invoke(ctx, addr, "DeleteOfflineMessages", req, &pb.DeleteOfflineMessagesReply{})
+	})
+}
+
+//统计所有机器上各系统的连接数
+func (b nodeBackplane) CountSystemClients(req *pb.CountSystemClientsReq) map[string]int {
+	counts := make(map[string]int)
+	var lock sync.Mutex
+	broadcastTo(b.invoker.nodes(), "CountSystemClients", func(ctx context.Context, addr string) error {
+		response := &pb.CountSystemClientsReply{}
+		if err := b.invoke(ctx, addr, "CountSystemClients", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for systemId, count := range response.Counts {
+			counts[systemId] += int(count)
+		}
+		return nil
+	})
+	return counts
+}
+
+//用户的连接离开分组,返回所有机器上离开分组的连接数
+func (b nodeBackplane) LeaveGroup(req *pb.LeaveGroupReq) (count int, result BroadcastResult) {
+	var lock sync.Mutex
+	result = broadcastTo(b.invoker.nodes(), "LeaveGroup", func(ctx context.Context, addr string) error {
+		response := &pb.LeaveGroupReply{}
+		if err := b.invoke(ctx, addr, "LeaveGroup", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		count += int(response.Count)
+		lock.Unlock()
+		return nil
+	})
+	return
+}
+
+//解散分组,只发送到有该分组成员的节点,返回被移出分组的连接数
+func (b nodeBackplane) DissolveGroup(req *pb.DissolveGroupReq) (count int, result BroadcastResult) {
+	var lock sync.Mutex
+	result = broadcastTo(b.invoker.groupNodes(req.SystemId, req.GroupName), "DissolveGroup", func(ctx context.Context, addr string) error {
+		response := &pb.DissolveGroupReply{}
+		if err := b.invoke(ctx, addr, "DissolveGroup", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		count += int(response.Count)
+		lock.Unlock()
+		return nil
+	})
+	return
+}
+
+//获取各节点上用户的连接数和最后在线时间,同一用户在每个节点各有一条
+func (b nodeBackplane) GetPresence(req *pb.GetPresenceReq) (list []UserPresence) {
+	var lock sync.Mutex
+	broadcastTo(b.invoker.nodes(), "GetPresence", func(ctx context.Context, addr string) error {
+		response := &pb.GetPresenceReply{}
+		if err := b.invoke(ctx, addr, "GetPresence", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, item := range response.List {
+			list = append(list, UserPresence{UserId: item.UserId, Count: int(item.Count), LastSeen: item.LastSeen, node: addr})
+		}
+		return nil
+	})
+	return
+}
+
+//获取用户在所有机器上的连接,以及最晚的最后在线时间
+func (b nodeBackplane) GetUserDevices(req *pb.GetUserDevicesReq) (devices []Device, lastSeen int64) {
+	var lock sync.Mutex
+	broadcastTo(b.invoker.nodes(), "GetUserDevices", func(ctx context.Context, addr string) error {
+		response := &pb.GetUserDevicesReply{}
+		if err := b.invoke(ctx, addr, "GetUserDevices", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, device := range response.List {
+			devices = append(devices, Device{
+				ClientId:    device.ClientId,
+				SystemId:    device.SystemId,
+				GroupList:   device.GroupList,
+				Extend:      device.Extend,
+				ConnectTime: device.ConnectTime,
+				Node:        device.Node,
+			})
+		}
+		if response.LastSeen > lastSeen {
+			lastSeen = response.LastSeen
+		}
+		return nil
+	})
+	return
+}
+
+//广播用户在本机的状态变化
+func (b nodeBackplane) PresenceChanged(req *pb.PresenceChangedReq) BroadcastResult {
+	return broadcastTo(b.invoker.nodes(), "PresenceChanged", func(ctx context.Context, addr string) error {
+		return b.invoke(ctx, addr, "PresenceChanged", req, &pb.PresenceChangedReply{})
+	})
+}
+
+//查询用户时调用所有节点,查询分组时只调用有该分组成员的节点
+func (b nodeBackplane) memberNodes(req *pb.GetGroupMembersReq) []string {
+	if len(req.UserId) > 0 {
+		return b.invoker.nodes()
+	}
+	return b.invoker.groupNodes(req.SystemId, req.GroupName)
+}
+
+//获取各节点游标之后的一页成员,去重时同一用户在多个节点上只计数一次
+func (b nodeBackplane) GetGroupMembers(req *pb.GetGroupMembersReq) (members []Member, count int) {
+	var lock sync.Mutex
+	userIds := make(map[string]struct{})
+	broadcastTo(b.memberNodes(req), "GetGroupMembers", func(ctx context.Context, addr string) error {
+		response := &pb.GetGroupMembersReply{}
+		if err := b.invoke(ctx, addr, "GetGroupMembers", req, response); err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		members = append(members, membersFromPb(response.List)...)
+		count += int(response.Count) - len(response.UserIds)
+		for _, userId := range response.UserIds {
+			userIds[userId] = struct{}{}
+		}
+		return nil
+	})
+	count += len(userIds)
+	return
+}
+
+//分批获取各节点的所有成员
+func (b nodeBackplane) StreamGroupClients(req *pb.GetGroupMembersReq) (members []Member) {
+	var lock sync.Mutex
+	add := func(list []*pb.GroupMember) {
+		lock.Lock()
+		members = append(members, membersFromPb(list)...)
+		lock.Unlock()
+	}
+
+	broadcastTo(b.memberNodes(req), "StreamGroupClients", func(ctx context.Context, addr string) error {
+		if invoker, ok := b.invoker.(streamInvoker); ok {
+			start := time.Now()
+			err := invoker.invokeStream(ctx, addr, "StreamGroupClients", req, func() interface{} {
+				return &pb.GetGroupMembersReply{}
+			}, func(reply interface{}) {
+				add(reply.(*pb.GetGroupMembersReply).List)
+			})
+			observeRPCClient("StreamGroupClients", start, err)
+			return err
+		}
+
+		//不支持流式调用时按页获取
+		page := &pb.GetGroupMembersReq{
+			SystemId:  req.SystemId,
+			GroupName: req.GroupName,
+			UserId:    req.UserId,
+			Cursor:    req.Cursor,
+			Limit:     memberChunkSize,
+			Dedupe:    req.Dedupe,
+		}
+		for {
+			response := &pb.GetGroupMembersReply{}
+			if err := b.invoke(ctx, addr, "GetGroupMembers", page, response); err != nil {
+				return err
+			}
+			add(response.List)
+			if len(response.List) < memberChunkSize {
+				return nil
+			}
+			last := response.List[len(response.List)-1]
+			page.Cursor = Member{ClientId: last.ClientId, UserId: last.UserId}.key(req.Dedupe)
+		}
+	})
+	return
+}
+
+//按方法名调用本机的服务,请求为json编码,供不使用grpc的实现接收其他节点的调用
+func dispatch(ctx context.Context, srv pb.CommonServiceServer, method string, payload []byte) (response interface{}, err error) {
+	start := time.Now()
+	defer func() {
+		observeRPCServer(method, start, err)
+	}()
+	return dispatchMethod(ctx, srv, method, payload)
+}
+
+//可以按方法名调用的服务方法,值为方法表达式,请求的类型从方法的参数中获取,新增的非流式RPC需要加到这里
+var dispatchMethods = newDispatchTable(map[string]interface{}{
+	"Send2Client":           pb.CommonServiceServer.Send2Client,
+	"CloseClient":           pb.CommonServiceServer.CloseClient,
+	"BindGroup":             pb.CommonServiceServer.BindGroup,
+	"Send2Group":            pb.CommonServiceServer.Send2Group,
+	"Send2System":           pb.CommonServiceServer.Send2System,
+	"GetGroupClients":       pb.CommonServiceServer.GetGroupClients,
+	"Send2User":             pb.CommonServiceServer.Send2User,
+	"GetUserClients":        pb.CommonServiceServer.GetUserClients,
+	"GetMessageStatus":      pb.CommonServiceServer.GetMessageStatus,
+	"PeekOfflineMessages":   pb.CommonServiceServer.PeekOfflineMessages,
+	"DeleteOfflineMessages": pb.CommonServiceServer.DeleteOfflineMessages,
+	"CountSystemClients":    pb.CommonServiceServer.CountSystemClients,
+	"UnbindGroup":           pb.CommonServiceServer.UnbindGroup,
+	"LeaveGroup":            pb.CommonServiceServer.LeaveGroup,
+	"GetClientGroups":       pb.CommonServiceServer.GetClientGroups,
+	"DissolveGroup":         pb.CommonServiceServer.DissolveGroup,
+	"GetPresence":           pb.CommonServiceServer.GetPresence,
+	"GetUserDevices":        pb.CommonServiceServer.GetUserDevices,
+	"PresenceChanged":       pb.CommonServiceServer.PresenceChanged,
+	"GetGroupMembers":       pb.CommonServiceServer.GetGroupMembers,
+})
+
+type dispatchEntry struct {
+	fn      reflect.Value
+	reqType reflect.Type
+}
+
+func newDispatchTable(methods map[string]interface{}) map[string]dispatchEntry {
+	table := make(map[string]dispatchEntry, len(methods))
+	for name, method := range methods {
+		fn := reflect.ValueOf(method)
+		//方法表达式的参数为(服务, ctx, 请求),请求是指针
+		table[name] = dispatchEntry{fn: fn, reqType: fn.Type().In(2).Elem()}
+	}
+	return table
+}
+
+func dispatchMethod(ctx context.Context, srv pb.CommonServiceServer, method string, payload []byte) (interface{}, error) {
+	entry, ok := dispatchMethods[method]
+	if !ok {
+		return nil, errors.New("未知的方法：" + method)
+	}
+
+	req := reflect.New(entry.reqType)
+	if err := json.Unmarshal(payload, req.Interface()); err != nil {
+		return nil, err
+	}
+
+	out := entry.fn.Call([]reflect.Value{reflect.ValueOf(srv), reflect.ValueOf(ctx), req})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	return out[0].Interface(), nil
+}
@@ -0,0 +1,115 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"sort"
+	"sync"
+)
+
+//进程内的集群,可以在一个进程中启动多个节点
+type MemoryHub struct {
+	lock  sync.RWMutex
+	nodes map[string]pb.CommonServiceServer
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		nodes: make(map[string]pb.CommonServiceServer),
+	}
+}
+
+//在同一个进程中转发调用,请求和响应仍然经过json编码,与跨进程的实现保持一致
+type MemoryBackplane struct {
+	nodeBackplane
+	hub  *MemoryHub
+	addr string
+	srv  pb.CommonServiceServer
+}
+
+//创建hub中的节点,调用Start之后加入集群
+func (h *MemoryHub) NewNode(addr string, srv pb.CommonServiceServer) *MemoryBackplane {
+	b := &MemoryBackplane{hub: h, addr: addr, srv: srv}
+	b.nodeBackplane = nodeBackplane{invoker: b}
+	return b
+}
+
+func (h *MemoryHub) get(addr string) (pb.CommonServiceServer, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	srv, ok := h.nodes[addr]
+	return srv, ok
+}
+
+func (b *MemoryBackplane) nodes() []string {
+	b.hub.lock.RLock()
+	defer b.hub.lock.RUnlock()
+
+	addrs := make([]string, 0, len(b.hub.nodes))
+	for addr := range b.hub.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (b *MemoryBackplane) groupNodes(systemId, groupName string) []string {
+	return b.nodes()
+}
+
+func (b *MemoryBackplane) invoke(ctx context.Context, addr, method string, req, reply interface{}) error {
+	srv, ok := b.hub.get(addr)
+	if !ok {
+		return errors.New("节点不在线：" + addr)
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := dispatch(ctx, srv, method, payload)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		data, err := json.Marshal(response)
+		done <- result{data: data, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		return json.Unmarshal(r.data, reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *MemoryBackplane) Start() error {
+	b.hub.lock.Lock()
+	defer b.hub.lock.Unlock()
+	b.hub.nodes[b.addr] = b.srv
+	return nil
+}
+
+func (b *MemoryBackplane) Leave() error {
+	b.hub.lock.Lock()
+	defer b.hub.lock.Unlock()
+	delete(b.hub.nodes, b.addr)
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	return b.Leave()
+}
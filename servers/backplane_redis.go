@@ -0,0 +1,295 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 节点发送心跳的间隔
+var redisHeartbeatInterval = 5 * time.Second
+
+// 超过该时间没有心跳的节点视为下线
+var redisNodeTTL = 15 * time.Second
+
+//通过redis转发的请求
+type redisRequest struct {
+	Id      string          `json:"id"`
+	Method  string          `json:"method"`
+	From    string          `json:"from"` // 请求方的节点地址,响应发送到该节点的响应频道
+	Payload json.RawMessage `json:"payload"`
+}
+
+//通过redis返回的响应
+type redisReply struct {
+	Id      string          `json:"id"`
+	Error   string          `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+//通过redis发布订阅调用其他节点,每个节点订阅自己的请求频道和响应频道,节点列表保存在有序集合中
+type RedisBackplane struct {
+	nodeBackplane
+	client *redis.Client
+	addr   string
+	srv    pb.CommonServiceServer
+	pubsub *redis.PubSub
+	done   chan struct{}
+
+	leaveOnce sync.Once
+	received  chan struct{}  // 接收协程退出时关闭
+	alive     chan struct{}  // 心跳协程退出时关闭
+	handling  sync.WaitGroup // 处理中的请求
+
+	lock    sync.RWMutex
+	members []string                   // 在线节点的快照,每次心跳时更新
+	pending map[string]chan redisReply // 等待响应的请求
+}
+
+func NewRedisBackplane(client *redis.Client, addr string, srv pb.CommonServiceServer) *RedisBackplane {
+	b := &RedisBackplane{
+		client:  client,
+		addr:    addr,
+		srv:     srv,
+		done:    make(chan struct{}),
+		pending: make(map[string]chan redisReply),
+	}
+	b.nodeBackplane = nodeBackplane{invoker: b}
+	return b
+}
+
+func redisNodeChannel(addr string) string {
+	return define.RedisChannelNode + addr
+}
+
+func redisReplyChannel(addr string) string {
+	return define.RedisChannelReply + addr
+}
+
+func (b *RedisBackplane) nodes() []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]string{}, b.members...)
+}
+
+//没有分组索引,发送到所有节点
+func (b *RedisBackplane) groupNodes(systemId, groupName string) []string {
+	return b.nodes()
+}
+
+func (b *RedisBackplane) invoke(ctx context.Context, addr, method string, req, reply interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	request := redisRequest{Id: util.GenUUID(), Method: method, From: b.addr, Payload: payload}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan redisReply, 1)
+	b.lock.Lock()
+	b.pending[request.Id] = ch
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.pending, request.Id)
+		b.lock.Unlock()
+	}()
+
+	//没有订阅者说明节点已经下线,不需要等到超时
+	receivers, err := b.client.WithContext(ctx).Publish(redisNodeChannel(addr), data).Result()
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return errors.New("节点不在线：" + addr)
+	}
+
+	select {
+	case r := <-ch:
+		if len(r.Error) > 0 {
+			return errors.New(r.Error)
+		}
+		return json.Unmarshal(r.Payload, reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//处理其他节点的请求
+func (b *RedisBackplane) handle(data string) {
+	request := redisRequest{}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		log.Errorf("解析集群请求失败: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout())
+	defer cancel()
+
+	reply := redisReply{Id: request.Id}
+	if response, err := dispatch(ctx, b.srv, request.Method, request.Payload); err != nil {
+		reply.Error = err.Error()
+	} else if reply.Payload, err = json.Marshal(response); err != nil {
+		reply.Error = err.Error()
+	}
+
+	replyData, err := json.Marshal(reply)
+	if err == nil {
+		err = b.client.Publish(redisReplyChannel(request.From), replyData).Err()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":   setting.GlobalSetting.LocalHost,
+			"port":   setting.CommonSetting.HttpPort,
+			"addr":   request.From,
+			"method": request.Method,
+		}).Errorf("返回集群响应失败: %v", err)
+	}
+}
+
+//把响应交给等待中的请求,超时的请求已经移除
+func (b *RedisBackplane) deliver(data string) {
+	reply := redisReply{}
+	if err := json.Unmarshal([]byte(data), &reply); err != nil {
+		log.Errorf("解析集群响应失败: %v", err)
+		return
+	}
+
+	b.lock.RLock()
+	ch, ok := b.pending[reply.Id]
+	b.lock.RUnlock()
+	if ok {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+}
+
+func (b *RedisBackplane) receive() {
+	defer close(b.received)
+
+	replyChannel := redisReplyChannel(b.addr)
+	for msg := range b.pubsub.Channel() {
+		if msg.Channel == replyChannel {
+			b.deliver(msg.Payload)
+		} else {
+			b.handling.Add(1)
+			go func(payload string) {
+				defer b.handling.Done()
+				b.handle(payload)
+			}(msg.Payload)
+		}
+	}
+}
+
+//更新本机的心跳,移除超时的节点并刷新节点列表
+func (b *RedisBackplane) heartbeat() error {
+	now := time.Now()
+	expire := strconv.FormatInt(now.Add(-redisNodeTTL).UnixNano()/int64(time.Millisecond), 10)
+
+	pipe := b.client.TxPipeline()
+	pipe.ZAdd(define.RedisKeyNodes, redis.Z{Score: float64(now.UnixNano() / int64(time.Millisecond)), Member: b.addr})
+	pipe.ZRemRangeByScore(define.RedisKeyNodes, "-inf", "("+expire)
+	members := pipe.ZRange(define.RedisKeyNodes, 0, -1)
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	addrs := members.Val()
+	sort.Strings(addrs)
+	b.lock.Lock()
+	b.members = addrs
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *RedisBackplane) keepalive() {
+	defer close(b.alive)
+	ticker := time.NewTicker(redisHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.heartbeat(); err != nil {
+				log.WithFields(log.Fields{
+					"host": setting.GlobalSetting.LocalHost,
+					"port": setting.CommonSetting.HttpPort,
+				}).Errorf("更新节点心跳失败: %v", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+//订阅本机的请求和响应频道,并加入节点列表
+func (b *RedisBackplane) Start() error {
+	b.pubsub = b.client.Subscribe(redisNodeChannel(b.addr), redisReplyChannel(b.addr))
+	//等待订阅完成,避免加入节点列表之后收不到请求
+	for i := 0; i < 2; i++ {
+		if _, err := b.pubsub.Receive(); err != nil {
+			_ = b.pubsub.Close()
+			b.pubsub = nil
+			return err
+		}
+	}
+
+	if err := b.heartbeat(); err != nil {
+		_ = b.pubsub.Close()
+		b.pubsub = nil
+		return err
+	}
+
+	b.received = make(chan struct{})
+	b.alive = make(chan struct{})
+	go b.receive()
+	go b.keepalive()
+	return nil
+}
+
+//停止心跳并离开节点列表,仍然订阅请求频道,处理已经发出的请求
+func (b *RedisBackplane) Leave() error {
+	var err error
+	b.leaveOnce.Do(func() {
+		close(b.done)
+		err = b.client.ZRem(define.RedisKeyNodes, b.addr).Err()
+	})
+	return err
+}
+
+//离开节点列表,取消订阅并等待处理中的请求完成
+func (b *RedisBackplane) Close() error {
+	err := b.Leave()
+	//等待心跳协程退出,避免关闭redis连接之后还在更新心跳
+	if b.alive != nil {
+		<-b.alive
+	}
+	//Start失败或者没有调用时没有订阅,也没有接收协程
+	if b.pubsub != nil {
+		if unsubscribeErr := b.pubsub.Unsubscribe(); err == nil {
+			err = unsubscribeErr
+		}
+		if closeErr := b.pubsub.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if b.received != nil {
+		<-b.received
+	}
+	b.handling.Wait()
+	return err
+}
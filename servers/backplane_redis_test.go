@@ -0,0 +1,104 @@
+package servers
+
+import (
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"testing"
+	"time"
+)
+
+func TestRedisBackplane(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.RPCTimeout = 1
+
+	Convey("测试redis发布订阅集群", t, func() {
+		server, err := miniredis.Run()
+		So(err, ShouldBeNil)
+		defer server.Close()
+
+		services := []*testService{{addr: "127.0.0.1:17001"}, {addr: "127.0.0.1:17002"}}
+		var nodes []*RedisBackplane
+		for _, service := range services {
+			client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+			defer client.Close()
+			node := NewRedisBackplane(client, service.addr, service)
+			So(node.Start(), ShouldBeNil)
+			//先于redis连接关闭,停止心跳
+			defer node.Close()
+			nodes = append(nodes, node)
+		}
+		//先启动的节点在下一次心跳时才能发现后启动的节点
+		So(nodes[0].heartbeat(), ShouldBeNil)
+		So(nodes[0].nodes(), ShouldResemble, []string{services[0].addr, services[1].addr})
+
+		testBackplane(nodes[0], services)
+
+		Convey("节点离开后调用失败", func() {
+			So(nodes[1].Close(), ShouldBeNil)
+			So(nodes[0].Send2Client(services[1].addr, &pb.Send2ClientReq{ClientId: "clientId"}), ShouldNotBeNil)
+			So(services[1].Calls(), ShouldBeEmpty)
+
+			So(nodes[0].heartbeat(), ShouldBeNil)
+			So(nodes[0].nodes(), ShouldResemble, []string{services[0].addr})
+		})
+
+		Convey("离开节点列表后仍处理已经发出的调用", func() {
+			So(nodes[1].Leave(), ShouldBeNil)
+			So(nodes[0].heartbeat(), ShouldBeNil)
+			So(nodes[0].nodes(), ShouldResemble, []string{services[0].addr})
+
+			So(nodes[0].Send2Client(services[1].addr, &pb.Send2ClientReq{ClientId: "clientId"}), ShouldBeNil)
+			So(nodes[1].Close(), ShouldBeNil)
+		})
+
+		Convey("不支持流式调用时分页获取成员", func() {
+			_, ok := nodes[0].invoker.(streamInvoker)
+			So(ok, ShouldBeFalse)
+
+			for i := 0; i <= memberChunkSize; i++ {
+				services[1].clients = append(services[1].clients, fmt.Sprintf("client%04d", i))
+			}
+			members := nodes[0].StreamGroupClients(&pb.GetGroupMembersReq{GroupName: "group"})
+			So(members, ShouldHaveLength, memberChunkSize+1)
+			So(services[1].Calls(), ShouldResemble, []string{"GetGroupMembers:group", "GetGroupMembers:group"})
+		})
+
+		Convey("移除心跳超时的节点", func() {
+			redisNodeTTL = time.Millisecond
+			defer func() {
+				redisNodeTTL = 15 * time.Second
+			}()
+			time.Sleep(10 * time.Millisecond)
+			So(nodes[0].heartbeat(), ShouldBeNil)
+			So(nodes[0].nodes(), ShouldResemble, []string{services[0].addr})
+		})
+	})
+}
+
+func TestRedisBackplaneClose(t *testing.T) {
+	resetSetting()
+
+	Convey("测试没有启动的redis集群节点可以关闭", t, func() {
+		server, err := miniredis.Run()
+		So(err, ShouldBeNil)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer client.Close()
+
+		Convey("没有调用Start", func() {
+			defer server.Close()
+			node := NewRedisBackplane(client, "127.0.0.1:17001", &testService{addr: "127.0.0.1:17001"})
+			So(node.Close(), ShouldBeNil)
+		})
+
+		Convey("Start失败", func() {
+			server.Close()
+			node := NewRedisBackplane(client, "127.0.0.1:17001", &testService{addr: "127.0.0.1:17001"})
+			So(node.Start(), ShouldNotBeNil)
+			So(node.Close(), ShouldNotBeNil)
+		})
+	})
+}
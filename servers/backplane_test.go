@@ -0,0 +1,307 @@
+package servers
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录收到的调用,模拟集群中的一个节点
+type testService struct {
+	lock    sync.Mutex
+	addr    string
+	calls   []string
+	clients []string      // 本节点上的客户端
+	online  int           // 本节点上目标用户的连接数
+	delay   time.Duration // 处理每个调用前的等待时间
+}
+
+func (s *testService) record(method string) {
+	time.Sleep(s.delay)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls = append(s.calls, method)
+}
+
+func (s *testService) Calls() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.calls...)
+}
+
+func (s *testService) Send2Client(ctx context.Context, req *pb.Send2ClientReq) (*pb.Send2ClientReply, error) {
+	s.record("Send2Client:" + req.ClientId)
+	return &pb.Send2ClientReply{}, nil
+}
+
+func (s *testService) CloseClient(ctx context.Context, req *pb.CloseClientReq) (*pb.CloseClientReply, error) {
+	s.record("CloseClient:" + req.ClientId)
+	return &pb.CloseClientReply{}, nil
+}
+
+func (s *testService) BindGroup(ctx context.Context, req *pb.BindGroupReq) (*pb.BindGroupReply, error) {
+	s.record("BindGroup:" + req.GroupName)
+	return &pb.BindGroupReply{}, nil
+}
+
+func (s *testService) Send2Group(ctx context.Context, req *pb.Send2GroupReq) (*pb.Send2GroupReply, error) {
+	s.record("Send2Group:" + req.GroupName)
+	return &pb.Send2GroupReply{}, nil
+}
+
+func (s *testService) Send2System(ctx context.Context, req *pb.Send2SystemReq) (*pb.Send2SystemReply, error) {
+	s.record("Send2System:" + req.SystemId)
+	return &pb.Send2SystemReply{}, nil
+}
+
+func (s *testService) GetGroupClients(ctx context.Context, req *pb.GetGroupClientsReq) (*pb.GetGroupClientsReply, error) {
+	s.record("GetGroupClients:" + req.GroupName)
+	return &pb.GetGroupClientsReply{List: s.clients}, nil
+}
+
+func (s *testService) Send2User(ctx context.Context, req *pb.Send2UserReq) (*pb.Send2UserReply, error) {
+	s.record("Send2User:" + req.UserId)
+	return &pb.Send2UserReply{Online: int32(s.online)}, nil
+}
+
+func (s *testService) GetUserClients(ctx context.Context, req *pb.GetUserClientsReq) (*pb.GetUserClientsReply, error) {
+	s.record("GetUserClients:" + req.UserId)
+	return &pb.GetUserClientsReply{List: s.clients}, nil
+}
+
+func (s *testService) GetMessageStatus(ctx context.Context, req *pb.GetMessageStatusReq) (*pb.GetMessageStatusReply, error) {
+	s.record("GetMessageStatus:" + req.MessageId)
+	return &pb.GetMessageStatusReply{MessageId: req.MessageId, ClientId: req.ClientId, Status: AckStatusAcked, Retries: 1}, nil
+}
+
+func (s *testService) PeekOfflineMessages(ctx context.Context, req *pb.PeekOfflineMessagesReq) (*pb.PeekOfflineMessagesReply, error) {
+	s.record("PeekOfflineMessages:" + req.UserId)
+	return &pb.PeekOfflineMessagesReply{List: []*pb.OfflineMessage{
+		{MessageId: s.addr, SystemId: req.SystemId, UserId: req.UserId, Code: 1, Data: "data"},
+	}}, nil
+}
+
+func (s *testService) DeleteOfflineMessages(ctx context.Context, req *pb.DeleteOfflineMessagesReq) (*pb.DeleteOfflineMessagesReply, error) {
+	s.record("DeleteOfflineMessages:" + req.UserId)
+	return &pb.DeleteOfflineMessagesReply{}, nil
+}
+
+func (s *testService) CountSystemClients(ctx context.Context, req *pb.CountSystemClientsReq) (*pb.CountSystemClientsReply, error) {
+	s.record("CountSystemClients:" + req.SystemId)
+	return &pb.CountSystemClientsReply{Counts: map[string]int32{req.SystemId: int32(len(s.clients))}}, nil
+}
+
+func (s *testService) UnbindGroup(ctx context.Context, req *pb.UnbindGroupReq) (*pb.UnbindGroupReply, error) {
+	s.record("UnbindGroup:" + req.GroupName)
+	return &pb.UnbindGroupReply{}, nil
+}
+
+func (s *testService) LeaveGroup(ctx context.Context, req *pb.LeaveGroupReq) (*pb.LeaveGroupReply, error) {
+	s.record("LeaveGroup:" + req.UserId)
+	return &pb.LeaveGroupReply{Count: int32(s.online)}, nil
+}
+
+func (s *testService) GetClientGroups(ctx context.Context, req *pb.GetClientGroupsReq) (*pb.GetClientGroupsReply, error) {
+	s.record("GetClientGroups:" + req.ClientId)
+	return &pb.GetClientGroupsReply{List: []string{"group"}}, nil
+}
+
+func (s *testService) DissolveGroup(ctx context.Context, req *pb.DissolveGroupReq) (*pb.DissolveGroupReply, error) {
+	s.record("DissolveGroup:" + req.GroupName)
+	return &pb.DissolveGroupReply{Count: int32(len(s.clients))}, nil
+}
+
+func (s *testService) GetPresence(ctx context.Context, req *pb.GetPresenceReq) (*pb.GetPresenceReply, error) {
+	s.record("GetPresence:" + req.SystemId)
+	response := &pb.GetPresenceReply{}
+	for _, userId := range req.UserIds {
+		response.List = append(response.List, &pb.UserPresence{UserId: userId, Count: int32(s.online), LastSeen: int64(len(s.addr))})
+	}
+	return response, nil
+}
+
+func (s *testService) GetUserDevices(ctx context.Context, req *pb.GetUserDevicesReq) (*pb.GetUserDevicesReply, error) {
+	s.record("GetUserDevices:" + req.UserId)
+	response := &pb.GetUserDevicesReply{}
+	for _, clientId := range s.clients {
+		response.List = append(response.List, &pb.Device{ClientId: clientId, SystemId: req.SystemId, Node: s.addr})
+	}
+	return response, nil
+}
+
+func (s *testService) PresenceChanged(ctx context.Context, req *pb.PresenceChangedReq) (*pb.PresenceChangedReply, error) {
+	s.record("PresenceChanged:" + req.UserId)
+	return &pb.PresenceChangedReply{}, nil
+}
+
+func (s *testService) GetGroupMembers(ctx context.Context, req *pb.GetGroupMembersReq) (*pb.GetGroupMembersReply, error) {
+	s.record("GetGroupMembers:" + req.GroupName)
+	response := &pb.GetGroupMembersReply{Count: int32(len(s.clients))}
+	for _, clientId := range s.clients {
+		if req.Limit > 0 && len(response.List) >= int(req.Limit) {
+			break
+		}
+		if clientId > req.Cursor {
+			response.List = append(response.List, &pb.GroupMember{ClientId: clientId, UserId: "userId", Node: s.addr})
+		}
+	}
+	if req.Dedupe {
+		response.UserIds = []string{"userId"}
+	}
+	return response, nil
+}
+
+func (s *testService) StreamGroupClients(req *pb.GetGroupMembersReq, stream pb.CommonService_StreamGroupClientsServer) error {
+	s.record("StreamGroupClients:" + req.GroupName)
+	for _, clientId := range s.clients {
+		if err := stream.Send(&pb.GetGroupMembersReply{List: []*pb.GroupMember{{ClientId: clientId, Node: s.addr}}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//验证各实现对同一组节点的行为一致
+func testBackplane(backplane Backplane, services []*testService) {
+	Convey("发送到指定节点", func() {
+		So(backplane.Send2Client(services[1].addr, &pb.Send2ClientReq{ClientId: "clientId"}), ShouldBeNil)
+		So(backplane.CloseClient(services[1].addr, &pb.CloseClientReq{ClientId: "clientId"}), ShouldBeNil)
+		So(backplane.BindGroup(services[1].addr, &pb.BindGroupReq{GroupName: "group"}), ShouldBeNil)
+		So(backplane.UnbindGroup(services[1].addr, &pb.UnbindGroupReq{GroupName: "group"}), ShouldBeNil)
+		So(backplane.GetClientGroups(services[1].addr, &pb.GetClientGroupsReq{ClientId: "clientId"}), ShouldResemble, []string{"group"})
+		So(services[0].Calls(), ShouldBeEmpty)
+		So(services[1].Calls(), ShouldResemble, []string{"Send2Client:clientId", "CloseClient:clientId", "BindGroup:group", "UnbindGroup:group", "GetClientGroups:clientId"})
+
+		status, ok := backplane.GetMessageStatus(services[1].addr, &pb.GetMessageStatusReq{ClientId: "clientId", MessageId: "messageId"})
+		So(ok, ShouldBeTrue)
+		So(status.MessageId, ShouldEqual, "messageId")
+		So(status.Status, ShouldEqual, AckStatusAcked)
+		So(status.Retries, ShouldEqual, 1)
+	})
+
+	Convey("广播到所有节点", func() {
+		services[0].online = 1
+		services[1].online = 2
+		online, result := backplane.Send2User(&pb.Send2UserReq{UserId: "userId"})
+		So(online, ShouldEqual, 3)
+		So(result.Nodes, ShouldEqual, len(services))
+		So(result.Reached, ShouldEqual, len(services))
+
+		result = backplane.Send2Group(&pb.Send2GroupReq{GroupName: "group"})
+		So(result.Reached, ShouldEqual, len(services))
+		result = backplane.Send2System(&pb.Send2SystemReq{SystemId: "system"})
+		So(result.Reached, ShouldEqual, len(services))
+		count, result := backplane.LeaveGroup(&pb.LeaveGroupReq{GroupName: "group", UserId: "userId"})
+		So(count, ShouldEqual, 3)
+		So(result.Reached, ShouldEqual, len(services))
+		for _, service := range services {
+			So(service.Calls(), ShouldResemble, []string{"Send2User:userId", "Send2Group:group", "Send2System:system", "LeaveGroup:userId"})
+		}
+	})
+
+	Convey("汇总各节点的查询结果", func() {
+		services[0].clients = []string{"first"}
+		services[1].clients = []string{"second"}
+		So(backplane.GetGroupClients(&pb.GetGroupClientsReq{GroupName: "group"}), ShouldHaveLength, 2)
+		So(backplane.GetUserClients(&pb.GetUserClientsReq{UserId: "userId"}), ShouldHaveLength, 2)
+
+		members, count := backplane.GetGroupMembers(&pb.GetGroupMembersReq{GroupName: "group", Dedupe: true})
+		So(members, ShouldHaveLength, 2)
+		//两个节点上是同一个用户
+		So(count, ShouldEqual, 1)
+		members = backplane.StreamGroupClients(&pb.GetGroupMembersReq{GroupName: "group"})
+		So(members, ShouldHaveLength, 2)
+		So([]string{members[0].Node, members[1].Node}, ShouldContain, services[1].addr)
+
+		messages := backplane.PeekOfflineMessages(&pb.PeekOfflineMessagesReq{SystemId: "system", UserId: "userId"})
+		So(messages, ShouldHaveLength, len(services))
+		So(messages[0].UserId, ShouldEqual, "userId")
+		So(messages[0].Data, ShouldEqual, "data")
+		deleted := backplane.DeleteOfflineMessages(&pb.DeleteOfflineMessagesReq{SystemId: "system", UserId: "userId", MessageIds: []string{messages[0].MessageId}})
+		So(deleted.Reached, ShouldEqual, len(services))
+
+		counts := backplane.CountSystemClients(&pb.CountSystemClientsReq{SystemId: "system"})
+		So(counts, ShouldResemble, map[string]int{"system": 2})
+
+		count, result := backplane.DissolveGroup(&pb.DissolveGroupReq{GroupName: "group"})
+		So(count, ShouldEqual, 2)
+		So(result.Reached, ShouldEqual, len(services))
+
+		devices, _ := backplane.GetUserDevices(&pb.GetUserDevicesReq{SystemId: "system", UserId: "userId"})
+		So(devices, ShouldHaveLength, 2)
+		So([]string{devices[0].Node, devices[1].Node}, ShouldContain, services[1].addr)
+
+		services[0].online = 1
+		presence := backplane.GetPresence(&pb.GetPresenceReq{SystemId: "system", UserIds: []string{"userId"}})
+		So(presence, ShouldHaveLength, len(services))
+
+		result = backplane.PresenceChanged(&pb.PresenceChangedReq{SystemId: "system", UserId: "userId", Online: true})
+		So(result.Reached, ShouldEqual, len(services))
+	})
+}
+
+func TestMemoryBackplane(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.RPCTimeout = 1
+
+	Convey("测试进程内的集群", t, func() {
+		hub := NewMemoryHub()
+		services := []*testService{{addr: "127.0.0.1:17001"}, {addr: "127.0.0.1:17002"}}
+		var nodes []*MemoryBackplane
+		for _, service := range services {
+			node := hub.NewNode(service.addr, service)
+			So(node.Start(), ShouldBeNil)
+			nodes = append(nodes, node)
+		}
+
+		testBackplane(nodes[0], services)
+
+		Convey("节点离开后调用失败", func() {
+			So(nodes[1].Close(), ShouldBeNil)
+			So(nodes[0].Send2Client(services[1].addr, &pb.Send2ClientReq{ClientId: "clientId"}), ShouldNotBeNil)
+
+			result := nodes[0].Send2System(&pb.Send2SystemReq{SystemId: "system"})
+			So(result.Nodes, ShouldEqual, 1)
+			So(result.Reached, ShouldEqual, 1)
+		})
+
+		Convey("节点超时", func() {
+			services[1].delay = 2 * time.Second
+			start := time.Now()
+			result := nodes[0].Send2System(&pb.Send2SystemReq{SystemId: "system"})
+			So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+			So(result.Reached, ShouldEqual, 1)
+			So(result.Failed, ShouldResemble, []string{services[1].addr})
+		})
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	Convey("测试按方法名调用", t, func() {
+		service := &testService{}
+		response, err := dispatch(context.Background(), service, "Send2User", []byte(`{}`))
+		So(err, ShouldBeNil)
+		So(response, ShouldHaveSameTypeAs, &pb.Send2UserReply{})
+
+		_, err = dispatch(context.Background(), service, "Unknown", []byte(`{}`))
+		So(err, ShouldNotBeNil)
+
+		_, err = dispatch(context.Background(), service, "Send2User", []byte(`invalid`))
+		So(err, ShouldNotBeNil)
+
+		//所有非流式的方法都可以按方法名调用
+		server := reflect.TypeOf((*pb.CommonServiceServer)(nil)).Elem()
+		contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
+		for i := 0; i < server.NumMethod(); i++ {
+			method := server.Method(i)
+			if method.Type.NumIn() == 2 && method.Type.In(0) == contextType {
+				So(dispatchMethods, ShouldContainKey, method.Name)
+			}
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//建立一对连接,服务端收到的消息写入messages,compress为true时协商permessage-deflate压缩
+func newBroadcastConn(t testing.TB, compress bool) (*websocket.Conn, chan []byte, func()) {
+	messages := make(chan []byte, 16)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{EnableCompression: compress}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- message:
+			default:
+			}
+		}
+	}))
+	dialer := websocket.Dialer{EnableCompression: compress}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, messages, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestPreparedMessage(t *testing.T) {
+	Convey("测试广播时共享编码后的消息", t, func() {
+		data := "hello"
+		info := clientInfo{MessageId: "messageId", SendUserId: "sender", Code: 0, Msg: "success", Data: &data}
+
+		for _, compress := range []bool{false, true} {
+			conn, messages, closeConn := newBroadcastConn(t, compress)
+			client := &Client{Socket: conn}
+
+			So(client.render(info), ShouldBeNil)
+			expected := <-messages
+
+			//与单独编码的消息完全一致
+			info.prepared = prepareMessage(info.MessageId, info.SendUserId, info.Code, info.Msg, info.Data)
+			So(info.prepared, ShouldNotBeNil)
+			So(client.render(info), ShouldBeNil)
+			So(<-messages, ShouldResemble, expected)
+
+			info.prepared = nil
+			closeConn()
+		}
+	})
+}
+
+//向1万个成员的分组广播一条消息,每个成员单独编码和所有成员共享编码的对比
+//各成员的写入都发往同一个连接,只统计编码、压缩和写入的开销
+func BenchmarkBroadcast(b *testing.B) {
+	const members = 10000
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	data := `{"content":"` + strings.Repeat("广播的消息内容", 20) + `"}`
+	info := clientInfo{MessageId: "messageId", SendUserId: "sender", Code: 0, Msg: "success", Data: &data}
+
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "compressed"
+		}
+
+		b.Run(name+"/encodeEach", func(b *testing.B) {
+			conn, _, closeConn := newBroadcastConn(b, compress)
+			defer closeConn()
+			client := &Client{Socket: conn}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for m := 0; m < members; m++ {
+					if err := client.render(info); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(name+"/prepared", func(b *testing.B) {
+			conn, _, closeConn := newBroadcastConn(b, compress)
+			defer closeConn()
+			client := &Client{Socket: conn}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				shared := info
+				shared.prepared = prepareMessage(info.MessageId, info.SendUserId, info.Code, info.Msg, info.Data)
+				for m := 0; m < members; m++ {
+					if err := client.render(shared); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
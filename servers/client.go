@@ -8,6 +8,8 @@ import (
 	"github.com/woodylan/go-websocket/define/retcode"
 	"github.com/woodylan/go-websocket/pkg/setting"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +23,25 @@ type Client struct {
 	UserId      string          // 业务端标识用户ID
 	Extend      string          // 扩展字段，用户可以自定义
 	GroupList   []string        // 该客户端绑定到的组列表
+
+	lock sync.RWMutex // 保护UserId、Extend和GroupList,连接的读协程、接口和RPC都会修改,通过getUser、getGroups等方法读写
+
+	sendChan    chan clientInfo // 发送队列,由该客户端自己的写协程消费
+	closeChan   chan struct{}   // 关闭信号,通知写协程退出,恢复会话时和发送队列一起交给新的客户端
+	closeOnce   *sync.Once
+	suspendChan chan struct{} // 连接断开等待恢复时关闭,通知写协程退出,发送队列保留
+	resumeToken string        // 断线重连时用来恢复会话的凭证,每次连接都会重新生成
+	state       int32         // 会话状态
+	kicked      int32         // 是否被主动关闭,主动关闭的连接不保留会话
+
+	authorized    bool     // 是否通过连接凭证认证,认证后的客户端不能修改userId
+	allowedGroups []string // 连接凭证中允许加入的分组
+
+	limiter   rateLimiter // 客户端发送事件的限流
+	throttled int         // 连续被限流的次数,只在读协程中修改
+
+	disconnectReason string // 第一次触发断开的原因
+	reasonOnce       sync.Once
 }
 
 type SendData struct {
@@ -37,7 +58,231 @@ func NewClient(clientId string, systemId string, notify bool, socket *websocket.
 		ConnectTime: uint64(time.Now().Unix()),
 		IsDeleted:   false,
 		Notify:      notify,
+		sendChan:    make(chan clientInfo, sendQueueSize()),
+		closeChan:   make(chan struct{}),
+		closeOnce:   &sync.Once{},
+		suspendChan: make(chan struct{}),
+	}
+}
+
+//发送队列长度,未配置时使用默认值
+func sendQueueSize() int {
+	if setting.CommonSetting.SendQueueSize > 0 {
+		return setting.CommonSetting.SendQueueSize
+	}
+	return defaultSendQueueSize
+}
+
+//业务端的用户ID和扩展字段
+func (c *Client) getUser() (userId, extend string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.UserId, c.Extend
+}
+
+//业务端的用户ID
+func (c *Client) getUserId() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.UserId
+}
+
+//修改用户ID和扩展字段,返回原来的用户ID
+func (c *Client) setUser(userId, extend string) (oldUserId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	oldUserId = c.UserId
+	c.UserId, c.Extend = userId, extend
+	return
+}
+
+//已加入分组的副本,调用方可以随意修改
+func (c *Client) getGroups() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]string{}, c.GroupList...)
+}
+
+//客户端是否已加入该分组
+func (c *Client) inGroup(groupName string) bool {
+	if len(groupName) == 0 {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, group := range c.GroupList {
+		if group == groupName {
+			return true
+		}
+	}
+	return false
+}
+
+//加入分组,已经加入过则返回false
+func (c *Client) addGroup(groupName string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, group := range c.GroupList {
+		if group == groupName {
+			return false
+		}
+	}
+	c.GroupList = append(c.GroupList, groupName)
+	return true
+}
+
+//离开分组,不在该分组中时返回false
+func (c *Client) removeGroup(groupName string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	//重新分配列表,不修改之前返回的列表
+	groupList := make([]string, 0, len(c.GroupList))
+	for _, group := range c.GroupList {
+		if group != groupName {
+			groupList = append(groupList, group)
+		}
+	}
+	if len(groupList) == len(c.GroupList) {
+		return false
 	}
+	c.GroupList = groupList
+	return true
+}
+
+//将消息放入发送队列,队列满时按照配置的策略处理,不会阻塞调用方
+func (c *Client) Send(info clientInfo) {
+	select {
+	case <-c.closeChan:
+		return
+	default:
+	}
+
+	select {
+	case c.sendChan <- info:
+		return
+	default:
+	}
+
+	fields := log.Fields{
+		"host":      setting.GlobalSetting.LocalHost,
+		"port":      setting.CommonSetting.HttpPort,
+		"systemId":  c.SystemId,
+		"clientId":  c.ClientId,
+		"messageId": info.MessageId,
+	}
+
+	switch setting.CommonSetting.SlowPolicy {
+	case SlowPolicyDropNewest:
+		log.WithFields(fields).Warn("发送队列已满,丢弃最新的消息")
+	case SlowPolicyDisconnect:
+		log.WithFields(fields).Warn("发送队列已满,断开客户端连接")
+		c.kick(DisconnectSlow)
+	default:
+		//丢弃最早的消息,腾出位置给新消息
+		select {
+		case dropped := <-c.sendChan:
+			fields["dropMessageId"] = dropped.MessageId
+		default:
+		}
+		select {
+		case c.sendChan <- info:
+		default:
+		}
+		log.WithFields(fields).Warn("发送队列已满,丢弃最早的消息")
+	}
+}
+
+//写协程,从发送队列中取出消息写入连接
+func (c *Client) Write() {
+	go func() {
+		for {
+			//连接已断开,剩余的消息留在队列中等待恢复会话
+			select {
+			case <-c.suspendChan:
+				return
+			default:
+			}
+
+			select {
+			case info := <-c.sendChan:
+				_ = c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.render(info); err != nil {
+					writeErrorsTotal.With().Inc()
+					c.disconnect(DisconnectWriteError)
+					log.WithFields(log.Fields{
+						"host":     setting.GlobalSetting.LocalHost,
+						"port":     setting.CommonSetting.HttpPort,
+						"clientId": c.ClientId,
+						"msg":      info.Msg,
+					}).Error("Write客户端异常离线：" + err.Error())
+					return
+				}
+				if info.NeedAck {
+					Acks.Sent(info.MessageId)
+				}
+			case <-c.closeChan:
+				return
+			case <-c.suspendChan:
+				return
+			}
+		}
+	}()
+}
+
+//写入一条消息,广播的消息直接写入共享的帧
+func (c *Client) render(info clientInfo) error {
+	if info.prepared != nil {
+		return c.Socket.WritePreparedMessage(info.prepared)
+	}
+	return Render(c.Socket, info.MessageId, info.SendUserId, info.Code, info.Msg, info.Data)
+}
+
+//将消息放入发送队列,不等待,队列已满或者连接关闭则返回false
+func (c *Client) trySend(info clientInfo) bool {
+	select {
+	case <-c.closeChan:
+		return false
+	default:
+	}
+
+	select {
+	case c.sendChan <- info:
+		return true
+	default:
+		return false
+	}
+}
+
+//主动断开连接,不保留会话
+func (c *Client) Kick() {
+	c.kick(DisconnectKicked)
+}
+
+func (c *Client) kick(reason string) {
+	atomic.StoreInt32(&c.kicked, 1)
+	c.disconnect(reason)
+}
+
+//记录断开的原因,只保留第一次的原因
+func (c *Client) setDisconnectReason(reason string) {
+	c.reasonOnce.Do(func() {
+		c.disconnectReason = reason
+	})
+}
+
+//通知管理者断开连接
+func (c *Client) disconnect(reason string) {
+	c.setDisconnectReason(reason)
+	Manager.disconnect(c)
+}
+
+//通知写协程退出,可重复调用
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
 }
 
 func (c *Client) Read() {
@@ -55,7 +300,7 @@ func (c *Client) Read() {
 					"message":     string(msgBuffer),
 				}).Error("接受到客户端发送的无效消息:" + err.Error())
 				if messageType == -1 && websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
-					Manager.DisConnect <- c //关闭出错或者断开的连接
+					c.disconnect(DisconnectClosed) //关闭出错或者断开的连接
 					return
 				} else if messageType != websocket.PingMessage {
 					return
@@ -86,10 +331,55 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 	if len(systemId) == 0 {
 		systemId = c.SystemId
 	}
-	switch strings.ToUpper(msg.Event) {
+	event := strings.ToUpper(msg.Event)
+	policy := getSystemPolicy(c.SystemId)
+	//超过系统配额时忽略该事件,并提示客户端
+	if err := c.checkEventQuota(event, msg, policy); err != nil {
+		log.WithFields(log.Fields{
+			"event":    msg.Event,
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"systemId": c.SystemId,
+			"clientId": c.ClientId,
+		}).Warn("客户端事件超过系统配额: " + err.Error())
+		c.sendError(QuotaCode(err), err.Error())
+		if err == ErrSocketRateLimited {
+			c.throttle()
+		}
+		return
+	}
+	c.throttled = 0
+
+	//事件或目标未被系统授权时忽略该事件
+	if err := c.authorizeEvent(event, msg, policy); err != nil {
+		c.sendError(retcode.ForbiddenErrCode, err.Error())
+		return
+	}
+
+	switch event {
 	case Bind2Group:
+		if c.authorized && len(msg.GroupName) > 0 && !groupAllowed(c.allowedGroups, msg.GroupName) {
+			log.WithFields(log.Fields{
+				"event":     msg.Event,
+				"host":      setting.GlobalSetting.LocalHost,
+				"port":      setting.CommonSetting.HttpPort,
+				"systemId":  c.SystemId,
+				"clientId":  c.ClientId,
+				"groupName": msg.GroupName,
+			}).Error("B2G操作,连接凭证不允许加入该分组")
+			return
+		}
+
 		if len(msg.GroupName) > 0 {
-			AddClient2Group(systemId, msg.GroupName, c.ClientId, msg.UserId, msg.Extend)
+			userId, extend := msg.UserId, msg.Extend
+			//认证过的客户端只能使用连接凭证中的身份
+			if c.authorized {
+				systemId = c.SystemId
+				userId, extend = c.getUser()
+			}
+			if err := AddClient2Group(systemId, msg.GroupName, c.ClientId, userId, extend); err != nil {
+				c.sendError(retcode.QuotaErrCode, err.Error())
+			}
 		} else {
 			//该操作必传 GroupName,否则忽略
 			log.WithFields(log.Fields{
@@ -108,7 +398,7 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 			//该操作必传 ClientIds , 否则忽略
 			for _, clientId := range msg.ClientIds {
 				//发送信息
-				SendMessage2Client(clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data)
+				SendMessage2Client(c.SystemId, clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data, false)
 			}
 		} else {
 			log.WithFields(log.Fields{
@@ -128,7 +418,7 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 			if len(msg.ClientIds) > 0 {
 				for _, clientId := range msg.ClientIds {
 					//单个客户端发送信息
-					SendMessage2Client(clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data)
+					SendMessage2Client(c.SystemId, clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data, false)
 				}
 			} else {
 				//群发
@@ -152,7 +442,7 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 			if len(msg.ClientIds) > 0 {
 				for _, clientId := range msg.ClientIds {
 					//单个客户端发送信息
-					SendMessage2Client(clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data)
+					SendMessage2Client(c.SystemId, clientId, c.ClientId, retcode.SUCCESS, "success", &msg.Data, false)
 				}
 			} else {
 				//发所有当前用户的客户端连接
@@ -164,6 +454,106 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 		// 同时向群组内所有有效的客户端发送消息(CLS)
 		CloseClient(c.ClientId, systemId)
 
+	case Ack:
+		// 客户端确认收到消息(ACK)
+		if len(msg.MessageId) > 0 {
+			Acks.Ack(c.ClientId, msg.MessageId)
+		} else {
+			log.WithFields(log.Fields{
+				"event":    msg.Event,
+				"host":     setting.GlobalSetting.LocalHost,
+				"port":     setting.CommonSetting.HttpPort,
+				"systemId": c.SystemId,
+				"clientId": c.ClientId,
+				"message":  fmt.Sprintf("%+v", msg),
+			}).Error("ACK操作,MessageId必传 :")
+		}
+
+	case UnbindGroup:
+		// 将自己从组中解绑(UBG)
+		if len(msg.GroupName) > 0 {
+			DelClientFromGroup(c.SystemId, msg.GroupName, c.ClientId)
+		} else {
+			log.WithFields(log.Fields{
+				"event":    msg.Event,
+				"host":     setting.GlobalSetting.LocalHost,
+				"port":     setting.CommonSetting.HttpPort,
+				"systemId": c.SystemId,
+				"clientId": c.ClientId,
+				"message":  fmt.Sprintf("%+v", msg),
+			}).Error("UBG操作,GroupName必传 :")
+		}
+
+	case LeaveGroup:
+		// 当前用户的所有客户端离开组(LVG),没有userId时只有自己离开
+		if len(msg.GroupName) > 0 {
+			if userId := c.getUserId(); len(userId) > 0 {
+				DelUserFromGroup(c.SystemId, msg.GroupName, userId)
+			} else {
+				DelClientFromGroup(c.SystemId, msg.GroupName, c.ClientId)
+			}
+		} else {
+			log.WithFields(log.Fields{
+				"event":    msg.Event,
+				"host":     setting.GlobalSetting.LocalHost,
+				"port":     setting.CommonSetting.HttpPort,
+				"systemId": c.SystemId,
+				"clientId": c.ClientId,
+				"message":  fmt.Sprintf("%+v", msg),
+			}).Error("LVG操作,GroupName必传 :")
+		}
+
+	case GetGroups:
+		// 获取当前客户端加入的组(GCG),data为组名的Json数组
+		groupList, _ := json.Marshal(GetClientGroupList(c.SystemId, c.ClientId))
+		data := string(groupList)
+		c.Send(clientInfo{SystemId: c.SystemId, ClientId: c.ClientId, Code: retcode.SUCCESS, Msg: "success", Data: &data})
+
+	case Dissolve:
+		// 解散组(DSG),移出组内所有的客户端,notify为true时通知被移出的客户端
+		if len(msg.GroupName) > 0 {
+			DissolveGroup(c.SystemId, c.ClientId, msg.GroupName, msg.Notify)
+		} else {
+			log.WithFields(log.Fields{
+				"event":    msg.Event,
+				"host":     setting.GlobalSetting.LocalHost,
+				"port":     setting.CommonSetting.HttpPort,
+				"systemId": c.SystemId,
+				"clientId": c.ClientId,
+				"message":  fmt.Sprintf("%+v", msg),
+			}).Error("DSG操作,GroupName必传 :")
+		}
+
+	case Subscribe:
+		// 订阅同一系统中用户的上下线(SUB),data为这些用户当前的在线状态
+		if len(msg.UserIds) > 0 {
+			list, err := Subscriptions.Subscribe(c, msg.UserIds)
+			if err != nil {
+				c.sendError(retcode.QuotaErrCode, err.Error())
+				return
+			}
+			presence, _ := json.Marshal(list)
+			data := string(presence)
+			c.Send(clientInfo{SystemId: c.SystemId, ClientId: c.ClientId, Code: retcode.SUCCESS, Msg: "success", Data: &data})
+		} else {
+			log.WithFields(log.Fields{
+				"event":    msg.Event,
+				"host":     setting.GlobalSetting.LocalHost,
+				"port":     setting.CommonSetting.HttpPort,
+				"systemId": c.SystemId,
+				"clientId": c.ClientId,
+				"message":  fmt.Sprintf("%+v", msg),
+			}).Error("SUB操作,UserIds必传 :")
+		}
+
+	case Unsubscribe:
+		// 取消订阅用户的上下线(UNS),不传UserIds时取消所有的订阅
+		Subscriptions.Unsubscribe(c, msg.UserIds)
+
+	case Upstream:
+		// 通过回调发送给业务系统(UPS),系统没有配置回调时忽略
+		Webhooks.Emit(webhookEvent{Event: WebhookUpstream, SystemId: c.SystemId, ClientId: c.ClientId, UserId: c.getUserId(), Data: msg.Data})
+
 	default:
 		//忽略掉无法识别的消息
 		log.WithFields(log.Fields{
@@ -178,7 +568,7 @@ func handlerClientMsg(c *Client, msg *clientMsg) {
 }
 
 type clientMsg struct {
-	Event      string   `json:"event" validate:"required"` // 发送消息需要做的操作类型：[绑定到组(B2G)|单发(S2C)|多发(S2M)|群发(S2G)|自发(S2U)|关闭(CLS)]
+	Event      string   `json:"event" validate:"required"` // 发送消息需要做的操作类型：[绑定到组(B2G)|解绑(UBG)|离开组(LVG)|查询组(GCG)|解散组(DSG)|订阅(SUB)|取消订阅(UNS)|单发(S2C)|多发(S2M)|群发(S2G)|自发(S2U)|关闭(CLS)|确认(ACK)|上行(UPS)]
 	SystemId   string   `json:"systemId"`                  // 系统标识，不传则默认使用当前客户端绑定的系统标识，后续可能需要跨系统发送消息
 	SendUserId string   `json:"sendUserId"`                // 发送者的clientId，不传则默认使用当前客户端的clientId
 	GroupName  string   `json:"groupName"`                 // 群发时候的groupName，无默认值，当event的值为B2G和S2G时必传，否则视为无效消息
@@ -186,6 +576,9 @@ type clientMsg struct {
 	Extend     string   `json:"extend"`                    // 业务端扩展字段,无默认值,用户可以自定义,可以在event的值为B2G时绑定一次，后续的操作中可以透传
 	ClientIds  []string `json:"clientIds"`                 // 单发或者多发的时候消息接收者的clientId，无默认值，当event的值为S2G时，如clientIds同时不为空，则以clientIds为准，当event的值为S2C或者S2M时必传，否则视为无效消息
 	Data       string   `json:"data"`                      // 业务数据，字符串类型，建议使用Json格式，根据各个业务系统需要自定义
+	MessageId  string   `json:"messageId"`                 // 确认收到的消息ID，当event的值为ACK时必传，否则视为无效消息
+	Notify     bool     `json:"notify"`                    // 解散组时是否通知被移出的客户端，只在event的值为DSG时有效
+	UserIds    []string `json:"userIds"`                   // 订阅或者取消订阅上下线的用户，当event的值为SUB时必传
 }
 
 const (
@@ -201,4 +594,29 @@ const (
 	Send2User = "S2U"
 	// 客户端主动向服务器请求关闭连接(CLS)
 	Close = "CLS"
+	// 客户端确认收到消息(ACK)
+	Ack = "ACK"
+	// 客户端发送消息给业务系统(UPS)
+	Upstream = "UPS"
+	// 将客户端从组中解绑(UBG)
+	UnbindGroup = "UBG"
+	// 当前用户的所有客户端离开组(LVG)
+	LeaveGroup = "LVG"
+	// 获取当前客户端加入的组(GCG)
+	GetGroups = "GCG"
+	// 解散组(DSG)
+	Dissolve = "DSG"
+	// 订阅用户的上下线(SUB)
+	Subscribe = "SUB"
+	// 取消订阅用户的上下线(UNS)
+	Unsubscribe = "UNS"
+)
+
+const (
+	// 发送队列满时丢弃最早的消息
+	SlowPolicyDropOldest = "dropOldest"
+	// 发送队列满时丢弃最新的消息
+	SlowPolicyDropNewest = "dropNewest"
+	// 发送队列满时断开连接
+	SlowPolicyDisconnect = "disconnect"
 )
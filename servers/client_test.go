@@ -0,0 +1,88 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//等待之前的测试留下的连接事件和通知处理完成之后再重置配置,避免和处理时读取配置竞争
+func resetSetting() {
+	pending.Wait()
+	setting.Default()
+}
+
+//建立一个真实的websocket连接,连接断开时可以正常关闭
+func newTestConn(t *testing.T) (*websocket.Conn, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, s.Close
+}
+
+func TestClientSend(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.SendQueueSize = 2
+	conn := &websocket.Conn{}
+
+	Convey("测试发送队列满时的处理策略", t, func() {
+		Convey("丢弃最早的消息", func() {
+			setting.CommonSetting.SlowPolicy = SlowPolicyDropOldest
+			client := NewClient("clientId", "publishSystem", false, conn)
+			client.Send(clientInfo{MessageId: "1"})
+			client.Send(clientInfo{MessageId: "2"})
+			client.Send(clientInfo{MessageId: "3"})
+			So(len(client.sendChan), ShouldEqual, 2)
+			So((<-client.sendChan).MessageId, ShouldEqual, "2")
+			So((<-client.sendChan).MessageId, ShouldEqual, "3")
+		})
+
+		Convey("丢弃最新的消息", func() {
+			setting.CommonSetting.SlowPolicy = SlowPolicyDropNewest
+			client := NewClient("clientId", "publishSystem", false, conn)
+			client.Send(clientInfo{MessageId: "1"})
+			client.Send(clientInfo{MessageId: "2"})
+			client.Send(clientInfo{MessageId: "3"})
+			So(len(client.sendChan), ShouldEqual, 2)
+			So((<-client.sendChan).MessageId, ShouldEqual, "1")
+			So((<-client.sendChan).MessageId, ShouldEqual, "2")
+		})
+
+		Convey("断开连接", func() {
+			setting.CommonSetting.SlowPolicy = SlowPolicyDisconnect
+			conn, closeServer := newTestConn(t)
+			defer closeServer()
+			client := NewClient("clientId", "publishSystem", false, conn)
+			client.Send(clientInfo{MessageId: "1"})
+			client.Send(clientInfo{MessageId: "2"})
+			client.Send(clientInfo{MessageId: "3"})
+			So(len(client.sendChan), ShouldEqual, 2)
+			So(atomic.LoadInt32(&client.kicked), ShouldEqual, 1)
+		})
+
+		Convey("关闭之后不再入队", func() {
+			client := NewClient("clientId", "publishSystem", false, conn)
+			client.close()
+			client.close()
+			client.Send(clientInfo{MessageId: "1"})
+			So(len(client.sendChan), ShouldEqual, 0)
+		})
+	})
+}
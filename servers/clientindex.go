@@ -0,0 +1,142 @@
+package servers
+
+import (
+	"sync"
+)
+
+//索引的分片数,不同的key分散到各分片,减少锁的竞争
+const indexShards = 64
+
+// key到clientId集合的索引,用于分组、用户和系统的连接列表
+// 按key分片加锁,加入和删除都是O(1),读取时返回快照,遍历期间不受成员变化影响
+type ClientIndex struct {
+	shards [indexShards]indexShard
+
+	//key的第一个成员加入和最后一个成员删除时在分片的锁内调用,同一个key的通知保持顺序
+	onFirst func(key string)
+	onEmpty func(key string)
+}
+
+type indexShard struct {
+	lock sync.RWMutex
+	sets map[string]map[string]struct{}
+}
+
+func NewClientIndex() *ClientIndex {
+	index := &ClientIndex{}
+	for i := range index.shards {
+		index.shards[i].sets = make(map[string]map[string]struct{})
+	}
+	return index
+}
+
+//使用FNV-1a计算key的哈希,避免每次查找都分配内存
+func (index *ClientIndex) shard(key string) *indexShard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &index.shards[h%indexShards]
+}
+
+// 添加成员,已经存在时返回false
+func (index *ClientIndex) Add(key, clientId string) bool {
+	return index.AddLimit(key, clientId, 0)
+}
+
+// 成员数小于limit时添加成员,检查和添加在同一个锁内,limit<=0时不限制,已经存在或者达到上限时返回false
+func (index *ClientIndex) AddLimit(key, clientId string, limit int) bool {
+	shard := index.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	set, ok := shard.sets[key]
+	if _, exists := set[clientId]; exists {
+		return false
+	}
+	if limit > 0 && len(set) >= limit {
+		return false
+	}
+	if !ok {
+		set = make(map[string]struct{})
+		shard.sets[key] = set
+	}
+	set[clientId] = struct{}{}
+
+	if len(set) == 1 && index.onFirst != nil {
+		index.onFirst(key)
+	}
+	return true
+}
+
+// 删除成员,不存在时返回false
+func (index *ClientIndex) Remove(key, clientId string) bool {
+	shard := index.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	set, ok := shard.sets[key]
+	if !ok {
+		return false
+	}
+	if _, ok = set[clientId]; !ok {
+		return false
+	}
+	delete(set, clientId)
+
+	if len(set) == 0 {
+		delete(shard.sets, key)
+		if index.onEmpty != nil {
+			index.onEmpty(key)
+		}
+	}
+	return true
+}
+
+// 成员的快照,顺序不固定,调用方可以随意修改
+func (index *ClientIndex) Members(key string) []string {
+	shard := index.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	set := shard.sets[key]
+	clientIds := make([]string, 0, len(set))
+	for clientId := range set {
+		clientIds = append(clientIds, clientId)
+	}
+	return clientIds
+}
+
+// 是否包含该成员
+func (index *ClientIndex) Has(key, clientId string) bool {
+	shard := index.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	_, ok := shard.sets[key][clientId]
+	return ok
+}
+
+// 成员数量
+func (index *ClientIndex) Count(key string) int {
+	shard := index.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	return len(shard.sets[key])
+}
+
+// 各key的成员数量,逐个分片加锁,不是整个索引在同一时刻的快照
+func (index *ClientIndex) Counts() map[string]int {
+	counts := make(map[string]int)
+	for i := range index.shards {
+		shard := &index.shards[i]
+		shard.lock.RLock()
+		for key, set := range shard.sets {
+			counts[key] = len(set)
+		}
+		shard.lock.RUnlock()
+	}
+	return counts
+}
@@ -0,0 +1,206 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestClientIndex(t *testing.T) {
+	Convey("测试连接索引", t, func() {
+		index := NewClientIndex()
+		var events []string
+		index.onFirst = func(key string) { events = append(events, "first:"+key) }
+		index.onEmpty = func(key string) { events = append(events, "empty:"+key) }
+
+		Convey("添加和删除成员", func() {
+			So(index.Add("group", "first"), ShouldBeTrue)
+			So(index.Add("group", "first"), ShouldBeFalse)
+			So(index.Add("group", "second"), ShouldBeTrue)
+			So(index.Count("group"), ShouldEqual, 2)
+			So(index.Has("group", "first"), ShouldBeTrue)
+
+			So(index.Remove("group", "first"), ShouldBeTrue)
+			So(index.Remove("group", "first"), ShouldBeFalse)
+			So(index.Remove("other", "first"), ShouldBeFalse)
+			So(index.Members("group"), ShouldResemble, []string{"second"})
+
+			//第一个成员加入和最后一个成员删除时通知
+			So(index.Remove("group", "second"), ShouldBeTrue)
+			So(events, ShouldResemble, []string{"first:group", "empty:group"})
+			So(index.Counts(), ShouldBeEmpty)
+		})
+
+		Convey("成员数达到上限时不添加", func() {
+			So(index.AddLimit("system", "first", 2), ShouldBeTrue)
+			So(index.AddLimit("system", "first", 2), ShouldBeFalse)
+			So(index.AddLimit("system", "second", 2), ShouldBeTrue)
+			So(index.AddLimit("system", "third", 2), ShouldBeFalse)
+			So(index.Count("system"), ShouldEqual, 2)
+			So(index.AddLimit("system", "third", 0), ShouldBeTrue)
+		})
+
+		Convey("并发添加时不超过上限", func() {
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			added := 0
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if index.AddLimit("system", strconv.Itoa(i), 10) {
+						lock.Lock()
+						added++
+						lock.Unlock()
+					}
+				}(i)
+			}
+			wg.Wait()
+			So(added, ShouldEqual, 10)
+			So(index.Count("system"), ShouldEqual, 10)
+		})
+
+		Convey("读取时返回快照", func() {
+			index.Add("group", "first")
+			index.Add("group", "second")
+			members := index.Members("group")
+			index.Remove("group", "first")
+			index.Add("group", "third")
+
+			sort.Strings(members)
+			So(members, ShouldResemble, []string{"first", "second"})
+			So(index.Members("notExist"), ShouldBeEmpty)
+		})
+
+		Convey("统计各key的成员数", func() {
+			for i := 0; i < 100; i++ {
+				index.Add("system"+strconv.Itoa(i%3), strconv.Itoa(i))
+			}
+			So(index.Counts(), ShouldResemble, map[string]int{"system0": 34, "system1": 33, "system2": 33})
+		})
+	})
+}
+
+//分组成员的索引,用来对比原来基于切片的实现
+type membershipIndex interface {
+	Add(key, clientId string) bool
+	Remove(key, clientId string) bool
+	Members(key string) []string
+}
+
+//原来的实现:整个索引一把锁,删除时线性查找
+//原来读取时直接返回内部的切片,并发遍历不安全,这里在锁内复制一份以便公平比较
+type sliceIndex struct {
+	lock sync.RWMutex
+	sets map[string][]string
+}
+
+func newSliceIndex() *sliceIndex {
+	return &sliceIndex{sets: make(map[string][]string)}
+}
+
+func (index *sliceIndex) Add(key, clientId string) bool {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	for _, id := range index.sets[key] {
+		if id == clientId {
+			return false
+		}
+	}
+	index.sets[key] = append(index.sets[key], clientId)
+	return true
+}
+
+func (index *sliceIndex) Remove(key, clientId string) bool {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	for i, id := range index.sets[key] {
+		if id == clientId {
+			index.sets[key] = append(index.sets[key][:i], index.sets[key][i+1:]...)
+			if len(index.sets[key]) == 0 {
+				delete(index.sets, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (index *sliceIndex) Members(key string) []string {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	return append([]string{}, index.sets[key]...)
+}
+
+func benchmarkIndexes(b *testing.B, run func(b *testing.B, index membershipIndex)) {
+	b.Run("slice", func(b *testing.B) {
+		run(b, newSliceIndex())
+	})
+	b.Run("sharded", func(b *testing.B) {
+		run(b, NewClientIndex())
+	})
+}
+
+func fillIndex(index membershipIndex, groups, members int) {
+	for g := 0; g < groups; g++ {
+		for m := 0; m < members; m++ {
+			index.Add("group"+strconv.Itoa(g), "client"+strconv.Itoa(g)+"-"+strconv.Itoa(m))
+		}
+	}
+}
+
+//大分组中成员的加入和离开
+func BenchmarkIndexJoinLeave(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, index membershipIndex) {
+		fillIndex(index, 1, 20000)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			clientId := "client0-" + strconv.Itoa(i%20000)
+			index.Remove("group0", clientId)
+			index.Add("group0", clientId)
+		}
+	})
+}
+
+//大量连接在不同分组中并发加入和离开
+func BenchmarkIndexJoinLeaveParallel(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, index membershipIndex) {
+		fillIndex(index, 1000, 100)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				group := strconv.Itoa(i % 1000)
+				clientId := "client" + group + "-" + strconv.Itoa(i%100)
+				index.Remove("group"+group, clientId)
+				index.Add("group"+group, clientId)
+				i++
+			}
+		})
+	})
+}
+
+//分组广播时读取成员,同时有其他连接加入和离开
+func BenchmarkIndexBroadcastWithChurn(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, index membershipIndex) {
+		fillIndex(index, 100, 1000)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				group := "group" + strconv.Itoa(i%100)
+				if i%10 == 0 {
+					for range index.Members(group) {
+					}
+				} else {
+					clientId := "client" + strconv.Itoa(i%100) + "-" + strconv.Itoa(i%1000)
+					index.Remove(group, clientId)
+					index.Add(group, clientId)
+				}
+				i++
+			}
+		})
+	})
+}
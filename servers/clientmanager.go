@@ -9,6 +9,7 @@ import (
 	"github.com/woodylan/go-websocket/tools/util"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,21 +18,30 @@ type ClientManager struct {
 	ClientIdMap     map[string]*Client // 全部的连接
 	ClientIdMapLock sync.RWMutex       // 读写锁
 
-	Connect    chan *Client // 连接处理
-	DisConnect chan *Client // 断开连接处理
+	Connect    chan *Client // 连接处理,通过connect方法发送
+	DisConnect chan *Client // 断开连接处理,通过disconnect方法发送
 
-	GroupLock sync.RWMutex
-	Groups    map[string][]string // 群组
-	// key为GroupName;value为ClientId列表
+	Groups *ClientIndex // 群组
+	// key为systemId:groupName;value为ClientId集合
 
-	UserLock    sync.RWMutex
-	UserClients map[string][]string // 拥有同样业务端UserId的客户端连接
+	UserClients *ClientIndex // 拥有同样业务端UserId的客户端连接
 	// 用户当一个业务端用户在多个地方登陆时通知客户端
-	// key为业务端userId;value为ClientId列表
+	// key为业务端userId;value为ClientId集合
 
-	SystemClientsLock sync.RWMutex
-	SystemClients     map[string][]string // 所有系统的链接
-	// key为systemId;value为ClientId列表
+	SystemClients *ClientIndex // 所有系统的链接
+	// key为systemId;value为ClientId集合
+}
+
+// 还没有处理完的连接事件和后台发送的上下线通知,测试中重置配置之前等待完成
+var pending sync.WaitGroup
+
+//在后台发送通知,不阻塞连接的建立和断开
+func goNotify(send func()) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		send()
+	}()
 }
 
 func NewClientManager() (clientManager *ClientManager) {
@@ -39,9 +49,16 @@ func NewClientManager() (clientManager *ClientManager) {
 		ClientIdMap:   make(map[string]*Client),
 		Connect:       make(chan *Client, 10000),
 		DisConnect:    make(chan *Client, 10000),
-		Groups:        make(map[string][]string, 100),
-		UserClients:   make(map[string][]string, 100),
-		SystemClients: make(map[string][]string, 100),
+		Groups:        NewClientIndex(),
+		UserClients:   NewClientIndex(),
+		SystemClients: NewClientIndex(),
+	}
+	//本机有了分组的第一个成员或者没有成员时,通知其他节点
+	clientManager.Groups.onFirst = func(groupKey string) {
+		Groups.publish(groupKey, true)
+	}
+	clientManager.Groups.onEmpty = func(groupKey string) {
+		Groups.publish(groupKey, false)
 	}
 
 	return
@@ -54,16 +71,32 @@ func (manager *ClientManager) Start() {
 		case client := <-manager.Connect:
 			// 建立连接事件
 			manager.EventConnect(client)
+			pending.Done()
 		case conn := <-manager.DisConnect:
 			// 断开连接事件
 			manager.EventDisconnect(conn)
+			pending.Done()
 		}
 	}
 }
 
+// 通知管理者处理建立连接事件
+func (manager *ClientManager) connect(client *Client) {
+	pending.Add(1)
+	manager.Connect <- client
+}
+
+// 通知管理者处理断开连接事件
+func (manager *ClientManager) disconnect(client *Client) {
+	pending.Add(1)
+	manager.DisConnect <- client
+}
+
 // 建立连接事件
 func (manager *ClientManager) EventConnect(client *Client) {
 	manager.AddClient(client)
+	connectsTotal.With(client.SystemId, "false").Inc()
+	Webhooks.Emit(webhookEvent{Event: WebhookConnect, SystemId: client.SystemId, ClientId: client.ClientId, UserId: client.getUserId()})
 
 	log.WithFields(log.Fields{
 		"host":     setting.GlobalSetting.LocalHost,
@@ -75,30 +108,79 @@ func (manager *ClientManager) EventConnect(client *Client) {
 
 // 断开连接时间
 func (manager *ClientManager) EventDisconnect(client *Client) {
+	//会话已经被新的连接恢复,忽略旧连接的断开事件
+	if current, err := manager.GetByClientId(client.ClientId); err == nil && current != client {
+		_ = client.Socket.Close()
+		return
+	}
+
+	//保留会话等待客户端重连,期间不发送下线通知
+	if suspendClient(client) {
+		return
+	}
+
+	//挂起过的连接在挂起时已经计数,重复的断开事件不计数
+	if !client.IsDeleted && atomic.LoadInt32(&client.state) != clientStateExpired {
+		recordDisconnect(client)
+	}
+
 	//关闭连接
 	_ = client.Socket.Close()
+	client.close()
 	manager.DelClient(client)
 
+	userId, extend := client.getUser()
+	groupList := client.getGroups()
+	Webhooks.Emit(webhookEvent{
+		Event:    WebhookDisconnect,
+		SystemId: client.SystemId,
+		ClientId: client.ClientId,
+		UserId:   userId,
+		Duration: uint64(time.Now().Unix()) - client.ConnectTime,
+		Reason:   client.disconnectReason,
+	})
+
+	//记录用户最后在线的时间
+	if len(userId) > 0 {
+		Presence.seen(client.SystemId, userId, time.Now().Unix())
+	}
+
+	//记录断开的客户端所属的用户,发送给该客户端的消息可以保存为离线消息
+	if OfflineStore != nil && len(userId) > 0 {
+		recentClients.Store(client.ClientId, recentClient{
+			SystemId: client.SystemId,
+			UserId:   userId,
+			Time:     time.Now().Unix(),
+		})
+	}
+
 	mJson, _ := json.Marshal(map[string]string{
 		"systemId":  client.SystemId,
-		"groupName": strings.Join(client.GroupList, ","),
+		"groupName": strings.Join(groupList, ","),
 		"clientId":  client.ClientId,
-		"userId":    client.UserId,
-		"extend":    client.Extend,
+		"userId":    userId,
+		"extend":    extend,
 	})
 	data := string(mJson)
+	//后台发送通知时client已经被置空
+	clientId, systemId := client.ClientId, client.SystemId
 
 	//发送下线通知
 	//通知同UserId的客户端连接
-	if len(client.UserId) > 0 {
+	if len(userId) > 0 {
 		//默认通知所有当前用户登录的客户端，不区分system和group
-		SendMessage2User("", client.ClientId, "", client.UserId, retcode.OffLineMsgCode, "客户端下线", &data)
+		goNotify(func() {
+			SendMessage2User("", clientId, "", userId, retcode.OffLineMsgCode, "客户端下线", &data)
+		})
 	}
 
 	//通知同组的客户端连接
-	if client.Notify && len(client.GroupList) > 0 {
-		for _, groupName := range client.GroupList {
-			SendMessage2Group(client.SystemId, client.ClientId, groupName, retcode.OffLineMsgCode, "客户端下线", &data)
+	if client.Notify && len(groupList) > 0 {
+		for _, groupName := range groupList {
+			groupName := groupName
+			goNotify(func() {
+				SendMessage2Group(systemId, clientId, groupName, retcode.OffLineMsgCode, "客户端下线", &data)
+			})
 		}
 	}
 
@@ -123,12 +205,16 @@ func (manager *ClientManager) AddClient(client *Client) {
 	manager.ClientIdMap[client.ClientId] = client
 }
 
-// 获取所有的客户端
+// 获取所有客户端的快照,遍历期间不受连接和断开的影响
 func (manager *ClientManager) AllClient() map[string]*Client {
 	manager.ClientIdMapLock.RLock()
 	defer manager.ClientIdMapLock.RUnlock()
 
-	return manager.ClientIdMap
+	clients := make(map[string]*Client, len(manager.ClientIdMap))
+	for clientId, client := range manager.ClientIdMap {
+		clients[clientId] = client
+	}
+	return clients
 }
 
 // 客户端数量
@@ -143,13 +229,15 @@ func (manager *ClientManager) DelClient(client *Client) {
 	manager.delClientIdMap(client.ClientId)
 
 	//删除用户自己列表
-	if len(client.UserId) > 0 {
-		manager.delUserClient(client.UserId, client.ClientId)
+	if userId := client.getUserId(); len(userId) > 0 && manager.delUserClient(userId, client.ClientId) {
+		Subscriptions.localChanged(client.SystemId, userId, -1)
 	}
+	//取消该客户端的订阅
+	Subscriptions.Unsubscribe(client, nil)
 
 	//删除所在的分组
-	if len(client.GroupList) > 0 {
-		for _, groupName := range client.GroupList {
+	if groupList := client.getGroups(); len(groupList) > 0 {
+		for _, groupName := range groupList {
 			manager.delGroupClient(util.GenGroupKey(client.SystemId, groupName), client.ClientId)
 		}
 	}
@@ -182,13 +270,15 @@ func (manager *ClientManager) SendMessage2LocalGroup(systemId, messageId, sendUs
 	if len(groupName) > 0 {
 		clientIds := manager.GetGroupClientList(util.GenGroupKey(systemId, groupName))
 		if len(clientIds) > 0 {
+			//所有成员共享同一个编码后的消息
+			prepared := prepareMessage(messageId, sendUserId, code, msg, data)
 			for _, clientId := range clientIds {
 				if len(sendUserId) > 0 && sendUserId == clientId {
 					continue
 				}
 				if _, err := Manager.GetByClientId(clientId); err == nil {
 					//添加到本地
-					SendMessage2LocalClient(messageId, clientId, sendUserId, code, msg, data)
+					send2LocalClient(clientInfo{ClientId: clientId, MessageId: messageId, SendUserId: sendUserId, Code: code, Msg: msg, Data: data, prepared: prepared})
 				} else {
 					//如果客户端连接已经不存在了,则从group中删除
 					manager.delGroupClient(util.GenGroupKey(systemId, groupName), clientId)
@@ -198,18 +288,14 @@ func (manager *ClientManager) SendMessage2LocalGroup(systemId, messageId, sendUs
 	}
 }
 
-// 发送到本机对应的userId
-func (manager *ClientManager) SendMessage2LocalUserId(systemId, messageId, sendUserId, groupName, userId string, code int, msg string, data *string) {
+// 发送到本机对应的userId,返回该用户在本机的有效连接数
+func (manager *ClientManager) SendMessage2LocalUserId(systemId, messageId, sendUserId, groupName, userId string, code int, msg string, data *string) (online int) {
 	if len(userId) > 0 {
 		userClients := manager.GetUserClients(userId)
 		if len(userClients) > 0 {
 			//log.Infof("SendMessage2LocalUserId userClients [ %d ]", len(userClients))
 			for _, clientId := range userClients {
 				//log.Infof("SendMessage2LocalUserId clientId [ %s ]", clientId)
-				if len(sendUserId) > 0 && sendUserId == clientId {
-					continue //是自己,不发消息给自己
-				}
-
 				var client *Client
 				var err error
 				if client, err = manager.GetByClientId(clientId); err != nil {
@@ -225,17 +311,16 @@ func (manager *ClientManager) SendMessage2LocalUserId(systemId, messageId, sendU
 					continue //跳过,判断下一个连接
 				}
 				//log.Infof("SendMessage2LocalUserId systemId [ %s ]", systemId)
+				online++
+
+				if len(sendUserId) > 0 && sendUserId == clientId {
+					continue //是自己,不发消息给自己
+				}
 
 				send := true
 				if len(groupName) > 0 {
 					//log.Infof("SendMessage2LocalUserId groupName [ %s ]", groupName)
-					send = false
-					groupList := client.GroupList
-					for _, myGroup := range groupList {
-						if groupName == myGroup {
-							send = true
-						}
-					}
+					send = client.inGroup(groupName)
 				}
 
 				//log.Infof("SendMessage2LocalUserId messageId [ %s ]", messageId)
@@ -245,6 +330,7 @@ func (manager *ClientManager) SendMessage2LocalUserId(systemId, messageId, sendU
 			}
 		}
 	}
+	return
 }
 
 //发送给指定业务系统
@@ -252,8 +338,9 @@ func (manager *ClientManager) SendMessage2LocalSystem(systemId, messageId string
 	if len(systemId) > 0 {
 		clientIds := Manager.GetSystemClientList(systemId)
 		if len(clientIds) > 0 {
+			prepared := prepareMessage(messageId, sendUserId, code, msg, data)
 			for _, clientId := range clientIds {
-				SendMessage2LocalClient(messageId, clientId, sendUserId, code, msg, data)
+				send2LocalClient(clientInfo{ClientId: clientId, MessageId: messageId, SendUserId: sendUserId, Code: code, Msg: msg, Data: data, prepared: prepared})
 			}
 		}
 	}
@@ -261,15 +348,15 @@ func (manager *ClientManager) SendMessage2LocalSystem(systemId, messageId string
 
 // 添加到本地分组
 func (manager *ClientManager) AddClient2LocalGroup(groupName string, client *Client, userId string, extend string) {
-	//标记当前客户端的userId
-	client.UserId = userId
-	client.Extend = extend
+	//标记当前客户端的userId,更换了userId时从原来用户的列表中删除
+	oldUserId := client.setUser(userId, extend)
+	if len(oldUserId) > 0 && oldUserId != userId && manager.delUserClient(oldUserId, client.ClientId) {
+		Subscriptions.localChanged(client.SystemId, oldUserId, -1)
+	}
 
 	//判断之前是否有添加过
-	for _, groupValue := range client.GroupList {
-		if groupValue == groupName {
-			return
-		}
+	if client.inGroup(groupName) {
+		return
 	}
 
 	// 为属性添加分组信息
@@ -277,7 +364,10 @@ func (manager *ClientManager) AddClient2LocalGroup(groupName string, client *Cli
 
 	manager.addClient2Group(groupKey, client)
 
-	client.GroupList = append(client.GroupList, groupName)
+	if !client.addGroup(groupName) {
+		return //同时有其他调用加入了该分组
+	}
+	Webhooks.Emit(webhookEvent{Event: WebhookBind, SystemId: client.SystemId, ClientId: client.ClientId, UserId: userId, GroupName: groupName})
 
 	if len(userId) > 0 {
 		//log.Info("ClientManager AddClient2LocalGroup userId:[%s], group:[%s], clientId:[%s]", userId, groupName, client.ClientId)
@@ -288,96 +378,111 @@ func (manager *ClientManager) AddClient2LocalGroup(groupName string, client *Cli
 		"systemId":  client.SystemId,
 		"groupName": groupName,
 		"clientId":  client.ClientId,
-		"userId":    client.UserId,
-		"extend":    client.Extend,
+		"userId":    userId,
+		"extend":    extend,
 	})
 	data := string(mJson)
 
 	if client.Notify {
 		//发送系统通知
-		SendMessage2Group(client.SystemId, client.ClientId, groupName, retcode.OnLineMsgCode, "客户端上线", &data)
+		goNotify(func() {
+			SendMessage2Group(client.SystemId, client.ClientId, groupName, retcode.OnLineMsgCode, "客户端上线", &data)
+		})
 	}
 }
 
 // 添加到本地分组
 func (manager *ClientManager) addClient2Group(groupKey string, client *Client) {
-	manager.GroupLock.Lock()
-	defer manager.GroupLock.Unlock()
-	manager.Groups[groupKey] = append(manager.Groups[groupKey], client.ClientId)
+	manager.Groups.Add(groupKey, client.ClientId)
 }
 
-// 删除分组里的客户端
-func (manager *ClientManager) delGroupClient(groupKey string, clientId string) {
-	manager.GroupLock.Lock()
-	defer manager.GroupLock.Unlock()
+// 从本地分组中删除客户端,客户端不在该分组中时返回false
+// 用户列表按连接维护,离开分组后仍然可以通过userId找到该连接
+func (manager *ClientManager) DelClientFromLocalGroup(groupName string, client *Client) bool {
+	if !client.removeGroup(groupName) {
+		return false
+	}
+
+	manager.delGroupClient(util.GenGroupKey(client.SystemId, groupName), client.ClientId)
+	Webhooks.Emit(webhookEvent{Event: WebhookUnbind, SystemId: client.SystemId, ClientId: client.ClientId, UserId: client.getUserId(), GroupName: groupName})
+	return true
+}
 
-	for index, groupClientId := range manager.Groups[groupKey] {
-		if groupClientId == clientId {
-			manager.Groups[groupKey] = append(manager.Groups[groupKey][:index], manager.Groups[groupKey][index+1:]...)
+// 解散本地分组,返回被移出分组的客户端
+func (manager *ClientManager) DissolveLocalGroup(systemId, groupName string) (clients []*Client) {
+	groupKey := util.GenGroupKey(systemId, groupName)
+	for _, clientId := range manager.GetGroupClientList(groupKey) {
+		client, err := manager.GetByClientId(clientId)
+		if err != nil {
+			//客户端连接已经不存在了,直接从分组中删除
+			manager.delGroupClient(groupKey, clientId)
+			continue
+		}
+		if manager.DelClientFromLocalGroup(groupName, client) {
+			clients = append(clients, client)
+		} else {
+			manager.delGroupClient(groupKey, clientId)
 		}
 	}
+	return
 }
 
-// 获取本地分组的成员
+// 删除分组里的客户端
+func (manager *ClientManager) delGroupClient(groupKey string, clientId string) {
+	manager.Groups.Remove(groupKey, clientId)
+}
+
+// 获取本地分组成员的快照,顺序不固定
 func (manager *ClientManager) GetGroupClientList(groupKey string) []string {
-	manager.GroupLock.RLock()
-	defer manager.GroupLock.RUnlock()
-	return manager.Groups[groupKey]
+	return manager.Groups.Members(groupKey)
 }
 
 // 添加到用户客户端连接列表
 func (manager *ClientManager) AddClient2UserClients(userId, groupName string, client *Client) {
-	manager.UserLock.Lock()
-	defer manager.UserLock.Unlock()
-
 	if len(userId) == 0 {
 		return
 	}
 
-	//判断之前是否有添加过
-	for _, clientId := range manager.UserClients[userId] {
-		if clientId == client.ClientId {
-			return
-		}
+	if manager.UserClients.Has(userId, client.ClientId) {
+		return
 	}
+	//先投递该用户的离线消息再加入用户列表,之后发送给该用户的消息排在离线消息后面
+	replayOfflineMessages(client, userId)
 
-	manager.UserClients[userId] = append(manager.UserClients[userId], client.ClientId)
+	//通知在锁外发送,单机模式下发送用户消息时需要读取用户列表
+	if !manager.addUserClient(userId, client.ClientId) {
+		return
+	}
+	Subscriptions.localChanged(client.SystemId, userId, 1)
 
+	_, extend := client.getUser()
 	mJson, _ := json.Marshal(map[string]string{
 		"systemId":  client.SystemId,
 		"groupName": groupName,
 		"clientId":  client.ClientId,
 		"userId":    userId,
-		"extend":    client.Extend,
+		"extend":    extend,
 	})
 	data := string(mJson)
 	//默认通知所有当前用户登录的客户端，不区分system和group
-	SendMessage2User("", client.ClientId, "", userId, retcode.MultiSignOnCode, "在另外一个客户端登录", &data)
+	goNotify(func() {
+		SendMessage2User("", client.ClientId, "", userId, retcode.MultiSignOnCode, "在另外一个客户端登录", &data)
+	})
 }
 
-// 删除用户列表里的客户端连接
-func (manager *ClientManager) delUserClient(userId string, clientId string) {
-	manager.UserLock.Lock()
-	defer manager.UserLock.Unlock()
+// 添加到用户客户端连接列表,之前已经添加过则返回false
+func (manager *ClientManager) addUserClient(userId, clientId string) bool {
+	return manager.UserClients.Add(userId, clientId)
+}
 
-	userClients := manager.UserClients[userId]
-	//只有一个并且就是要删除的这个连接
-	if len(userClients) == 1 && clientId == userClients[0] {
-		delete(manager.UserClients, userId)
-	} else {
-		for index, userClientId := range userClients {
-			if userClientId == clientId {
-				manager.UserClients[userId] = append(userClients[:index], userClients[index+1:]...)
-			}
-		}
-	}
+// 删除用户列表里的客户端连接,列表中没有该连接则返回false
+func (manager *ClientManager) delUserClient(userId string, clientId string) bool {
+	return manager.UserClients.Remove(userId, clientId)
 }
 
-// 获取本地用户列表里的客户端连接clientId
+// 获取本地用户列表里客户端连接clientId的快照
 func (manager *ClientManager) GetUserClients(userId string) []string {
-	manager.UserLock.RLock()
-	defer manager.UserLock.RUnlock()
-	return manager.UserClients[userId]
+	return manager.UserClients.Members(userId)
 }
 
 // 获取本地用户列表里的客户端连接,返回内容格式为:[systemId:groupName:clientId]
@@ -399,14 +504,14 @@ func (manager *ClientManager) GetSystemGroupUserClients(systemId, groupName, use
 			continue //跳过,判断下一个连接
 		}
 
-		groupList := client.GroupList
+		groupList := client.getGroups()
 		if len(groupList) == 0 {
 			if len(groupName) > 0 {
 				continue //跳过,判断下一个组
 			}
 			userClients = append(userClients, util.GenUserClientKey(systemId, "", userClientId))
 		} else {
-			for _, myGroup := range client.GroupList {
+			for _, myGroup := range groupList {
 				if len(groupName) > 0 && groupName != myGroup {
 					continue //跳过,判断下一个组
 				}
@@ -418,28 +523,29 @@ func (manager *ClientManager) GetSystemGroupUserClients(systemId, groupName, use
 	return userClients
 }
 
-// 添加到系统客户端列表
-func (manager *ClientManager) AddClient2SystemClient(systemId string, client *Client) {
-	manager.SystemClientsLock.Lock()
-	defer manager.SystemClientsLock.Unlock()
-	manager.SystemClients[systemId] = append(manager.SystemClients[systemId], client.ClientId)
+// 添加到系统客户端列表,本机该系统的连接数达到limit时返回false,limit<=0时不限制
+func (manager *ClientManager) AddClient2SystemClient(systemId string, client *Client, limit int) bool {
+	return manager.SystemClients.AddLimit(systemId, client.ClientId, limit)
 }
 
 // 删除系统里的客户端
 func (manager *ClientManager) delSystemClient(client *Client) {
-	manager.SystemClientsLock.Lock()
-	defer manager.SystemClientsLock.Unlock()
-
-	for index, clientId := range manager.SystemClients[client.SystemId] {
-		if clientId == client.ClientId {
-			manager.SystemClients[client.SystemId] = append(manager.SystemClients[client.SystemId][:index], manager.SystemClients[client.SystemId][index+1:]...)
-		}
-	}
+	manager.SystemClients.Remove(client.SystemId, client.ClientId)
 }
 
-// 获取指定系统的客户端列表
+// 获取指定系统客户端列表的快照
 func (manager *ClientManager) GetSystemClientList(systemId string) []string {
-	manager.SystemClientsLock.RLock()
-	defer manager.SystemClientsLock.RUnlock()
-	return manager.SystemClients[systemId]
+	return manager.SystemClients.Members(systemId)
+}
+
+// 统计各系统的连接数,systemId为空时统计所有系统
+func (manager *ClientManager) CountSystemClients(systemId string) map[string]int {
+	if len(systemId) > 0 {
+		counts := make(map[string]int)
+		if count := manager.SystemClients.Count(systemId); count > 0 {
+			counts[systemId] = count
+		}
+		return counts
+	}
+	return manager.SystemClients.Counts()
 }
@@ -3,7 +3,6 @@ package servers
 import (
 	"github.com/gorilla/websocket"
 	. "github.com/smartystreets/goconvey/convey"
-	"github.com/woodylan/go-websocket/pkg/setting"
 	"github.com/woodylan/go-websocket/tools/util"
 	"testing"
 )
@@ -13,7 +12,7 @@ func TestAddClient(t *testing.T) {
 	systemId := "publishSystem"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 
 	manager.AddClient(clientSocket)
 
@@ -34,7 +33,7 @@ func TestDelClient(t *testing.T) {
 	systemId := "publishSystem"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 	manager.AddClient(clientSocket)
 
 	manager.DelClient(clientSocket)
@@ -56,7 +55,7 @@ func TestCount(t *testing.T) {
 	systemId := "publishSystem"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 
 	Convey("测试获取客户端数量", t, func() {
 		Convey("添加一个客户端后", func() {
@@ -77,12 +76,31 @@ func TestCount(t *testing.T) {
 	})
 }
 
+func TestAllClient(t *testing.T) {
+	var manager = NewClientManager() // 管理者
+	conn := &websocket.Conn{}
+	first := NewClient("firstClientId", "publishSystem", false, conn)
+	manager.AddClient(first)
+
+	Convey("测试获取所有客户端的快照", t, func() {
+		clients := manager.AllClient()
+		So(clients, ShouldHaveLength, 1)
+
+		//快照不随连接变化
+		manager.AddClient(NewClient("secondClientId", "publishSystem", false, conn))
+		manager.DelClient(first)
+		So(clients, ShouldHaveLength, 1)
+		So(clients["firstClientId"], ShouldEqual, first)
+		So(manager.Count(), ShouldEqual, 1)
+	})
+}
+
 func TestGetByClientId(t *testing.T) {
 	clientId := "clientId"
 	systemId := "publishSystem"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 
 	Convey("测试通过clientId获取客户端", t, func() {
 		Convey("获取一个存在的clientId", func() {
@@ -99,25 +117,25 @@ func TestGetByClientId(t *testing.T) {
 }
 
 func TestAddClient2LocalGroup(t *testing.T) {
-	setting.Default()
+	resetSetting()
 	clientId := "clientId"
 	systemId := "publishSystem"
 	userId := "userId"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 	manager.AddClient(clientSocket)
 	groupName := "testGroup"
 
 	Convey("测试添加分组", t, func() {
 		Convey("添加一个客户端到分组", func() {
 			manager.AddClient2LocalGroup(groupName, clientSocket, userId, "")
-			So(len(manager.Groups[util.GenGroupKey(systemId, groupName)]), ShouldEqual, 1)
+			So(manager.Groups.Count(util.GenGroupKey(systemId, groupName)), ShouldEqual, 1)
 		})
 
 		Convey("再添加一个客户端到分组", func() {
 			manager.AddClient2LocalGroup(groupName, clientSocket, userId, "")
-			So(len(manager.Groups[util.GenGroupKey(systemId, groupName)]), ShouldEqual, 1)
+			So(manager.Groups.Count(util.GenGroupKey(systemId, groupName)), ShouldEqual, 1)
 		})
 	})
 }
@@ -128,7 +146,7 @@ func TestGetGroupClientList(t *testing.T) {
 	userId := "userId"
 	var manager = NewClientManager() // 管理者
 	conn := &websocket.Conn{}
-	clientSocket := NewClient(clientId, systemId, conn)
+	clientSocket := NewClient(clientId, systemId, false, conn)
 	manager.AddClient(clientSocket)
 	groupName := "testGroup"
 
@@ -4,9 +4,7 @@ import (
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/woodylan/go-websocket/api"
-	"github.com/woodylan/go-websocket/define"
 	"github.com/woodylan/go-websocket/define/retcode"
-	"github.com/woodylan/go-websocket/pkg/etcd"
 	"github.com/woodylan/go-websocket/pkg/setting"
 	"github.com/woodylan/go-websocket/tools/util"
 	"net/http"
@@ -17,16 +15,45 @@ type Controller struct {
 }
 
 type renderData struct {
-	ClientId string `json:"clientId"`
+	ClientId    string `json:"clientId"`
+	ResumeToken string `json:"resumeToken,omitempty"` // 断线重连时传入resumeToken可以恢复会话
+	Resumed     bool   `json:"resumed,omitempty"`     // 是否恢复了之前的会话
 }
 
 func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 	//解析参数
 	systemId := r.FormValue("systemId")
+	userId := r.FormValue("userId")
+	extend := r.FormValue("extend")
+	groupName := r.FormValue("groupName")
+
+	//服务器正在关闭,不再接受新的连接,客户端应连接其他服务器
+	if IsDraining() {
+		api.RenderStatus(w, http.StatusServiceUnavailable, retcode.DrainingErrCode, "服务器正在关闭", []string{})
+		return
+	}
+
+	//校验连接凭证,校验失败时不升级连接,直接返回401
+	claims, ok := authorize(w, r, systemId)
+	if !ok {
+		return
+	}
+
+	//使用连接凭证中的身份,忽略请求参数中的userId和extend
+	if claims != nil {
+		userId = claims.UserId
+		extend = claims.Extend
+		if len(groupName) > 0 && !claims.allowGroup(groupName) {
+			api.RenderStatus(w, http.StatusUnauthorized, retcode.TokenErrCode, "连接凭证不允许加入该分组", []string{})
+			return
+		}
+	}
 
 	conn, err := (&websocket.Upgrader{
 		ReadBufferSize:  setting.CommonSetting.ReadBuffer,
 		WriteBufferSize: setting.CommonSetting.WriteBuffer,
+		//开启压缩时广播的消息只压缩一次
+		EnableCompression: setting.CommonSetting.Compression,
 		// 允许所有CORS跨域请求
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -45,66 +72,130 @@ func (c *Controller) Run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//判断系统是否被注册
-	if util.IsCluster() {
-		resp, err := etcd.Get(define.ETcdPrefixAccountInfo + systemId)
-		if err != nil {
-			api.ConnRenderMsg(conn, retcode.ETcdErrCode, "etcd服务器错误", []string{})
-			_ = conn.Close()
-			return
-		}
+	//判断系统是否被注册以及是否停用
+	switch err := CheckSystem(systemId); err {
+	case nil:
+	case ErrSystemNotRegistered:
+		api.ConnRenderMsg(conn, retcode.ETcdErrCode, "系统ID未注册", []string{})
+		_ = conn.Close()
+		return
+	case ErrSystemSuspended:
+		api.ConnRenderMsg(conn, retcode.SuspendedErrCode, "系统已停用", []string{})
+		_ = conn.Close()
+		return
+	default:
+		api.ConnRenderMsg(conn, retcode.ETcdErrCode, "etcd服务器错误", []string{})
+		_ = conn.Close()
+		return
+	}
 
-		if resp.Count == 0 {
-			api.ConnRenderMsg(conn, retcode.ETcdErrCode, "系统ID未注册", []string{})
-			_ = conn.Close()
-			return
-		}
-	} else {
-		if _, ok := SystemMap.Load(systemId); !ok {
-			api.ConnRenderMsg(conn, retcode.ETcdErrCode, "系统ID未注册", []string{})
-			_ = conn.Close()
+	policy := getSystemPolicy(systemId)
+
+	//设置读取消息大小上线,系统未配置时使用全局配置
+	conn.SetReadLimit(policy.messageSize())
+
+	//断线重连,恢复之前的clientId、分组和未发送的消息
+	if resumeToken := r.FormValue("resumeToken"); len(resumeToken) > 0 {
+		if clientSocket := Manager.ResumeClient(resumeToken, systemId, userId, claims != nil, conn); clientSocket != nil {
+			connectsTotal.With(systemId, "true").Inc()
+			clientSocket.Read()
+
+			if err = api.ConnRender(conn, renderData{ClientId: clientSocket.ClientId, ResumeToken: clientSocket.resumeToken, Resumed: true}); err != nil {
+				_ = conn.Close()
+				return
+			}
+
+			clientSocket.Write()
 			return
 		}
 	}
 
-	//设置读取消息大小上线
-	conn.SetReadLimit(setting.CommonSetting.MaxMessageSize)
-
 	clientId := util.GenClientId()
 
-	//上线、下线时是否通知相同GroupName中的其他客户端连接,开启则上线、下线时会通知同组的所有客户端
-	notify := false
-	if "true" == strings.ToLower(r.FormValue("notify")) {
-		notify = true
+	//上线、下线时是否通知相同GroupName中的其他客户端连接,开启则上线、下线时会通知同组的所有客户端,未传时使用系统的默认配置
+	notify := policy.Notify
+	if notifyParam := r.FormValue("notify"); len(notifyParam) > 0 {
+		notify = "true" == strings.ToLower(notifyParam)
 	}
 
 	clientSocket := NewClient(clientId, systemId, notify, conn)
+	clientSocket.resumeToken = genResumeToken(clientId)
+	if claims != nil {
+		clientSocket.authorized = true
+		clientSocket.allowedGroups = claims.Groups
+	}
+
+	//恢复会话不占用新的连接数,检查和占用连接数是原子的,并发连接不会超过上限
+	//连接数只统计本机,集群中的总连接数最多为节点数乘以MaxConnections
+	if !Manager.AddClient2SystemClient(systemId, clientSocket, policy.MaxConnections) {
+		api.ConnRenderMsg(conn, retcode.QuotaErrCode, ErrTooManyConnections.Error(), []string{})
+		_ = conn.Close()
+		return
+	}
+
+	//读取客户端消息
+	clientSocket.Read()
 
-	Manager.AddClient2SystemClient(systemId, clientSocket)
+	if err = api.ConnRender(conn, renderData{ClientId: clientId, ResumeToken: clientSocket.resumeToken}); err != nil {
+		//客户端还没有加入ClientIdMap,断开时不会清理,这里释放占用的连接数
+		Manager.delSystemClient(clientSocket)
+		_ = conn.Close()
+		return
+	}
 
+	//握手响应之后再启动写协程,避免并发写连接
+	clientSocket.Write()
+
+	//写协程启动之后再绑定分组和用户,投递的离线消息由写协程及时取出,减少发送队列已满的情况
 	//如果有groupName参数,则连接成功之后直接将客户端绑定到对应的组
-	groupName := r.FormValue("groupName")
 	if len(groupName) > 0 {
-		userId := r.FormValue("userId")
-		extend := r.FormValue("extend")
 		Manager.AddClient2LocalGroup(groupName, clientSocket, userId, extend)
 	}
 
 	//如果有userId参数
-	userId := r.FormValue("userId")
 	if len(userId) > 0 {
 		//log.Info("connect Run AddClient2UserClients userId:[%s], group:[%s], clientId:[%s]", userId, groupName, clientId)
+		clientSocket.setUser(userId, extend)
 		Manager.AddClient2UserClients(userId, groupName, clientSocket)
 	}
 
-	//读取客户端消息
-	clientSocket.Read()
+	// 用户连接事件
+	Manager.connect(clientSocket)
+}
 
-	if err = api.ConnRender(conn, renderData{ClientId: clientId}); err != nil {
-		_ = conn.Close()
-		return
+//校验连接凭证,未携带凭证且系统不要求凭证时返回nil
+func authorize(w http.ResponseWriter, r *http.Request, systemId string) (*connectClaims, bool) {
+	account, err := getAccountInfo(systemId)
+	switch err {
+	case nil:
+	case ErrSystemNotRegistered:
+		//系统ID是否有效在升级连接之后校验
+		return nil, true
+	default:
+		//无法读取账号时不知道系统是否要求凭证,拒绝连接
+		api.RenderStatus(w, http.StatusServiceUnavailable, retcode.ETcdErrCode, "etcd服务器错误", []string{})
+		return nil, false
 	}
 
-	// 用户连接事件
-	Manager.Connect <- clientSocket
+	token := getConnectToken(r)
+	if len(token) == 0 {
+		if account.RequireToken {
+			api.RenderStatus(w, http.StatusUnauthorized, retcode.TokenErrCode, "缺少连接凭证", []string{})
+			return nil, false
+		}
+		return nil, true
+	}
+
+	claims, err := parseConnectToken(account, token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"systemId": systemId,
+		}).Info("连接凭证校验失败: " + err.Error())
+		api.RenderStatus(w, http.StatusUnauthorized, retcode.TokenErrCode, "连接凭证无效", []string{})
+		return nil, false
+	}
+
+	return claims, true
 }
@@ -0,0 +1,124 @@
+package servers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"strings"
+)
+
+const (
+	// 不限制目标,只能发送给同一系统
+	TargetAny = "any"
+	// 只能发送给已加入的分组,以及已加入的分组中的客户端
+	TargetJoined = "joined"
+)
+
+//事件允许的目标,未配置时默认不限制,denyByDefault时默认只能发送给已加入的分组
+func (p SystemPolicy) eventTarget(event string) string {
+	for e, target := range p.EventTargets {
+		if strings.ToUpper(e) == event {
+			return target
+		}
+	}
+	if p.DenyByDefault {
+		return TargetJoined
+	}
+	return TargetAny
+}
+
+//校验客户端是否可以发送该事件到指定的目标,拒绝时记录审计日志
+func (c *Client) authorizeEvent(event string, msg *clientMsg, policy SystemPolicy) error {
+	err := c.checkEventTarget(event, msg, policy)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":           setting.GlobalSetting.LocalHost,
+			"port":           setting.CommonSetting.HttpPort,
+			"systemId":       c.SystemId,
+			"clientId":       c.ClientId,
+			"userId":         c.getUserId(),
+			"event":          event,
+			"targetSystemId": msg.SystemId,
+			"groupName":      msg.GroupName,
+			"targetUserId":   msg.UserId,
+			"clientIds":      msg.ClientIds,
+		}).Warn("拒绝客户端事件: " + err.Error())
+	}
+	return err
+}
+
+func (c *Client) checkEventTarget(event string, msg *clientMsg, policy SystemPolicy) error {
+	if !policy.allowEvent(event) {
+		return ErrEventNotAllowed
+	}
+
+	//客户端只能操作自己所在的系统
+	if len(msg.SystemId) > 0 && msg.SystemId != c.SystemId {
+		return ErrCrossSystem
+	}
+
+	//客户端只能把自己从分组中解绑,解绑其他客户端需要调用接口
+	if event == UnbindGroup {
+		for _, clientId := range msg.ClientIds {
+			if clientId != c.ClientId {
+				return ErrTargetNotAllowed
+			}
+		}
+	}
+
+	if policy.eventTarget(event) == TargetAny {
+		return nil
+	}
+
+	//绑定分组由连接凭证中的分组限制,关闭、确认、离开和查询分组、订阅只作用于自己,不校验目标
+	switch event {
+	case UnbindGroup, Dissolve:
+		//只能操作已加入的分组
+		if !c.inGroup(msg.GroupName) {
+			return ErrTargetNotAllowed
+		}
+	case Send2Client, Send2ClientS:
+		if !c.sharesGroup(msg.ClientIds) {
+			return ErrTargetNotAllowed
+		}
+	case Send2Group, Send2User:
+		//发送给用户时只发送到该分组中的连接,即只能发送给有共同分组的用户
+		if len(msg.ClientIds) > 0 {
+			if !c.sharesGroup(msg.ClientIds) {
+				return ErrTargetNotAllowed
+			}
+		} else if !c.inGroup(msg.GroupName) {
+			return ErrTargetNotAllowed
+		}
+	}
+	return nil
+}
+
+//目标客户端是否都和该客户端有共同的分组
+//本机的目标直接读取分组,其他节点的目标只查询所在的节点,不在读协程中遍历分组的集群成员
+func (c *Client) sharesGroup(clientIds []string) bool {
+	if len(clientIds) == 0 {
+		return true
+	}
+
+	groups := make(map[string]bool)
+	for _, group := range c.getGroups() {
+		groups[group] = true
+	}
+	if len(groups) == 0 {
+		return false
+	}
+
+	for _, clientId := range clientIds {
+		shared := false
+		for _, group := range GetClientGroupList(c.SystemId, clientId) {
+			if groups[group] {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			return false
+		}
+	}
+	return true
+}
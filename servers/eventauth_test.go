@@ -0,0 +1,101 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAuthorizeEvent(t *testing.T) {
+	resetSetting()
+	StartWebSocket()
+
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试客户端事件的授权", t, func() {
+		sender := NewClient("authSender", "authSystem", false, conn)
+		member := NewClient("authMember", "authSystem", false, conn)
+		other := NewClient("authOther", "authSystem", false, conn)
+		for _, client := range []*Client{sender, member, other} {
+			Manager.AddClient(client)
+		}
+		Manager.AddClient2LocalGroup("joined", sender, "", "")
+		Manager.AddClient2LocalGroup("joined", member, "", "")
+		Manager.AddClient2LocalGroup("other", other, "", "")
+
+		Convey("默认不限制目标", func() {
+			policy := SystemPolicy{}
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "other"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Send2Client, &clientMsg{ClientIds: []string{"authOther"}}, policy), ShouldBeNil)
+		})
+
+		Convey("不能操作其他系统", func() {
+			So(sender.authorizeEvent(Send2Group, &clientMsg{SystemId: "otherSystem", GroupName: "joined"}, SystemPolicy{}), ShouldEqual, ErrCrossSystem)
+			So(sender.authorizeEvent(Send2Group, &clientMsg{SystemId: "authSystem", GroupName: "joined"}, SystemPolicy{}), ShouldBeNil)
+		})
+
+		Convey("只能发送给已加入的分组", func() {
+			policy := SystemPolicy{EventTargets: map[string]string{"s2g": TargetJoined, "S2U": TargetJoined}}
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "joined"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "other"}, policy), ShouldEqual, ErrTargetNotAllowed)
+			So(sender.authorizeEvent(Send2User, &clientMsg{UserId: "user"}, policy), ShouldEqual, ErrTargetNotAllowed)
+			So(sender.authorizeEvent(Send2User, &clientMsg{UserId: "user", GroupName: "joined"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Send2Client, &clientMsg{ClientIds: []string{"authOther"}}, policy), ShouldBeNil)
+		})
+
+		Convey("只能发送给有共同分组的客户端", func() {
+			policy := SystemPolicy{EventTargets: map[string]string{Send2Client: TargetJoined}}
+			So(sender.authorizeEvent(Send2Client, &clientMsg{ClientIds: []string{"authMember"}}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Send2Client, &clientMsg{ClientIds: []string{"authMember", "authOther"}}, policy), ShouldEqual, ErrTargetNotAllowed)
+			//不存在的客户端没有分组
+			So(sender.authorizeEvent(Send2Client, &clientMsg{ClientIds: []string{"authMissing"}}, policy), ShouldEqual, ErrTargetNotAllowed)
+		})
+
+		Convey("只能解绑和解散已加入的分组", func() {
+			policy := SystemPolicy{
+				AllowedEvents: []string{UnbindGroup, Dissolve, LeaveGroup},
+				EventTargets:  map[string]string{UnbindGroup: TargetJoined, Dissolve: TargetJoined, LeaveGroup: TargetJoined},
+			}
+			So(sender.authorizeEvent(UnbindGroup, &clientMsg{GroupName: "joined"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(UnbindGroup, &clientMsg{GroupName: "other"}, policy), ShouldEqual, ErrTargetNotAllowed)
+			So(sender.authorizeEvent(Dissolve, &clientMsg{GroupName: "joined"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Dissolve, &clientMsg{GroupName: "other"}, policy), ShouldEqual, ErrTargetNotAllowed)
+			So(sender.authorizeEvent(LeaveGroup, &clientMsg{GroupName: "other"}, policy), ShouldBeNil)
+		})
+
+		Convey("只能解绑自己", func() {
+			policy := SystemPolicy{}
+			So(sender.authorizeEvent(UnbindGroup, &clientMsg{GroupName: "joined", ClientIds: []string{"authSender"}}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(UnbindGroup, &clientMsg{GroupName: "joined", ClientIds: []string{"authMember"}}, policy), ShouldEqual, ErrTargetNotAllowed)
+		})
+
+		Convey("默认不允许客户端解散分组", func() {
+			So(sender.authorizeEvent(Dissolve, &clientMsg{GroupName: "joined"}, SystemPolicy{}), ShouldEqual, ErrEventNotAllowed)
+		})
+
+		Convey("默认拒绝", func() {
+			policy := SystemPolicy{DenyByDefault: true}
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "joined"}, policy), ShouldEqual, ErrEventNotAllowed)
+			So(sender.authorizeEvent(Ack, &clientMsg{MessageId: "messageId"}, policy), ShouldBeNil)
+
+			policy.AllowedEvents = []string{Send2Group, Bind2Group}
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "joined"}, policy), ShouldBeNil)
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "other"}, policy), ShouldEqual, ErrTargetNotAllowed)
+			So(sender.authorizeEvent(Bind2Group, &clientMsg{GroupName: "other"}, policy), ShouldBeNil)
+
+			policy.EventTargets = map[string]string{Send2Group: TargetAny}
+			So(sender.authorizeEvent(Send2Group, &clientMsg{GroupName: "other"}, policy), ShouldBeNil)
+		})
+
+		Convey("校验事件目标的配置", func() {
+			So(SystemPolicy{EventTargets: map[string]string{Send2Group: "all"}}.validate(), ShouldNotBeNil)
+			So(SystemPolicy{EventTargets: map[string]string{Send2Group: TargetJoined}}.validate(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			for _, client := range []*Client{sender, member, other} {
+				Manager.DelClient(client)
+			}
+		})
+	})
+}
@@ -0,0 +1,177 @@
+package servers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+)
+
+//将客户端从分组中解绑
+func DelClientFromGroup(systemId, groupName, clientId string) {
+	if util.IsCluster() {
+		addr, _, _, isLocal, err := util.GetAddrInfoAndIsLocal(clientId)
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+
+		//如果是本机则从本机分组中删除
+		if isLocal {
+			delLocalClientFromGroup(systemId, groupName, clientId)
+		} else {
+			//发送到指定机器
+			_ = Cluster.UnbindGroup(addr, &pb.UnbindGroupReq{
+				SystemId:  systemId,
+				GroupName: groupName,
+				ClientId:  clientId,
+			})
+		}
+	} else {
+		//如果是单机服务，则只删除本机的
+		delLocalClientFromGroup(systemId, groupName, clientId)
+	}
+}
+
+//只能解绑同一系统的客户端
+func delLocalClientFromGroup(systemId, groupName, clientId string) {
+	client, err := Manager.GetByClientId(clientId)
+	if err != nil || client.SystemId != systemId {
+		return
+	}
+	if Manager.DelClientFromLocalGroup(groupName, client) {
+		notifyLeaveGroup(client, groupName)
+	}
+}
+
+//用户的所有连接离开分组,返回离开分组的连接数和各节点的调用结果
+func DelUserFromGroup(systemId, groupName, userId string) (count int, result BroadcastResult) {
+	if util.IsCluster() {
+		//用户的连接可能在任意节点上,发送到所有节点
+		count, result = Cluster.LeaveGroup(&pb.LeaveGroupReq{
+			SystemId:  systemId,
+			GroupName: groupName,
+			UserId:    userId,
+		})
+	} else {
+		//如果是单机服务，则只删除本机的
+		count = delLocalUserFromGroup(systemId, groupName, userId)
+		result = localResult()
+	}
+	return
+}
+
+//本机该用户的连接离开分组
+func delLocalUserFromGroup(systemId, groupName, userId string) (count int) {
+	if len(userId) == 0 {
+		return
+	}
+	for _, clientId := range Manager.GetUserClients(userId) {
+		client, err := Manager.GetByClientId(clientId)
+		if err != nil || client.SystemId != systemId {
+			continue
+		}
+		if Manager.DelClientFromLocalGroup(groupName, client) {
+			notifyLeaveGroup(client, groupName)
+			count++
+		}
+	}
+	return
+}
+
+//获取客户端加入的分组,客户端不存在时返回空列表
+func GetClientGroupList(systemId, clientId string) (groupList []string) {
+	if util.IsCluster() {
+		addr, _, _, isLocal, err := util.GetAddrInfoAndIsLocal(clientId)
+		if err != nil {
+			log.Errorf("%s", err)
+			return []string{}
+		}
+
+		//如果是本机则查询本机
+		if isLocal {
+			groupList = getLocalClientGroupList(systemId, clientId)
+		} else {
+			//查询指定机器
+			groupList = Cluster.GetClientGroups(addr, &pb.GetClientGroupsReq{
+				SystemId: systemId,
+				ClientId: clientId,
+			})
+		}
+	} else {
+		//如果是单机服务，则只查询本机
+		groupList = getLocalClientGroupList(systemId, clientId)
+	}
+
+	if groupList == nil {
+		groupList = []string{}
+	}
+	return
+}
+
+//只能查询同一系统的客户端
+func getLocalClientGroupList(systemId, clientId string) []string {
+	client, err := Manager.GetByClientId(clientId)
+	if err != nil || client.SystemId != systemId {
+		return []string{}
+	}
+	return client.getGroups()
+}
+
+//解散分组,将集群中该分组的所有成员移出,notify为true时通知被移出的客户端
+func DissolveGroup(systemId, sendUserId, groupName string, notify bool) (messageId string, count int, result BroadcastResult) {
+	messageId = util.GenUUID()
+	if util.IsCluster() {
+		//只发送到有该分组成员的节点
+		count, result = Cluster.DissolveGroup(&pb.DissolveGroupReq{
+			SystemId:   systemId,
+			MessageId:  messageId,
+			SendUserId: sendUserId,
+			GroupName:  groupName,
+			Notify:     notify,
+		})
+	} else {
+		//如果是单机服务，则只解散本机的
+		count = dissolveLocalGroup(systemId, messageId, sendUserId, groupName, notify)
+		result = localResult()
+	}
+	return
+}
+
+//解散本机分组,返回被移出的客户端数量
+func dissolveLocalGroup(systemId, messageId, sendUserId, groupName string, notify bool) int {
+	clients := Manager.DissolveLocalGroup(systemId, groupName)
+	if notify && len(clients) > 0 {
+		mJson, _ := json.Marshal(map[string]string{
+			"systemId":  systemId,
+			"groupName": groupName,
+		})
+		data := string(mJson)
+		for _, client := range clients {
+			if client.ClientId == sendUserId {
+				continue //是自己,不发消息给自己
+			}
+			SendMessage2LocalClient(messageId, client.ClientId, sendUserId, retcode.DissolveCode, "分组已解散", &data)
+		}
+	}
+	return len(clients)
+}
+
+//离开分组时通知同组的其他客户端,与加入分组时一样只在客户端开启通知时发送
+func notifyLeaveGroup(client *Client, groupName string) {
+	if !client.Notify {
+		return
+	}
+
+	userId, extend := client.getUser()
+	mJson, _ := json.Marshal(map[string]string{
+		"systemId":  client.SystemId,
+		"groupName": groupName,
+		"clientId":  client.ClientId,
+		"userId":    userId,
+		"extend":    extend,
+	})
+	data := string(mJson)
+	go SendMessage2Group(client.SystemId, client.ClientId, groupName, retcode.LeaveGroupCode, "客户端离开分组", &data)
+}
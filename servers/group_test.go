@@ -0,0 +1,88 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sort"
+	"testing"
+)
+
+func TestGroupManagement(t *testing.T) {
+	resetSetting()
+
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试分组管理", t, func() {
+		systemId := "groupSystem"
+		first := NewClient("groupFirst", systemId, false, conn)
+		second := NewClient("groupSecond", systemId, false, conn)
+		third := NewClient("groupThird", systemId, false, conn)
+		for _, client := range []*Client{first, second, third} {
+			Manager.AddClient(client)
+		}
+		Manager.AddClient2LocalGroup("room", first, "groupUser", "")
+		Manager.AddClient2LocalGroup("lobby", first, "groupUser", "")
+		Manager.AddClient2LocalGroup("room", second, "groupUser", "")
+		Manager.AddClient2LocalGroup("lobby", second, "groupUser", "")
+		Manager.AddClient2LocalGroup("room", third, "", "")
+
+		Convey("获取客户端加入的分组", func() {
+			So(GetClientGroupList(systemId, "groupFirst"), ShouldResemble, []string{"room", "lobby"})
+			So(GetClientGroupList("otherSystem", "groupFirst"), ShouldBeEmpty)
+			So(GetClientGroupList(systemId, "notExistId"), ShouldResemble, []string{})
+		})
+
+		Convey("解绑客户端", func() {
+			DelClientFromGroup("otherSystem", "room", "groupFirst")
+			So(first.GroupList, ShouldResemble, []string{"room", "lobby"})
+
+			DelClientFromGroup(systemId, "room", "groupFirst")
+			So(first.GroupList, ShouldResemble, []string{"lobby"})
+			//分组成员的顺序不固定
+			clientIds := Manager.GetGroupClientList(util.GenGroupKey(systemId, "room"))
+			sort.Strings(clientIds)
+			So(clientIds, ShouldResemble, []string{"groupSecond", "groupThird"})
+			//离开分组后仍然可以通过userId找到该连接
+			So(Manager.GetUserClients("groupUser"), ShouldContain, "groupFirst")
+		})
+
+		Convey("用户的所有连接离开分组", func() {
+			count, result := DelUserFromGroup(systemId, "lobby", "groupUser")
+			So(count, ShouldEqual, 2)
+			So(result.Reached, ShouldEqual, 1)
+			So(first.GroupList, ShouldResemble, []string{"room"})
+			So(second.GroupList, ShouldResemble, []string{"room"})
+			So(Manager.GetGroupClientList(util.GenGroupKey(systemId, "lobby")), ShouldBeEmpty)
+		})
+
+		Convey("解散分组", func() {
+			_, count, _ := DissolveGroup(systemId, "groupFirst", "room", true)
+			So(count, ShouldEqual, 3)
+			So(Manager.GetGroupClientList(util.GenGroupKey(systemId, "room")), ShouldBeEmpty)
+			So(first.GroupList, ShouldResemble, []string{"lobby"})
+			So(third.GroupList, ShouldBeEmpty)
+
+			//被移出的客户端收到解散通知,发起者不通知
+			notice := <-third.sendChan
+			So(notice.Code, ShouldEqual, retcode.DissolveCode)
+			for len(first.sendChan) > 0 {
+				So((<-first.sendChan).Code, ShouldNotEqual, retcode.DissolveCode)
+			}
+		})
+
+		Convey("更换userId时从原来用户的列表中删除", func() {
+			Manager.AddClient2LocalGroup("other", third, "groupUser", "")
+			Manager.AddClient2LocalGroup("another", third, "anotherUser", "")
+			So(Manager.GetUserClients("groupUser"), ShouldNotContain, "groupThird")
+			So(Manager.GetUserClients("anotherUser"), ShouldContain, "groupThird")
+		})
+
+		Reset(func() {
+			for _, client := range []*Client{first, second, third} {
+				Manager.DelClient(client)
+			}
+		})
+	})
+}
@@ -0,0 +1,264 @@
+package servers
+
+import (
+	"context"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/etcd"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 发布失败时的重试次数
+const groupPublishRetry = 3
+
+// 有更新丢失时,按该间隔把本机的分组全部重新发布一次
+var groupReconcileInterval = 30 * time.Second
+
+// 本机分组的成员数在0和非0之间变化
+type groupEvent struct {
+	groupKey string
+	add      bool
+}
+
+// 集群中每个分组的成员分布在哪些节点上,广播分组消息时只发送到这些节点
+type GroupIndex struct {
+	lock   sync.RWMutex
+	nodes  map[string]map[string]struct{} // groupKey -> 节点地址
+	ready  bool                           // 是否已经从etcd加载完成,未完成时广播到所有节点
+	events chan groupEvent
+	dirty  int32 // 队列已满或者写入etcd失败时置为1,等待重新发布
+}
+
+var Groups = NewGroupIndex()
+
+func NewGroupIndex() *GroupIndex {
+	return &GroupIndex{
+		nodes:  make(map[string]map[string]struct{}),
+		events: make(chan groupEvent, 10000),
+	}
+}
+
+// 本机的RPC地址,与注册到etcd的服务地址一致
+func localRPCAddr() string {
+	return net.JoinHostPort(setting.GlobalSetting.LocalHost, setting.CommonSetting.RPCPort)
+}
+
+func groupNodeKey(groupKey, addr string) string {
+	return define.ETcdPrefixGroupNodes + groupKey + "/" + addr
+}
+
+// 从etcd的key中解析出分组和节点地址,分组名中可能包含"/",节点地址中不会
+func parseGroupNodeKey(key string) (groupKey, addr string, ok bool) {
+	key = strings.TrimPrefix(key, define.ETcdPrefixGroupNodes)
+	index := strings.LastIndex(key, "/")
+	if index <= 0 || index == len(key)-1 {
+		return "", "", false
+	}
+	return key[:index], key[index+1:], true
+}
+
+// 获取有该分组成员的节点,索引不可用时返回false
+// 本机是否有成员以本机的连接为准,不等待本机的发布通过etcd监听返回;其他节点新加入的成员要等监听到之后才会出现在索引中
+func (g *GroupIndex) Nodes(groupKey string) ([]string, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if !g.ready {
+		return nil, false
+	}
+
+	local := localRPCAddr()
+	addrs := make([]string, 0, len(g.nodes[groupKey])+1)
+	for addr := range g.nodes[groupKey] {
+		if addr != local {
+			addrs = append(addrs, addr)
+		}
+	}
+	if Manager.Groups.Count(groupKey) > 0 {
+		addrs = append(addrs, local)
+	}
+	return addrs, true
+}
+
+// 本机分组成员数变化时发布到etcd,只在集群模式下生效
+func (g *GroupIndex) publish(groupKey string, add bool) {
+	if !util.IsCluster() {
+		return
+	}
+
+	select {
+	case g.events <- groupEvent{groupKey: groupKey, add: add}:
+	default:
+		atomic.StoreInt32(&g.dirty, 1)
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"groupKey": groupKey,
+		}).Error("分组索引更新队列已满")
+	}
+}
+
+func (g *GroupIndex) set(groupKey, addr string, add bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if add {
+		if _, ok := g.nodes[groupKey]; !ok {
+			g.nodes[groupKey] = make(map[string]struct{})
+		}
+		g.nodes[groupKey][addr] = struct{}{}
+		return
+	}
+
+	delete(g.nodes[groupKey], addr)
+	if len(g.nodes[groupKey]) == 0 {
+		delete(g.nodes, groupKey)
+	}
+}
+
+// 加载全部索引,返回加载时的版本号
+func (g *GroupIndex) load() (int64, error) {
+	resp, err := etcd.GetPrefix(define.ETcdPrefixGroupNodes)
+	if err != nil {
+		return 0, err
+	}
+
+	nodes := make(map[string]map[string]struct{})
+	for _, kv := range resp.Kvs {
+		if groupKey, addr, ok := parseGroupNodeKey(string(kv.Key)); ok {
+			if _, ok := nodes[groupKey]; !ok {
+				nodes[groupKey] = make(map[string]struct{})
+			}
+			nodes[groupKey][addr] = struct{}{}
+		}
+	}
+
+	g.lock.Lock()
+	g.nodes = nodes
+	g.ready = true
+	g.lock.Unlock()
+	return resp.Header.Revision, nil
+}
+
+// 监听索引变化,连接断开后重新加载
+func (g *GroupIndex) watch() {
+	for {
+		rev, err := g.load()
+		if err != nil {
+			log.Errorf("加载分组索引失败: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		for resp := range etcd.WatchPrefix(ctx, define.ETcdPrefixGroupNodes, rev+1) {
+			if resp.Err() != nil {
+				log.Errorf("监听分组索引失败: %v", resp.Err())
+				break
+			}
+			for _, ev := range resp.Events {
+				if groupKey, addr, ok := parseGroupNodeKey(string(ev.Kv.Key)); ok {
+					g.set(groupKey, addr, ev.Type == mvccpb.PUT)
+				}
+			}
+		}
+		cancel()
+
+		//重新加载期间广播到所有节点
+		g.lock.Lock()
+		g.ready = false
+		g.lock.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// 按顺序把本机的分组变化写入etcd,使用服务注册的租约,节点下线时自动删除
+func (g *GroupIndex) publisher(reg *etcd.ServiceReg) {
+	addr := localRPCAddr()
+	ticker := time.NewTicker(groupReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-g.events:
+			g.apply(reg, addr, event)
+		case <-ticker.C:
+			if atomic.CompareAndSwapInt32(&g.dirty, 1, 0) {
+				g.reconcile(reg, addr)
+			}
+		}
+	}
+}
+
+// 写入一次分组变化,重试之后仍然失败则等待重新发布
+func (g *GroupIndex) apply(reg *etcd.ServiceReg, addr string, event groupEvent) {
+	key := groupNodeKey(event.groupKey, addr)
+	var err error
+	for i := 0; i < groupPublishRetry; i++ {
+		if event.add {
+			err = reg.PutService(key, addr)
+		} else {
+			err = reg.DelService(key)
+		}
+		if err == nil {
+			return
+		}
+		time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&g.dirty, 1)
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"groupKey": event.groupKey,
+	}).Errorf("发布分组索引失败: %v", err)
+}
+
+// 对比本机的分组和etcd中本机发布的分组,补上缺少的,删除多余的
+func (g *GroupIndex) reconcile(reg *etcd.ServiceReg, addr string) {
+	resp, err := etcd.GetPrefix(define.ETcdPrefixGroupNodes)
+	if err != nil {
+		atomic.StoreInt32(&g.dirty, 1)
+		log.Errorf("重新发布分组索引失败: %v", err)
+		return
+	}
+
+	published := make(map[string]struct{})
+	for _, kv := range resp.Kvs {
+		if groupKey, nodeAddr, ok := parseGroupNodeKey(string(kv.Key)); ok && nodeAddr == addr {
+			published[groupKey] = struct{}{}
+		}
+	}
+
+	for _, event := range diffGroups(Manager.Groups.Counts(), published) {
+		g.apply(reg, addr, event)
+	}
+}
+
+// 本机有成员但没有发布的分组需要添加,已经发布但没有成员的需要删除
+func diffGroups(local map[string]int, published map[string]struct{}) []groupEvent {
+	events := make([]groupEvent, 0)
+	for groupKey := range local {
+		if _, ok := published[groupKey]; !ok {
+			events = append(events, groupEvent{groupKey: groupKey, add: true})
+		}
+	}
+	for groupKey := range published {
+		if _, ok := local[groupKey]; !ok {
+			events = append(events, groupEvent{groupKey: groupKey, add: false})
+		}
+	}
+	return events
+}
+
+// 启动索引的发布和监听
+func (g *GroupIndex) Start(reg *etcd.ServiceReg) {
+	go g.publisher(reg)
+	go g.watch()
+}
@@ -0,0 +1,118 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"testing"
+)
+
+func TestParseGroupNodeKey(t *testing.T) {
+	Convey("测试解析分组索引的key", t, func() {
+		groupKey, addr, ok := parseGroupNodeKey(groupNodeKey("system:group/name", "10.0.0.1:8061"))
+		So(ok, ShouldBeTrue)
+		So(groupKey, ShouldEqual, "system:group/name")
+		So(addr, ShouldEqual, "10.0.0.1:8061")
+
+		_, _, ok = parseGroupNodeKey(define.ETcdPrefixGroupNodes + "system:group")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestGroupIndex(t *testing.T) {
+	Convey("测试分组索引", t, func() {
+		index := NewGroupIndex()
+
+		Convey("未加载时不可用", func() {
+			_, ok := index.Nodes("system:group")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("节点加入和离开分组", func() {
+			index.ready = true
+			index.set("system:group", "10.0.0.1:8061", true)
+			index.set("system:group", "10.0.0.2:8061", true)
+			nodes, ok := index.Nodes("system:group")
+			So(ok, ShouldBeTrue)
+			So(len(nodes), ShouldEqual, 2)
+
+			index.set("system:group", "10.0.0.1:8061", false)
+			nodes, _ = index.Nodes("system:group")
+			So(nodes, ShouldResemble, []string{"10.0.0.2:8061"})
+
+			index.set("system:group", "10.0.0.2:8061", false)
+			nodes, ok = index.Nodes("system:group")
+			So(ok, ShouldBeTrue)
+			So(nodes, ShouldBeEmpty)
+		})
+
+		Convey("本机有成员时总是包含本机", func() {
+			index.ready = true
+			client := &Client{ClientId: "indexLocalClientId"}
+			Manager.addClient2Group("system:localGroup", client)
+			defer Manager.delGroupClient("system:localGroup", client.ClientId)
+
+			nodes, ok := index.Nodes("system:localGroup")
+			So(ok, ShouldBeTrue)
+			So(nodes, ShouldResemble, []string{localRPCAddr()})
+
+			//索引中已经有本机时不重复
+			index.set("system:localGroup", localRPCAddr(), true)
+			nodes, _ = index.Nodes("system:localGroup")
+			So(nodes, ShouldResemble, []string{localRPCAddr()})
+		})
+	})
+}
+
+func TestPublishGroupChange(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.Cluster = true
+	defer func() {
+		setting.CommonSetting.Cluster = false
+	}()
+
+	Convey("测试本机分组成员数变化时发布索引", t, func() {
+		manager := NewClientManager()
+		Groups = NewGroupIndex()
+		first := &Client{ClientId: "firstClientId"}
+		second := &Client{ClientId: "secondClientId"}
+
+		manager.addClient2Group("system:group", first)
+		manager.addClient2Group("system:group", second)
+		So(len(Groups.events), ShouldEqual, 1)
+		So(<-Groups.events, ShouldResemble, groupEvent{groupKey: "system:group", add: true})
+
+		manager.delGroupClient("system:group", first.ClientId)
+		So(len(Groups.events), ShouldEqual, 0)
+
+		manager.delGroupClient("system:group", second.ClientId)
+		So(<-Groups.events, ShouldResemble, groupEvent{groupKey: "system:group", add: false})
+	})
+}
+
+func TestGroupIndexReconcile(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.Cluster = true
+	defer func() {
+		setting.CommonSetting.Cluster = false
+	}()
+
+	Convey("测试分组索引丢失更新之后重新发布", t, func() {
+		Convey("队列已满时等待重新发布", func() {
+			index := &GroupIndex{events: make(chan groupEvent, 1)}
+			index.publish("system:first", true)
+			So(index.dirty, ShouldEqual, 0)
+			index.publish("system:second", true)
+			So(index.dirty, ShouldEqual, 1)
+		})
+
+		Convey("对比本机和已经发布的分组", func() {
+			local := map[string]int{"system:both": 1, "system:local": 2}
+			published := map[string]struct{}{"system:both": {}, "system:stale": {}}
+			events := diffGroups(local, published)
+			So(len(events), ShouldEqual, 2)
+			So(events, ShouldContain, groupEvent{groupKey: "system:local", add: true})
+			So(events, ShouldContain, groupEvent{groupKey: "system:stale", add: false})
+		})
+	})
+}
@@ -0,0 +1,220 @@
+package servers
+
+import (
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sort"
+)
+
+//流式发送和分页获取时每批成员的数量
+const memberChunkSize = 500
+
+// 在线列表中的成员
+type Member struct {
+	ClientId    string   `json:"clientId"`
+	UserId      string   `json:"userId"`
+	Extend      string   `json:"extend"`
+	ConnectTime uint64   `json:"connectTime"`
+	Node        string   `json:"node"`                // 连接所在节点的RPC地址
+	GroupList   []string `json:"groupList,omitempty"` // 连接加入的分组,只在查询用户时返回
+}
+
+// 在线列表的查询条件
+type MemberQuery struct {
+	SystemId  string
+	GroupName string
+	UserId    string // 不为空时查询该用户的连接,否则查询分组的成员
+	Cursor    string // 上一页返回的nextCursor,为空时从第一页开始
+	Limit     int    // 每页的数量,为0时不分页
+	Dedupe    bool   // 同一用户只返回最早建立的连接
+	CountOnly bool   // 只返回总数
+}
+
+// 在线列表的一页
+type MemberPage struct {
+	Count      int      `json:"count"` // 符合条件的成员总数,去重时为用户数
+	List       []Member `json:"list"`
+	NextCursor string   `json:"nextCursor"` // 下一页的游标,为空时没有下一页
+}
+
+//排序和分页使用的key,去重时同一用户的连接使用相同的key
+func (m Member) key(dedupe bool) string {
+	if !dedupe {
+		return m.ClientId
+	}
+	if len(m.UserId) > 0 {
+		return "u" + m.UserId
+	}
+	return "c" + m.ClientId
+}
+
+//获取在线列表,集群模式下汇总所有节点的成员
+func GetMembers(query MemberQuery) (page MemberPage) {
+	req := &pb.GetGroupMembersReq{
+		SystemId:  query.SystemId,
+		GroupName: query.GroupName,
+		UserId:    query.UserId,
+		Cursor:    query.Cursor,
+		Dedupe:    query.Dedupe,
+		CountOnly: query.CountOnly,
+	}
+	if query.Limit > 0 {
+		//多取一个用来判断是否还有下一页
+		req.Limit = int32(query.Limit + 1)
+	}
+
+	var members []Member
+	if util.IsCluster() {
+		if query.Limit == 0 && !query.CountOnly {
+			//不分页时分批获取各节点的所有成员,避免单个响应过大
+			req.Cursor = ""
+			members = sortMembers(Cluster.StreamGroupClients(req), query.Dedupe)
+			page.Count = len(members)
+			members = membersAfter(members, query.Cursor, query.Dedupe)
+		} else {
+			//每个节点最多返回一页,合并之后再取一页
+			members, page.Count = Cluster.GetGroupMembers(req)
+			members = sortMembers(members, query.Dedupe)
+		}
+	} else {
+		//如果是单机服务，则只查询本机
+		members, page.Count, _ = getLocalMembers(req)
+	}
+
+	if query.CountOnly {
+		page.List = []Member{}
+		return
+	}
+	if query.Limit > 0 && len(members) > query.Limit {
+		members = members[:query.Limit]
+		page.NextCursor = members[len(members)-1].key(query.Dedupe)
+	}
+	if members == nil {
+		members = []Member{}
+	}
+	page.List = members
+	return
+}
+
+//本机符合条件的成员,返回游标之后的一页、总数,以及去重时本机成员的userId
+func getLocalMembers(req *pb.GetGroupMembersReq) (members []Member, count int, userIds []string) {
+	var clients []*Client
+	if len(req.UserId) > 0 {
+		for _, client := range localUserClients(req.SystemId, req.UserId) {
+			if len(req.GroupName) == 0 || client.inGroup(req.GroupName) {
+				clients = append(clients, client)
+			}
+		}
+	} else {
+		for _, clientId := range Manager.GetGroupClientList(util.GenGroupKey(req.SystemId, req.GroupName)) {
+			client, err := Manager.GetByClientId(clientId)
+			if err != nil || client.IsDeleted {
+				continue
+			}
+			clients = append(clients, client)
+		}
+	}
+
+	node := localRPCAddr()
+	for _, client := range clients {
+		userId, extend := client.getUser()
+		member := Member{
+			ClientId:    client.ClientId,
+			UserId:      userId,
+			Extend:      extend,
+			ConnectTime: client.ConnectTime,
+			Node:        node,
+		}
+		if len(req.UserId) > 0 {
+			member.GroupList = client.getGroups()
+		}
+		members = append(members, member)
+	}
+
+	members = sortMembers(members, req.Dedupe)
+	count = len(members)
+	if req.Dedupe {
+		//同一用户可能在多个节点上都有连接,由调用方合并计数
+		for _, member := range members {
+			if len(member.UserId) > 0 {
+				userIds = append(userIds, member.UserId)
+			}
+		}
+	}
+	if req.CountOnly {
+		return nil, count, userIds
+	}
+
+	members = membersAfter(members, req.Cursor, req.Dedupe)
+	if req.Limit > 0 && len(members) > int(req.Limit) {
+		members = members[:req.Limit]
+	}
+	return
+}
+
+//按key排序,同一key中最早建立的连接在前,去重时每个key只保留第一个
+func sortMembers(members []Member, dedupe bool) []Member {
+	sort.Slice(members, func(i, j int) bool {
+		ki, kj := members[i].key(dedupe), members[j].key(dedupe)
+		if ki != kj {
+			return ki < kj
+		}
+		if members[i].ConnectTime != members[j].ConnectTime {
+			return members[i].ConnectTime < members[j].ConnectTime
+		}
+		return members[i].ClientId < members[j].ClientId
+	})
+	if !dedupe {
+		return members
+	}
+
+	result := members[:0]
+	for _, member := range members {
+		if len(result) > 0 && result[len(result)-1].key(true) == member.key(true) {
+			continue
+		}
+		result = append(result, member)
+	}
+	return result
+}
+
+//已排序的成员中key在游标之后的部分
+func membersAfter(members []Member, cursor string, dedupe bool) []Member {
+	if len(cursor) == 0 {
+		return members
+	}
+	index := sort.Search(len(members), func(i int) bool {
+		return members[i].key(dedupe) > cursor
+	})
+	return members[index:]
+}
+
+func membersToPb(members []Member) []*pb.GroupMember {
+	list := make([]*pb.GroupMember, 0, len(members))
+	for _, member := range members {
+		list = append(list, &pb.GroupMember{
+			ClientId:    member.ClientId,
+			UserId:      member.UserId,
+			Extend:      member.Extend,
+			ConnectTime: member.ConnectTime,
+			Node:        member.Node,
+			GroupList:   member.GroupList,
+		})
+	}
+	return list
+}
+
+func membersFromPb(list []*pb.GroupMember) []Member {
+	members := make([]Member, 0, len(list))
+	for _, member := range list {
+		members = append(members, Member{
+			ClientId:    member.ClientId,
+			UserId:      member.UserId,
+			Extend:      member.Extend,
+			ConnectTime: member.ConnectTime,
+			Node:        member.Node,
+			GroupList:   member.GroupList,
+		})
+	}
+	return members
+}
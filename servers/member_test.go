@@ -0,0 +1,91 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestMembers(t *testing.T) {
+	resetSetting()
+
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试在线列表", t, func() {
+		systemId := "memberSystem"
+		first := NewClient("memberA", systemId, false, conn)
+		second := NewClient("memberB", systemId, false, conn)
+		third := NewClient("memberC", systemId, false, conn)
+		for index, client := range []*Client{first, second, third} {
+			client.ConnectTime = uint64(100 - index)
+			Manager.AddClient(client)
+		}
+		Manager.AddClient2LocalGroup("room", first, "memberUser", "web")
+		Manager.AddClient2LocalGroup("room", second, "memberUser", "app")
+		Manager.AddClient2LocalGroup("lobby", second, "memberUser", "app")
+		Manager.AddClient2LocalGroup("room", third, "", "")
+
+		Convey("按游标分页", func() {
+			page := GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", Limit: 2})
+			So(page.Count, ShouldEqual, 3)
+			So(page.List, ShouldHaveLength, 2)
+			So(page.List[0].ClientId, ShouldEqual, "memberA")
+			So(page.List[0].UserId, ShouldEqual, "memberUser")
+			So(page.List[0].Extend, ShouldEqual, "web")
+			So(page.List[0].Node, ShouldEqual, localRPCAddr())
+			So(page.NextCursor, ShouldEqual, "memberB")
+
+			page = GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", Limit: 2, Cursor: page.NextCursor})
+			So(page.List, ShouldHaveLength, 1)
+			So(page.List[0].ClientId, ShouldEqual, "memberC")
+			So(page.NextCursor, ShouldBeEmpty)
+		})
+
+		Convey("按用户去重", func() {
+			page := GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", Dedupe: true})
+			So(page.Count, ShouldEqual, 2)
+			//同一用户只返回最早建立的连接
+			So(page.List[0].ClientId, ShouldEqual, "memberC")
+			So(page.List[1].ClientId, ShouldEqual, "memberB")
+
+			page = GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", Dedupe: true, Limit: 1})
+			So(page.List, ShouldHaveLength, 1)
+			page = GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", Dedupe: true, Limit: 1, Cursor: page.NextCursor})
+			So(page.List[0].UserId, ShouldEqual, "memberUser")
+			So(page.NextCursor, ShouldBeEmpty)
+		})
+
+		Convey("只返回数量", func() {
+			page := GetMembers(MemberQuery{SystemId: systemId, GroupName: "room", CountOnly: true})
+			So(page.Count, ShouldEqual, 3)
+			So(page.List, ShouldBeEmpty)
+		})
+
+		Convey("查询用户的连接", func() {
+			page := GetMembers(MemberQuery{SystemId: systemId, GroupName: "lobby", UserId: "memberUser"})
+			So(page.Count, ShouldEqual, 1)
+			So(page.List[0].GroupList, ShouldResemble, []string{"room", "lobby"})
+
+			ret := GetUserList(MemberQuery{SystemId: systemId, UserId: "memberUser"}, false)
+			So(ret["list"], ShouldResemble, []string{
+				systemId + ":room:memberA",
+				systemId + ":room:memberB",
+				systemId + ":lobby:memberB",
+			})
+			So(ret["count"], ShouldEqual, 2)
+		})
+
+		Convey("默认只返回clientId", func() {
+			ret := GetOnlineList(MemberQuery{SystemId: systemId, GroupName: "room"}, false)
+			So(ret["list"], ShouldResemble, []string{"memberA", "memberB", "memberC"})
+			So(ret["count"], ShouldEqual, 3)
+			So(ret["nextCursor"], ShouldBeEmpty)
+		})
+
+		Reset(func() {
+			for _, client := range []*Client{first, second, third} {
+				Manager.DelClient(client)
+			}
+		})
+	})
+}
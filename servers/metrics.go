@@ -0,0 +1,107 @@
+package servers
+
+import (
+	"github.com/woodylan/go-websocket/pkg/metrics"
+	"strings"
+	"time"
+)
+
+const (
+	// 客户端关闭了连接
+	DisconnectClosed = "closed"
+	// 写入消息失败
+	DisconnectWriteError = "write_error"
+	// 心跳失败
+	DisconnectHeartbeat = "heartbeat"
+	// 被主动关闭
+	DisconnectKicked = "kicked"
+	// 发送队列满时按策略断开
+	DisconnectSlow = "slow"
+	// 使用同一会话的新连接替换
+	DisconnectReplaced = "replaced"
+	// 服务器关闭
+	DisconnectShutdown = "shutdown"
+	// 持续超过发送频率
+	DisconnectThrottled = "throttled"
+)
+
+var (
+	connectsTotal = metrics.NewCounterVec("gws_connects_total",
+		"建立的连接数,resumed为是否恢复会话", "system_id", "resumed")
+	disconnectsTotal = metrics.NewCounterVec("gws_disconnects_total",
+		"断开的连接数", "reason")
+	messagesSentTotal = metrics.NewCounterVec("gws_messages_sent_total",
+		"接收的发送请求数,target为client|group|user|system", "target")
+	writeErrorsTotal = metrics.NewCounterVec("gws_write_errors_total",
+		"写入连接失败的次数")
+	heartbeatFailuresTotal = metrics.NewCounterVec("gws_heartbeat_failures_total",
+		"发送心跳失败的次数")
+	throttledTotal = metrics.NewCounterVec("gws_throttled_total",
+		"被限流的次数,scope为client|user|system|api", "scope")
+	webhooksTotal = metrics.NewCounterVec("gws_webhooks_total",
+		"回调业务系统的次数,result为success|failed|dropped", "event", "result")
+
+	rpcClientSeconds = metrics.NewHistogramVec("gws_rpc_client_duration_seconds",
+		"调用其他节点的耗时", metrics.DefBuckets, "method")
+	rpcClientErrorsTotal = metrics.NewCounterVec("gws_rpc_client_errors_total",
+		"调用其他节点失败的次数", "method")
+	rpcServerSeconds = metrics.NewHistogramVec("gws_rpc_server_duration_seconds",
+		"处理其他节点调用的耗时", metrics.DefBuckets, "method")
+	rpcServerErrorsTotal = metrics.NewCounterVec("gws_rpc_server_errors_total",
+		"处理其他节点调用失败的次数", "method")
+
+	_ = metrics.NewGaugeFunc("gws_connections",
+		"当前的连接数,包括等待恢复会话的连接", []string{"system_id"}, connectionSamples)
+	_ = metrics.NewGaugeFunc("gws_send_queue_depth",
+		"发送队列中等待写入的消息数", []string{"system_id"}, sendQueueSamples)
+)
+
+//按系统统计本机的连接数
+func connectionSamples() []metrics.Sample {
+	counts := Manager.SystemClients.Counts()
+	samples := make([]metrics.Sample, 0, len(counts))
+	for systemId, count := range counts {
+		samples = append(samples, metrics.Sample{Labels: []string{systemId}, Value: float64(count)})
+	}
+	return samples
+}
+
+//按系统统计发送队列的长度
+func sendQueueSamples() []metrics.Sample {
+	depth := make(map[string]int)
+	Manager.ClientIdMapLock.RLock()
+	for _, client := range Manager.ClientIdMap {
+		depth[client.SystemId] += len(client.sendChan)
+	}
+	Manager.ClientIdMapLock.RUnlock()
+
+	samples := make([]metrics.Sample, 0, len(depth))
+	for systemId, n := range depth {
+		samples = append(samples, metrics.Sample{Labels: []string{systemId}, Value: float64(n)})
+	}
+	return samples
+}
+
+//连接断开时按原因计数
+func recordDisconnect(client *Client) {
+	//没有记录原因时按客户端关闭处理
+	client.setDisconnectReason(DisconnectClosed)
+	disconnectsTotal.With(client.disconnectReason).Inc()
+}
+
+//记录调用其他节点的耗时和结果
+func observeRPCClient(method string, start time.Time, err error) {
+	rpcClientSeconds.With(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcClientErrorsTotal.With(method).Inc()
+	}
+}
+
+//记录处理其他节点调用的耗时和结果,grpc的方法为完整路径
+func observeRPCServer(method string, start time.Time, err error) {
+	method = method[strings.LastIndex(method, "/")+1:]
+	rpcServerSeconds.With(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcServerErrorsTotal.With(method).Inc()
+	}
+}
@@ -0,0 +1,50 @@
+package servers
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/metrics"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"testing"
+)
+
+func TestRecordDisconnect(t *testing.T) {
+	Convey("测试按原因统计断开的连接", t, func() {
+		kicked := disconnectsTotal.With(DisconnectKicked).Value()
+		closed := disconnectsTotal.With(DisconnectClosed).Value()
+
+		Convey("只记录第一次的原因", func() {
+			client := &Client{}
+			client.setDisconnectReason(DisconnectKicked)
+			client.setDisconnectReason(DisconnectWriteError)
+			recordDisconnect(client)
+			So(disconnectsTotal.With(DisconnectKicked).Value(), ShouldEqual, kicked+1)
+		})
+
+		Convey("没有原因时按客户端关闭统计", func() {
+			recordDisconnect(&Client{})
+			So(disconnectsTotal.With(DisconnectClosed).Value(), ShouldEqual, closed+1)
+		})
+	})
+}
+
+func TestRPCMetrics(t *testing.T) {
+	resetSetting()
+
+	Convey("测试统计节点之间的调用", t, func() {
+		hub := NewMemoryHub()
+		node := hub.NewNode("127.0.0.1:17001", &testService{})
+		So(node.Start(), ShouldBeNil)
+		defer node.Close()
+
+		failed := rpcClientErrorsTotal.With("CloseClient").Value()
+		node.Send2System(&pb.Send2SystemReq{SystemId: "system"})
+		_ = node.CloseClient("127.0.0.1:17002", &pb.CloseClientReq{ClientId: "clientId"})
+		So(rpcClientErrorsTotal.With("CloseClient").Value(), ShouldEqual, failed+1)
+
+		buf := &bytes.Buffer{}
+		So(metrics.Default.Write(buf), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, `gws_rpc_client_duration_seconds_count{method="Send2System"}`)
+		So(buf.String(), ShouldContainSubstring, `gws_rpc_server_duration_seconds_count{method="Send2System"}`)
+	})
+}
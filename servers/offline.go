@@ -0,0 +1,163 @@
+package servers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/offline"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 离线消息存储,为nil表示未启用
+var OfflineStore offline.Store
+
+// 最近断开的客户端,key为clientId
+var recentClients sync.Map
+
+type recentClient struct {
+	SystemId string
+	UserId   string
+	Time     int64
+}
+
+// 离线消息清理间隔
+var offlinePurgeInterval = time.Minute
+
+func InitOfflineStore() (err error) {
+	OfflineStore, err = offline.New()
+	if err != nil || OfflineStore == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(offlinePurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			purgeOffline(now.Unix())
+		}
+	}()
+	return
+}
+
+// 清理过期的离线消息和断开客户端的记录
+func purgeOffline(now int64) {
+	if err := OfflineStore.Purge(now); err != nil {
+		log.Errorf("清理过期离线消息失败：%s", err)
+	}
+
+	recentClients.Range(func(key, value interface{}) bool {
+		if value.(recentClient).Time+setting.OfflineSetting.TTL <= now {
+			recentClients.Delete(key)
+		}
+		return true
+	})
+}
+
+// 保存发送给离线用户的消息,只有开启了离线消息的系统才会保存
+func saveOfflineMessage(systemId, userId, messageId, sendUserId string, code int, msg string, data *string) {
+	if len(systemId) == 0 || len(userId) == 0 || OfflineStore == nil {
+		return
+	}
+
+	account, err := getAccountInfo(systemId)
+	if err != nil || !account.OfflineMessage {
+		return
+	}
+
+	ttl := account.OfflineTTL
+	if ttl <= 0 {
+		ttl = setting.OfflineSetting.TTL
+	}
+
+	message := offline.Message{
+		MessageId:  messageId,
+		SystemId:   systemId,
+		UserId:     userId,
+		SendUserId: sendUserId,
+		Code:       code,
+		Msg:        msg,
+		CreateTime: time.Now().UnixNano(),
+		ExpireTime: time.Now().Unix() + ttl,
+	}
+	if data != nil {
+		message.Data = *data
+	}
+
+	if err := OfflineStore.Save(message); err != nil {
+		log.WithFields(log.Fields{
+			"host":      setting.GlobalSetting.LocalHost,
+			"port":      setting.CommonSetting.HttpPort,
+			"systemId":  systemId,
+			"userId":    userId,
+			"messageId": messageId,
+		}).Error("保存离线消息失败：" + err.Error())
+	}
+}
+
+// 用户上线后按顺序投递离线消息,放入发送队列之后才删除
+// 不等待发送队列,队列已满或者连接断开时剩下的消息保留到下次上线,避免阻塞读协程和接口
+// 调用方需要在用户加入本地列表之前调用,保证离线消息排在之后发送给该用户的消息前面
+func replayOfflineMessages(client *Client, userId string) {
+	if OfflineStore == nil {
+		return
+	}
+
+	var messages []offline.Message
+	if util.IsCluster() {
+		//离线消息可能保存在任意一台机器上
+		messages = Cluster.PeekOfflineMessages(&pb.PeekOfflineMessagesReq{
+			SystemId: client.SystemId,
+			UserId:   userId,
+		})
+		sort.SliceStable(messages, func(i, j int) bool {
+			return messages[i].CreateTime < messages[j].CreateTime
+		})
+	} else {
+		var err error
+		if messages, err = OfflineStore.Peek(client.SystemId, userId); err != nil {
+			log.Errorf("读取离线消息失败：%s", err)
+			return
+		}
+	}
+
+	var delivered []string
+	for _, message := range messages {
+		data := message.Data
+		info := clientInfo{
+			ClientId:   client.ClientId,
+			MessageId:  message.MessageId,
+			SendUserId: message.SendUserId,
+			Code:       message.Code,
+			Msg:        message.Msg,
+			Data:       &data,
+		}
+		if !client.trySend(info) {
+			log.WithFields(log.Fields{
+				"host":      setting.GlobalSetting.LocalHost,
+				"port":      setting.CommonSetting.HttpPort,
+				"systemId":  client.SystemId,
+				"clientId":  client.ClientId,
+				"userId":    userId,
+				"remaining": len(messages) - len(delivered),
+			}).Warn("发送队列已满或者连接已断开,剩下的离线消息下次上线时投递")
+			break
+		}
+		delivered = append(delivered, message.MessageId)
+	}
+	if len(delivered) == 0 {
+		return
+	}
+
+	if util.IsCluster() {
+		Cluster.DeleteOfflineMessages(&pb.DeleteOfflineMessagesReq{
+			SystemId:   client.SystemId,
+			UserId:     userId,
+			MessageIds: delivered,
+		})
+	} else if err := OfflineStore.Delete(client.SystemId, userId, delivered); err != nil {
+		log.Errorf("删除离线消息失败：%s", err)
+	}
+}
@@ -0,0 +1,71 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/offline"
+	"testing"
+)
+
+func TestOfflineMessage(t *testing.T) {
+	resetSetting()
+	OfflineStore = offline.NewMemoryStore()
+	defer func() {
+		OfflineStore = nil
+	}()
+	_, _ = Register("offlineSystem", RegisterOptions{OfflineMessage: true, OfflineTTL: 60})
+	defer SystemMap.Delete("offlineSystem")
+
+	Convey("测试离线消息", t, func() {
+		Convey("用户不在线时保存离线消息", func() {
+			first, _ := SendMessage2User("offlineSystem", "sendUserId", "", "offlineUserId", 0, "success", new(string))
+			second, _ := SendMessage2User("offlineSystem", "sendUserId", "", "offlineUserId", 0, "success", new(string))
+
+			client := NewClient("offlineClientId", "offlineSystem", false, &websocket.Conn{})
+			Manager.AddClient2UserClients("offlineUserId", "", client)
+			defer Manager.delUserClient("offlineUserId", client.ClientId)
+
+			So((<-client.sendChan).MessageId, ShouldEqual, first)
+			So((<-client.sendChan).MessageId, ShouldEqual, second)
+
+			//放入发送队列之后删除
+			messages, _ := OfflineStore.Peek("offlineSystem", "offlineUserId")
+			So(len(messages), ShouldEqual, 0)
+		})
+
+		Convey("连接断开时保留未投递的消息", func() {
+			SendMessage2User("offlineSystem", "sendUserId", "", "closedUserId", 0, "success", new(string))
+
+			client := NewClient("closedClientId", "offlineSystem", false, &websocket.Conn{})
+			client.close()
+			Manager.AddClient2UserClients("closedUserId", "", client)
+			defer Manager.delUserClient("closedUserId", client.ClientId)
+
+			messages, _ := OfflineStore.Peek("offlineSystem", "closedUserId")
+			So(len(messages), ShouldEqual, 1)
+		})
+
+		Convey("发送队列已满时保留未投递的消息", func() {
+			SendMessage2User("offlineSystem", "sendUserId", "", "fullUserId", 0, "success", new(string))
+			SendMessage2User("offlineSystem", "sendUserId", "", "fullUserId", 0, "success", new(string))
+
+			client := NewClient("fullClientId", "offlineSystem", false, &websocket.Conn{})
+			client.sendChan = make(chan clientInfo, 1)
+			Manager.AddClient2UserClients("fullUserId", "", client)
+			defer Manager.delUserClient("fullUserId", client.ClientId)
+
+			So(len(client.sendChan), ShouldEqual, 1)
+			messages, _ := OfflineStore.Peek("offlineSystem", "fullUserId")
+			So(len(messages), ShouldEqual, 1)
+		})
+
+		Convey("未开启离线消息的系统不保存", func() {
+			_, _ = Register("onlineSystem", RegisterOptions{})
+			defer SystemMap.Delete("onlineSystem")
+
+			SendMessage2User("onlineSystem", "sendUserId", "", "offlineUserId", 0, "success", new(string))
+			messages, _ := OfflineStore.Peek("onlineSystem", "offlineUserId")
+			So(len(messages), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,127 @@
+package servers
+
+import (
+	"errors"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"strings"
+)
+
+// 系统的策略和配额,为0或为空时使用全局配置或不限制
+type SystemPolicy struct {
+	MaxConnections int               `json:"maxConnections"` // 每台服务器上该系统的最大连接数
+	MaxGroups      int               `json:"maxGroups"`      // 每个客户端最多加入的分组数
+	MaxMessageSize int64             `json:"maxMessageSize"` // 消息大小上限，单位：字节
+	ApiRate        float64           `json:"apiRate"`        // 每台服务器上发送接口每秒的调用次数上限,覆盖全局配置
+	SocketRate     float64           `json:"socketRate"`     // 每个连接每秒发送事件的次数上限,覆盖全局配置
+	AllowedEvents  []string          `json:"allowedEvents"`  // 允许客户端发送的事件,ACK始终允许
+	Notify         bool              `json:"notify"`         // 连接时未传notify参数时是否通知上下线
+	DenyByDefault  bool              `json:"denyByDefault"`  // 为true时allowedEvents为空则拒绝所有事件,未配置目标的事件只能发送给已加入的分组
+	EventTargets   map[string]string `json:"eventTargets"`   // 各事件允许的目标,key为事件类型,value为any|joined
+}
+
+var (
+	ErrTooManyConnections = errors.New("连接数超过系统上限")
+	ErrTooManyGroups      = errors.New("分组数超过系统上限")
+	ErrMessageTooLarge    = errors.New("消息超过系统的大小上限")
+	ErrApiRateLimited     = errors.New("接口调用过于频繁")
+	ErrSocketRateLimited  = errors.New("发送消息过于频繁")
+	ErrEventNotAllowed    = errors.New("系统不允许该操作")
+	ErrCrossSystem        = errors.New("不能操作其他系统")
+	ErrTargetNotAllowed   = errors.New("不允许发送给该目标")
+	ErrTooManyClientIds   = errors.New("clientIds数量超过上限")
+)
+
+//获取系统的策略,系统不存在时返回空策略
+func getSystemPolicy(systemId string) SystemPolicy {
+	account, err := getAccountInfo(systemId)
+	if err != nil {
+		return SystemPolicy{}
+	}
+	return account.Policy
+}
+
+//消息大小上限,未配置时使用全局配置
+func (p SystemPolicy) messageSize() int64 {
+	if p.MaxMessageSize > 0 {
+		return p.MaxMessageSize
+	}
+	return setting.CommonSetting.MaxMessageSize
+}
+
+//客户端是否可以发送该事件
+func (p SystemPolicy) allowEvent(event string) bool {
+	if event == Ack {
+		return true
+	}
+	//解散分组会移出其他客户端,只有在allowedEvents中明确允许时客户端才可以发送
+	if len(p.AllowedEvents) == 0 {
+		return !p.DenyByDefault && event != Dissolve
+	}
+	for _, allowed := range p.AllowedEvents {
+		if strings.ToUpper(allowed) == event {
+			return true
+		}
+	}
+	return false
+}
+
+//客户端是否还可以加入该分组,已加入的分组不受限制
+func (p SystemPolicy) allowGroup(client *Client, groupName string) bool {
+	if p.MaxGroups <= 0 || client.inGroup(groupName) {
+		return true
+	}
+	return len(client.getGroups()) < p.MaxGroups
+}
+
+//校验发送接口是否超过系统的配额和调用频率
+func CheckSendQuota(systemId string, size int) error {
+	policy := getSystemPolicy(systemId)
+	if int64(size) > policy.messageSize() {
+		return ErrMessageTooLarge
+	}
+	if !RateLimits.allowApi(systemId, policy) {
+		return ErrApiRateLimited
+	}
+	return nil
+}
+
+//校验客户端发送的事件是否超过系统的配额和发送频率
+func (c *Client) checkEventQuota(event string, msg *clientMsg, policy SystemPolicy) error {
+	if err := CheckClientIds(msg.ClientIds); err != nil {
+		return err
+	}
+	//确认消息不限流
+	if event != Ack && !RateLimits.allowEvent(c, policy) {
+		return ErrSocketRateLimited
+	}
+	return nil
+}
+
+//超过配额时返回的错误码,限流使用单独的错误码
+func QuotaCode(err error) int {
+	if err == ErrApiRateLimited || err == ErrSocketRateLimited {
+		return retcode.RateLimitErrCode
+	}
+	return retcode.QuotaErrCode
+}
+
+//校验策略中的配置
+func (p SystemPolicy) validate() error {
+	for event, target := range p.EventTargets {
+		if target != TargetAny && target != TargetJoined {
+			return errors.New("未知的事件目标：" + event + "=" + target)
+		}
+	}
+	return nil
+}
+
+//给客户端发送错误提示
+func (c *Client) sendError(code int, msg string) {
+	c.Send(clientInfo{
+		SystemId: c.SystemId,
+		ClientId: c.ClientId,
+		Code:     code,
+		Msg:      msg,
+	})
+}
@@ -0,0 +1,72 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"testing"
+	"time"
+)
+
+func TestSystemPolicy(t *testing.T) {
+	resetSetting()
+
+	Convey("测试系统的策略和配额", t, func() {
+		Convey("允许的事件", func() {
+			policy := SystemPolicy{}
+			So(policy.allowEvent(Send2Group), ShouldBeTrue)
+			So(policy.allowEvent(Dissolve), ShouldBeFalse)
+
+			policy.AllowedEvents = []string{"b2g", Send2Client, "dsg"}
+			So(policy.allowEvent(Bind2Group), ShouldBeTrue)
+			So(policy.allowEvent(Dissolve), ShouldBeTrue)
+			So(policy.allowEvent(Send2Client), ShouldBeTrue)
+			So(policy.allowEvent(Send2Group), ShouldBeFalse)
+			So(policy.allowEvent(Ack), ShouldBeTrue)
+		})
+
+		Convey("每个客户端的分组数", func() {
+			client := &Client{GroupList: []string{"a", "b"}}
+			So(SystemPolicy{}.allowGroup(client, "c"), ShouldBeTrue)
+			So(SystemPolicy{MaxGroups: 2}.allowGroup(client, "c"), ShouldBeFalse)
+			So(SystemPolicy{MaxGroups: 2}.allowGroup(client, "a"), ShouldBeTrue)
+			So(SystemPolicy{MaxGroups: 3}.allowGroup(client, "c"), ShouldBeTrue)
+		})
+
+		Convey("消息大小上限", func() {
+			So(SystemPolicy{}.messageSize(), ShouldEqual, setting.CommonSetting.MaxMessageSize)
+			So(SystemPolicy{MaxMessageSize: 100}.messageSize(), ShouldEqual, 100)
+		})
+
+		Convey("发送接口的配额", func() {
+			_, err := Register("policySystem", RegisterOptions{})
+			So(err, ShouldBeNil)
+			_, err = UpdateSystem("policySystem", UpdateOptions{Policy: &SystemPolicy{MaxMessageSize: 10, ApiRate: 1}})
+			So(err, ShouldBeNil)
+
+			So(CheckSendQuota("policySystem", 20), ShouldEqual, ErrMessageTooLarge)
+			So(CheckSendQuota("policySystem", 5), ShouldBeNil)
+			So(CheckSendQuota("policySystem", 5), ShouldEqual, ErrApiRateLimited)
+
+			Reset(func() {
+				SystemMap.Delete("policySystem")
+				RateLimits.cleanup(time.Now().Add(limiterIdle * 2))
+			})
+		})
+
+		Convey("客户端事件的配额", func() {
+			_, err := Register("policySystem", RegisterOptions{})
+			So(err, ShouldBeNil)
+			info, err := UpdateSystem("policySystem", UpdateOptions{Policy: &SystemPolicy{SocketRate: 1}})
+			So(err, ShouldBeNil)
+
+			client := &Client{SystemId: "policySystem"}
+			So(client.checkEventQuota(Send2Group, &clientMsg{}, info.Policy), ShouldBeNil)
+			So(client.checkEventQuota(Send2Group, &clientMsg{}, info.Policy), ShouldEqual, ErrSocketRateLimited)
+			So(client.checkEventQuota(Ack, &clientMsg{}, info.Policy), ShouldBeNil)
+
+			Reset(func() {
+				SystemMap.Delete("policySystem")
+			})
+		})
+	})
+}
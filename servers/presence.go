@@ -0,0 +1,230 @@
+package servers
+
+import (
+	"errors"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sync"
+	"time"
+)
+
+var ErrTooManyUserIds = errors.New("userIds数量超过上限")
+
+// 用户的在线状态
+type UserPresence struct {
+	UserId   string `json:"userId"`
+	Online   bool   `json:"online"`
+	Count    int    `json:"count"`    // 在线的连接数
+	LastSeen int64  `json:"lastSeen"` // 最后一个连接断开的时间,在线或者没有记录时为0
+
+	node string // 查询单个节点时该节点的地址
+}
+
+// 用户在线的连接
+type Device struct {
+	ClientId    string   `json:"clientId"`
+	SystemId    string   `json:"systemId"`
+	GroupList   []string `json:"groupList"`
+	Extend      string   `json:"extend"`
+	ConnectTime uint64   `json:"connectTime"`
+	Node        string   `json:"node"` // 连接所在节点的RPC地址
+}
+
+// 用户最后在线的时间,每个节点只记录本机断开的连接,查询时取所有节点中最晚的时间
+type PresenceTracker struct {
+	lock     sync.RWMutex
+	lastSeen map[string]map[string]int64 // userId -> systemId -> 断开的时间
+}
+
+var Presence = NewPresenceTracker()
+
+func NewPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{
+		lastSeen: make(map[string]map[string]int64),
+	}
+}
+
+// 定时清理超过保存时间的记录
+func (p *PresenceTracker) Start() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.cleanup(now.Unix())
+	}
+}
+
+func (p *PresenceTracker) cleanup(now int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for userId, systems := range p.lastSeen {
+		for systemId, seen := range systems {
+			if seen+setting.PresenceSetting.LastSeenTTL <= now {
+				delete(systems, systemId)
+			}
+		}
+		if len(systems) == 0 {
+			delete(p.lastSeen, userId)
+		}
+	}
+}
+
+//记录用户的连接断开的时间
+func (p *PresenceTracker) seen(systemId, userId string, t int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.lastSeen[userId] == nil {
+		p.lastSeen[userId] = make(map[string]int64)
+	}
+	if t > p.lastSeen[userId][systemId] {
+		p.lastSeen[userId][systemId] = t
+	}
+}
+
+//获取本机记录的用户最后在线时间,systemId为空时取所有系统中最晚的时间
+func (p *PresenceTracker) LastSeen(systemId, userId string) (seen int64) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for id, t := range p.lastSeen[userId] {
+		if (len(systemId) == 0 || id == systemId) && t > seen {
+			seen = t
+		}
+	}
+	return
+}
+
+//批量查询的userIds数量不能超过上限
+func CheckUserIds(userIds []string) error {
+	if max := setting.PresenceSetting.MaxUserIds; max > 0 && len(userIds) > max {
+		return ErrTooManyUserIds
+	}
+	return nil
+}
+
+//批量查询用户的在线状态,按userIds的顺序返回,systemId为空时查询所有系统
+func GetPresence(systemId string, userIds []string) []UserPresence {
+	userIds = uniqueStrings(userIds)
+	return mergePresence(userIds, queryPresence(systemId, userIds))
+}
+
+//查询各节点上用户的连接数和最后在线时间,同一用户在每个节点各有一条
+func queryPresence(systemId string, userIds []string) []UserPresence {
+	if util.IsCluster() {
+		//用户的连接可能在任意节点上,汇总所有节点的结果
+		return Cluster.GetPresence(&pb.GetPresenceReq{
+			SystemId: systemId,
+			UserIds:  userIds,
+		})
+	}
+	//如果是单机服务，则只查询本机
+	return getLocalPresence(systemId, userIds)
+}
+
+//合并各节点的结果,连接数相加,最后在线时间取最晚的
+func mergePresence(userIds []string, list []UserPresence) []UserPresence {
+	merged := make(map[string]UserPresence, len(userIds))
+	for _, item := range list {
+		m := merged[item.UserId]
+		m.Count += item.Count
+		if item.LastSeen > m.LastSeen {
+			m.LastSeen = item.LastSeen
+		}
+		merged[item.UserId] = m
+	}
+
+	result := make([]UserPresence, 0, len(userIds))
+	for _, userId := range userIds {
+		presence := UserPresence{UserId: userId, Count: merged[userId].Count, LastSeen: merged[userId].LastSeen}
+		presence.Online = presence.Count > 0
+		if presence.Online {
+			presence.LastSeen = 0
+		}
+		result = append(result, presence)
+	}
+	return result
+}
+
+//本机用户的连接数和最后在线时间
+func getLocalPresence(systemId string, userIds []string) []UserPresence {
+	node := localRPCAddr()
+	list := make([]UserPresence, 0, len(userIds))
+	for _, userId := range userIds {
+		list = append(list, UserPresence{
+			UserId:   userId,
+			Count:    len(localUserClients(systemId, userId)),
+			LastSeen: Presence.LastSeen(systemId, userId),
+			node:     node,
+		})
+	}
+	return list
+}
+
+//查询用户在线的连接,systemId为空时查询所有系统
+func GetUserDevices(systemId, userId string) (presence UserPresence, devices []Device) {
+	var lastSeen int64
+	if util.IsCluster() {
+		devices, lastSeen = Cluster.GetUserDevices(&pb.GetUserDevicesReq{
+			SystemId: systemId,
+			UserId:   userId,
+		})
+	} else {
+		devices, lastSeen = getLocalUserDevices(systemId, userId)
+	}
+
+	if devices == nil {
+		devices = []Device{}
+	}
+	presence = UserPresence{UserId: userId, Online: len(devices) > 0, Count: len(devices)}
+	if !presence.Online {
+		presence.LastSeen = lastSeen
+	}
+	return
+}
+
+//本机用户的连接和最后在线时间
+func getLocalUserDevices(systemId, userId string) (devices []Device, lastSeen int64) {
+	node := localRPCAddr()
+	for _, client := range localUserClients(systemId, userId) {
+		_, extend := client.getUser()
+		devices = append(devices, Device{
+			ClientId:    client.ClientId,
+			SystemId:    client.SystemId,
+			GroupList:   client.getGroups(),
+			Extend:      extend,
+			ConnectTime: client.ConnectTime,
+			Node:        node,
+		})
+	}
+	return devices, Presence.LastSeen(systemId, userId)
+}
+
+//本机用户有效的连接,等待恢复会话的连接也视为在线
+func localUserClients(systemId, userId string) (clients []*Client) {
+	if len(userId) == 0 {
+		return
+	}
+	for _, clientId := range Manager.GetUserClients(userId) {
+		client, err := Manager.GetByClientId(clientId)
+		if err != nil || client.IsDeleted {
+			continue
+		}
+		if len(systemId) > 0 && client.SystemId != systemId {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	return
+}
+
+//去掉重复的元素,保留第一次出现的顺序
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	resetSetting()
+
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试用户的在线状态", t, func() {
+		first := NewClient("presenceFirst", "presenceSystem", false, conn)
+		second := NewClient("presenceSecond", "otherPresenceSystem", false, conn)
+		for _, client := range []*Client{first, second} {
+			Manager.AddClient(client)
+		}
+		Manager.AddClient2LocalGroup("room", first, "presenceUser", "web")
+		Manager.AddClient2LocalGroup("room", second, "presenceUser", "app")
+
+		Convey("批量查询在线状态", func() {
+			Presence.seen("presenceSystem", "offlineUser", 100)
+			list := GetPresence("presenceSystem", []string{"presenceUser", "offlineUser", "presenceUser", "unknownUser"})
+			So(list, ShouldResemble, []UserPresence{
+				{UserId: "presenceUser", Online: true, Count: 1},
+				{UserId: "offlineUser", LastSeen: 100},
+				{UserId: "unknownUser"},
+			})
+
+			//systemId为空时查询所有系统
+			So(GetPresence("", []string{"presenceUser"})[0].Count, ShouldEqual, 2)
+		})
+
+		Convey("查询用户的连接", func() {
+			presence, devices := GetUserDevices("presenceSystem", "presenceUser")
+			So(presence.Online, ShouldBeTrue)
+			So(devices, ShouldHaveLength, 1)
+			So(devices[0].ClientId, ShouldEqual, "presenceFirst")
+			So(devices[0].Extend, ShouldEqual, "web")
+			So(devices[0].GroupList, ShouldResemble, []string{"room"})
+			So(devices[0].Node, ShouldEqual, localRPCAddr())
+
+			presence, devices = GetUserDevices("presenceSystem", "unknownUser")
+			So(presence.Online, ShouldBeFalse)
+			So(devices, ShouldResemble, []Device{})
+		})
+
+		Convey("断开后记录最后在线时间", func() {
+			Manager.EventDisconnect(first)
+			presence, _ := GetUserDevices("presenceSystem", "presenceUser")
+			So(presence.Online, ShouldBeFalse)
+			So(presence.LastSeen, ShouldBeGreaterThanOrEqualTo, time.Now().Unix()-1)
+			//其他系统中的连接仍然在线
+			So(GetPresence("", []string{"presenceUser"})[0].Online, ShouldBeTrue)
+		})
+
+		Convey("清理过期的记录", func() {
+			tracker := NewPresenceTracker()
+			tracker.seen("system", "user", 100)
+			tracker.seen("other", "user", 200)
+			tracker.cleanup(100 + setting.PresenceSetting.LastSeenTTL)
+			So(tracker.LastSeen("system", "user"), ShouldEqual, 0)
+			So(tracker.LastSeen("", "user"), ShouldEqual, 200)
+			tracker.cleanup(200 + setting.PresenceSetting.LastSeenTTL)
+			So(tracker.lastSeen, ShouldBeEmpty)
+		})
+
+		Convey("批量查询的userIds数量", func() {
+			setting.PresenceSetting.MaxUserIds = 2
+			So(CheckUserIds([]string{"a", "b"}), ShouldBeNil)
+			So(CheckUserIds([]string{"a", "b", "c"}), ShouldEqual, ErrTooManyUserIds)
+		})
+
+		Reset(func() {
+			for _, client := range []*Client{first, second} {
+				Manager.DelClient(client)
+			}
+			resetSetting()
+		})
+	})
+}
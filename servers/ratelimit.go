@@ -0,0 +1,165 @@
+package servers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+// 超过该时间未使用的限流器会被清理,清理后令牌桶重新从满的状态开始
+const limiterIdle = 10 * time.Minute
+
+// 令牌桶限流,每秒次数或突发次数变化时重新创建
+type rateLimiter struct {
+	lock    sync.Mutex
+	limit   float64
+	burst   int
+	limiter *rate.Limiter
+}
+
+//每秒次数为0时不限制,突发次数为0时使用一秒内允许的次数
+func (l *rateLimiter) allow(limit float64, burst int) bool {
+	if limit <= 0 {
+		return true
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(limit))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limiter == nil || l.limit != limit || l.burst != burst {
+		l.limit, l.burst = limit, burst
+		l.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+	return l.limiter.Allow()
+}
+
+//恢复会话时沿用旧连接的令牌桶,避免断线重连绕过限流
+func (l *rateLimiter) inherit(old *rateLimiter) {
+	old.lock.Lock()
+	limit, burst, limiter := old.limit, old.burst, old.limiter
+	old.lock.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit, l.burst, l.limiter = limit, burst, limiter
+}
+
+type keyedLimiter struct {
+	rateLimiter
+	lastUsed time.Time
+}
+
+// 按用户、系统保存的限流器
+type RateLimiters struct {
+	lock     sync.Mutex
+	limiters map[string]*keyedLimiter
+}
+
+var RateLimits = NewRateLimiters()
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{
+		limiters: make(map[string]*keyedLimiter),
+	}
+}
+
+// 定时清理长时间未使用的限流器
+func (r *RateLimiters) Start() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.cleanup(now)
+	}
+}
+
+func (r *RateLimiters) cleanup(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key, l := range r.limiters {
+		if now.Sub(l.lastUsed) > limiterIdle {
+			delete(r.limiters, key)
+		}
+	}
+}
+
+func (r *RateLimiters) allow(key string, limit float64, burst int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	r.lock.Lock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = &keyedLimiter{}
+		r.limiters[key] = l
+	}
+	l.lastUsed = time.Now()
+	r.lock.Unlock()
+	return l.allow(limit, burst)
+}
+
+//校验客户端事件的频率,依次检查连接、用户和系统,系统配置了socketRate时替换全局的连接限制
+func (r *RateLimiters) allowEvent(c *Client, policy SystemPolicy) bool {
+	conf := setting.RateLimitSetting
+	limit, burst := conf.ClientRate, conf.ClientBurst
+	if policy.SocketRate > 0 {
+		limit, burst = policy.SocketRate, 0
+	}
+
+	if !c.limiter.allow(limit, burst) {
+		throttledTotal.With("client").Inc()
+		return false
+	}
+	if userId := c.getUserId(); len(userId) > 0 && !r.allow("user:"+c.SystemId+":"+userId, conf.UserRate, conf.UserBurst) {
+		throttledTotal.With("user").Inc()
+		return false
+	}
+	if !r.allow("system:"+c.SystemId, conf.SystemRate, conf.SystemBurst) {
+		throttledTotal.With("system").Inc()
+		return false
+	}
+	return true
+}
+
+//校验发送接口的频率,系统配置了apiRate时替换全局配置
+func (r *RateLimiters) allowApi(systemId string, policy SystemPolicy) bool {
+	limit, burst := setting.RateLimitSetting.ApiRate, setting.RateLimitSetting.ApiBurst
+	if policy.ApiRate > 0 {
+		limit, burst = policy.ApiRate, 0
+	}
+
+	if !r.allow("api:"+systemId, limit, burst) {
+		throttledTotal.With("api").Inc()
+		return false
+	}
+	return true
+}
+
+//校验单次批量发送的clientIds数量
+func CheckClientIds(clientIds []string) error {
+	if max := setting.RateLimitSetting.MaxClientIds; max > 0 && len(clientIds) > max {
+		return ErrTooManyClientIds
+	}
+	return nil
+}
+
+//记录连续被限流的次数,达到配置的次数时断开连接
+func (c *Client) throttle() {
+	c.throttled++
+	kickAfter := setting.RateLimitSetting.KickAfter
+	if kickAfter > 0 && c.throttled >= kickAfter {
+		log.WithFields(log.Fields{
+			"host":      setting.GlobalSetting.LocalHost,
+			"port":      setting.CommonSetting.HttpPort,
+			"systemId":  c.SystemId,
+			"clientId":  c.ClientId,
+			"throttled": c.throttled,
+		}).Warn("客户端持续超过发送频率,断开连接")
+		c.kick(DisconnectThrottled)
+	}
+}
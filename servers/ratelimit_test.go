@@ -0,0 +1,95 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	resetSetting()
+
+	Convey("测试限流", t, func() {
+		Convey("令牌桶", func() {
+			limiter := &rateLimiter{}
+			So(limiter.allow(0, 0), ShouldBeTrue)
+			So(limiter.allow(2, 0), ShouldBeTrue)
+			So(limiter.allow(2, 0), ShouldBeTrue)
+			So(limiter.allow(2, 0), ShouldBeFalse)
+
+			//修改限制后重新计算
+			So(limiter.allow(1, 3), ShouldBeTrue)
+		})
+
+		Convey("连接、用户和系统的发送频率", func() {
+			setting.RateLimitSetting.ClientRate, setting.RateLimitSetting.ClientBurst = 1, 0
+			setting.RateLimitSetting.UserRate, setting.RateLimitSetting.UserBurst = 1, 2
+			setting.RateLimitSetting.SystemRate, setting.RateLimitSetting.SystemBurst = 1, 3
+			limits := NewRateLimiters()
+			first := &Client{ClientId: "first", SystemId: "system", UserId: "user"}
+			second := &Client{ClientId: "second", SystemId: "system", UserId: "user"}
+			third := &Client{ClientId: "third", SystemId: "system"}
+
+			So(limits.allowEvent(first, SystemPolicy{}), ShouldBeTrue)
+			So(limits.allowEvent(first, SystemPolicy{}), ShouldBeFalse)
+			So(limits.allowEvent(second, SystemPolicy{}), ShouldBeTrue)
+			//同一用户的其他连接共享用户的限制
+			So(limits.allowEvent(&Client{ClientId: "other", SystemId: "system", UserId: "user"}, SystemPolicy{}), ShouldBeFalse)
+			So(limits.allowEvent(third, SystemPolicy{}), ShouldBeTrue)
+			So(limits.allowEvent(&Client{ClientId: "fourth", SystemId: "system"}, SystemPolicy{}), ShouldBeFalse)
+		})
+
+		Convey("系统配置覆盖全局的连接限制", func() {
+			setting.RateLimitSetting.ClientRate, setting.RateLimitSetting.ClientBurst = 1, 0
+			limits := NewRateLimiters()
+			client := &Client{ClientId: "client", SystemId: "system"}
+			So(limits.allowEvent(client, SystemPolicy{SocketRate: 2}), ShouldBeTrue)
+			So(limits.allowEvent(client, SystemPolicy{SocketRate: 2}), ShouldBeTrue)
+			So(limits.allowEvent(client, SystemPolicy{SocketRate: 2}), ShouldBeFalse)
+		})
+
+		Convey("发送接口的频率", func() {
+			setting.RateLimitSetting.ApiRate, setting.RateLimitSetting.ApiBurst = 1, 2
+			limits := NewRateLimiters()
+			So(limits.allowApi("system", SystemPolicy{}), ShouldBeTrue)
+			So(limits.allowApi("system", SystemPolicy{}), ShouldBeTrue)
+			So(limits.allowApi("system", SystemPolicy{}), ShouldBeFalse)
+			So(limits.allowApi("other", SystemPolicy{}), ShouldBeTrue)
+		})
+
+		Convey("清理长时间未使用的限流器", func() {
+			limits := NewRateLimiters()
+			So(limits.allow("key", 1, 1), ShouldBeTrue)
+			So(limits.allow("key", 1, 1), ShouldBeFalse)
+
+			limits.cleanup(time.Now())
+			So(limits.limiters, ShouldHaveLength, 1)
+			limits.cleanup(time.Now().Add(limiterIdle * 2))
+			So(limits.limiters, ShouldHaveLength, 0)
+			So(limits.allow("key", 1, 1), ShouldBeTrue)
+		})
+
+		Convey("批量发送的clientIds数量", func() {
+			setting.RateLimitSetting.MaxClientIds = 2
+			So(CheckClientIds([]string{"a", "b"}), ShouldBeNil)
+			So(CheckClientIds([]string{"a", "b", "c"}), ShouldEqual, ErrTooManyClientIds)
+		})
+
+		Convey("持续被限流时断开连接", func() {
+			setting.RateLimitSetting.KickAfter = 2
+			conn, closeServer := newTestConn(t)
+			defer closeServer()
+			client := NewClient("throttledClient", "system", false, conn)
+			client.throttle()
+			So(atomic.LoadInt32(&client.kicked), ShouldEqual, 0)
+			client.throttle()
+			So(atomic.LoadInt32(&client.kicked), ShouldEqual, 1)
+		})
+
+		Reset(func() {
+			resetSetting()
+		})
+	})
+}
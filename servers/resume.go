@@ -0,0 +1,166 @@
+package servers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 连接正常
+	clientStateActive int32 = iota
+	// 连接已断开,等待恢复会话
+	clientStateSuspended
+	// 超过等待时间,会话已失效
+	clientStateExpired
+)
+
+// 等待恢复的会话,key为clientId
+var suspended = struct {
+	sync.Mutex
+	clients map[string]*Client
+}{clients: make(map[string]*Client)}
+
+// 生成恢复会话的凭证,格式为base64(clientId:随机数)
+func genResumeToken(clientId string) string {
+	if setting.CommonSetting.ResumeWindow <= 0 {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(clientId + ":" + util.GenUUID()))
+}
+
+// 解析凭证中的clientId
+func parseResumeToken(token string) (clientId string, ok bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", false
+	}
+
+	index := strings.LastIndex(string(raw), ":")
+	if index <= 0 {
+		return "", false
+	}
+	return string(raw[:index]), true
+}
+
+func (c *Client) checkResumeToken(token, systemId string) bool {
+	return c.SystemId == systemId && len(c.resumeToken) > 0 && subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) == 1
+}
+
+//重连请求的身份需要和会话一致,通过连接凭证认证的会话只能用相同用户的凭证恢复
+func (c *Client) checkResumeIdentity(userId string, authorized bool) bool {
+	if c.authorized && !authorized {
+		return false
+	}
+	sessionUserId, _ := c.getUser()
+	return sessionUserId == userId
+}
+
+func (c *Client) isSuspended() bool {
+	return atomic.LoadInt32(&c.state) == clientStateSuspended
+}
+
+// 连接断开时保留会话,返回false表示不保留,需要销毁客户端
+func suspendClient(client *Client) bool {
+	suspended.Lock()
+	defer suspended.Unlock()
+
+	switch atomic.LoadInt32(&client.state) {
+	case clientStateSuspended:
+		if atomic.LoadInt32(&client.kicked) == 0 && !IsDraining() {
+			//重复的断开事件
+			return true
+		}
+		//等待恢复期间被主动关闭,例如发送队列已满,不再保留会话,断开时已经计数
+		delete(suspended.clients, client.ClientId)
+		atomic.StoreInt32(&client.state, clientStateExpired)
+		return false
+	case clientStateExpired:
+		return false
+	}
+
+	window := setting.CommonSetting.ResumeWindow
+	if window <= 0 || len(client.resumeToken) == 0 || atomic.LoadInt32(&client.kicked) == 1 || IsDraining() {
+		return false
+	}
+
+	_ = client.Socket.Close()
+	atomic.StoreInt32(&client.state, clientStateSuspended)
+	recordDisconnect(client)
+	close(client.suspendChan)
+	suspended.clients[client.ClientId] = client
+
+	time.AfterFunc(time.Duration(window)*time.Second, func() {
+		suspended.Lock()
+		defer suspended.Unlock()
+
+		if suspended.clients[client.ClientId] != client {
+			return //已经恢复
+		}
+		delete(suspended.clients, client.ClientId)
+		atomic.StoreInt32(&client.state, clientStateExpired)
+		Manager.disconnect(client)
+	})
+
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"clientId": client.ClientId,
+	}).Info("客户端连接断开,等待恢复会话")
+	return true
+}
+
+// 使用新的连接恢复会话,保留clientId、分组、userId、限流状态和发送队列中的消息
+// userId为重连请求的用户,authorized为是否通过连接凭证认证,凭证无效或身份不一致则返回nil
+func (manager *ClientManager) ResumeClient(token, systemId, userId string, authorized bool, socket *websocket.Conn) *Client {
+	clientId, ok := parseResumeToken(token)
+	if !ok {
+		return nil
+	}
+
+	//旧连接可能还没有检测到断开,先将其挂起
+	if current, err := manager.GetByClientId(clientId); err == nil && !current.isSuspended() &&
+		current.checkResumeToken(token, systemId) && current.checkResumeIdentity(userId, authorized) {
+		current.setDisconnectReason(DisconnectReplaced)
+		suspendClient(current)
+	}
+
+	suspended.Lock()
+	old, ok := suspended.clients[clientId]
+	if !ok || !old.checkResumeToken(token, systemId) || !old.checkResumeIdentity(userId, authorized) {
+		suspended.Unlock()
+		return nil
+	}
+	delete(suspended.clients, clientId)
+	suspended.Unlock()
+
+	client := NewClient(clientId, systemId, old.Notify, socket)
+	client.ConnectTime = old.ConnectTime
+	client.UserId, client.Extend = old.getUser()
+	client.GroupList = old.getGroups()
+	client.authorized = old.authorized
+	client.allowedGroups = old.allowedGroups
+	client.resumeToken = genResumeToken(clientId)
+	client.limiter.inherit(&old.limiter)
+	//接管原来的发送队列和关闭信号,仍然持有旧客户端的发送方放入的消息也由新连接发送
+	//旧客户端的写协程在挂起时已经退出,不需要关闭
+	client.sendChan = old.sendChan
+	client.closeChan = old.closeChan
+	client.closeOnce = old.closeOnce
+
+	manager.AddClient(client)
+
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"clientId": clientId,
+	}).Info("客户端已恢复会话")
+	return client
+}
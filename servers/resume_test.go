@@ -0,0 +1,117 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type resumeRender struct {
+	Code int        `json:"code"`
+	Data renderData `json:"data"`
+}
+
+func TestResumeClient(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.ResumeWindow = 5
+	_, _ = Register("resumeSystem", RegisterOptions{})
+	defer SystemMap.Delete("resumeSystem")
+	StartWebSocket()
+
+	s := httptest.NewServer(http.HandlerFunc((&Controller{}).Run))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?systemId=resumeSystem&groupName=resumeGroup&userId=resumeUser"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first resumeRender
+	_ = conn.ReadJSON(&first)
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	_ = conn.Close()
+
+	var old *Client
+	for i := 0; i < 100; i++ {
+		if old, err = Manager.GetByClientId(first.Data.ClientId); err == nil && old.isSuspended() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Convey("测试断线重连恢复会话", t, func() {
+		So(first.Data.ResumeToken, ShouldNotBeEmpty)
+		So(old.isSuspended(), ShouldBeTrue)
+
+		//身份不一致时不能恢复,凭证仍然有效
+		So(Manager.ResumeClient(first.Data.ResumeToken, "resumeSystem", "otherUser", false, nil), ShouldBeNil)
+		So(Manager.ResumeClient(first.Data.ResumeToken, "resumeSystem", "", false, nil), ShouldBeNil)
+		So(old.isSuspended(), ShouldBeTrue)
+
+		//耗尽旧连接的令牌,恢复后仍然被限流
+		So(old.limiter.allow(0.001, 1), ShouldBeTrue)
+		So(old.limiter.allow(0.001, 1), ShouldBeFalse)
+
+		data := "断线期间的消息"
+		messageId := SendMessage2Client("resumeSystem", first.Data.ClientId, "sendUserId", 0, "success", &data, false)
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"&resumeToken="+url.QueryEscape(first.Data.ResumeToken), nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		var second resumeRender
+		So(conn.ReadJSON(&second), ShouldBeNil)
+		So(second.Data.Resumed, ShouldBeTrue)
+		So(second.Data.ClientId, ShouldEqual, first.Data.ClientId)
+		So(second.Data.ResumeToken, ShouldNotEqual, first.Data.ResumeToken)
+
+		var message RetData
+		So(conn.ReadJSON(&message), ShouldBeNil)
+		So(message.MessageId, ShouldEqual, messageId)
+
+		//仍然持有旧客户端的发送方,消息也会发送到新的连接
+		old.Send(clientInfo{ClientId: old.ClientId, MessageId: "afterResume", Data: &data})
+		So(conn.ReadJSON(&message), ShouldBeNil)
+		So(message.MessageId, ShouldEqual, "afterResume")
+
+		So(Manager.GetGroupClientList(util.GenGroupKey("resumeSystem", "resumeGroup")), ShouldContain, first.Data.ClientId)
+
+		resumed, err := Manager.GetByClientId(first.Data.ClientId)
+		So(err, ShouldBeNil)
+		So(resumed, ShouldNotEqual, old)
+		So(resumed.limiter.allow(0.001, 1), ShouldBeFalse)
+
+		Convey("凭证只能使用一次", func() {
+			So(Manager.ResumeClient(first.Data.ResumeToken, "resumeSystem", "resumeUser", false, nil), ShouldBeNil)
+		})
+	})
+}
+
+func TestSuspendKicked(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.ResumeWindow = 5
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试等待恢复期间被主动关闭", t, func() {
+		client := NewClient("kickedClientId", "resumeSystem", false, conn)
+		client.resumeToken = genResumeToken(client.ClientId)
+		So(suspendClient(client), ShouldBeTrue)
+		//重复的断开事件
+		So(suspendClient(client), ShouldBeTrue)
+
+		//例如发送队列已满时按照策略断开,不再保留会话
+		atomic.StoreInt32(&client.kicked, 1)
+		So(suspendClient(client), ShouldBeFalse)
+		So(atomic.LoadInt32(&client.state), ShouldEqual, clientStateExpired)
+		So(Manager.ResumeClient(client.resumeToken, "resumeSystem", "", false, nil), ShouldBeNil)
+	})
+}
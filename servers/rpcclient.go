@@ -3,245 +3,155 @@ package servers
 import (
 	"context"
 	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/etcd"
 	"github.com/woodylan/go-websocket/pkg/setting"
-	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
 	"google.golang.org/grpc"
-	"sync"
+	"io"
+	"time"
 )
 
-func grpcConn(addr string) *grpc.ClientConn {
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
-		log.Errorf("did not connect: %v", err)
-	}
-	return conn
+//grpc服务中的方法路径前缀
+const grpcMethodPrefix = "/CommonService/"
+
+//通过grpc调用其他节点,使用etcd注册和发现节点
+type GrpcBackplane struct {
+	nodeBackplane
+	server *grpc.Server
+	reg    *etcd.ServiceReg
 }
 
-func SendRpc2Client(addr string, messageId, sendUserId, clientId string, code int, message string, data *string) {
-	conn := grpcConn(addr)
-	defer conn.Close()
-
-	log.WithFields(log.Fields{
-		"host":     setting.GlobalSetting.LocalHost,
-		"port":     setting.CommonSetting.HttpPort,
-		"add":      addr,
-		"clientId": clientId,
-		"msg":      data,
-	}).Info("发送到服务器")
-
-	c := pb.NewCommonServiceClient(conn)
-	_, err := c.Send2Client(context.Background(), &pb.Send2ClientReq{
-		MessageId:  messageId,
-		SendUserId: sendUserId,
-		ClientId:   clientId,
-		Code:       int32(code),
-		Message:    message,
-		Data:       *data,
-	})
-	if err != nil {
-		log.Errorf("failed to call: %v", err)
-	}
+func NewGrpcBackplane() *GrpcBackplane {
+	b := &GrpcBackplane{}
+	b.nodeBackplane = nodeBackplane{invoker: b}
+	return b
 }
 
-func CloseRpcClient(addr string, clientId, systemId string) {
-	conn := grpcConn(addr)
-	defer conn.Close()
-
-	log.WithFields(log.Fields{
-		"host":     setting.GlobalSetting.LocalHost,
-		"port":     setting.CommonSetting.HttpPort,
-		"add":      addr,
-		"clientId": clientId,
-	}).Info("发送关闭连接到服务器")
-
-	c := pb.NewCommonServiceClient(conn)
-	_, err := c.CloseClient(context.Background(), &pb.CloseClientReq{
-		SystemId: systemId,
-		ClientId: clientId,
-	})
+//从连接池获取到指定节点的连接
+func grpcConn(addr string) (*grpc.ClientConn, error) {
+	conn, err := Nodes.Get(addr)
 	if err != nil {
-		log.Errorf("failed to call: %v", err)
+		log.Errorf("did not connect: %v", err)
 	}
+	return conn, err
 }
 
-//绑定分组
-func SendRpcBindGroup(addr string, systemId string, groupName string, clientId string, userId string, extend string) {
-	conn := grpcConn(addr)
-	defer conn.Close()
-
-	c := pb.NewCommonServiceClient(conn)
-	_, err := c.BindGroup(context.Background(), &pb.BindGroupReq{
-		SystemId:  systemId,
-		GroupName: groupName,
-		ClientId:  clientId,
-		UserId:    userId,
-		Extend:    extend,
-	})
-	if err != nil {
-		log.Errorf("failed to call: %v", err)
+//获取当前的服务器列表快照,避免调用期间一直持有锁
+func serverList() []string {
+	setting.GlobalSetting.ServerListLock.RLock()
+	defer setting.GlobalSetting.ServerListLock.RUnlock()
+
+	addrs := make([]string, 0, len(setting.GlobalSetting.ServerList))
+	for _, addr := range setting.GlobalSetting.ServerList {
+		addrs = append(addrs, addr)
 	}
+	return addrs
 }
 
-//发送分组消息
-func SendGroupBroadcast(systemId string, messageId, sendUserId, groupName string, code int, message string, data *string) {
-	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
-	for _, addr := range setting.GlobalSetting.ServerList {
-		conn := grpcConn(addr)
-		defer conn.Close()
-
-		c := pb.NewCommonServiceClient(conn)
-		_, err := c.Send2Group(context.Background(), &pb.Send2GroupReq{
-			SystemId:   systemId,
-			MessageId:  messageId,
-			SendUserId: sendUserId,
-			GroupName:  groupName,
-			Code:       int32(code),
-			Message:    message,
-			Data:       *data,
-		})
-		if err != nil {
-			log.Errorf("failed to call: %v", err)
-		}
+func (b *GrpcBackplane) nodes() []string {
+	return serverList()
+}
+
+//获取有该分组成员的节点,分组索引不可用时返回所有节点
+func (b *GrpcBackplane) groupNodes(systemId, groupName string) []string {
+	if addrs, ok := Groups.Nodes(util.GenGroupKey(systemId, groupName)); ok {
+		return addrs
 	}
+	return serverList()
 }
 
-//发送用户消息
-func SendUserBroadcast(systemId string, messageId, sendUserId, groupName, userId string, code int, message string, data *string) {
-	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
-	index := 0
-	for _, addr := range setting.GlobalSetting.ServerList {
-		//log.Infof("GlobalSetting.ServerList index:[ %d ], Key:[ %s ], Value:[ %s ]", index, key, addr)
-		index = index + 1
-		conn := grpcConn(addr)
-		defer conn.Close()
-
-		c := pb.NewCommonServiceClient(conn)
-		_, err := c.Send2User(context.Background(), &pb.Send2UserReq{
-			SystemId:   systemId,
-			MessageId:  messageId,
-			SendUserId: sendUserId,
-			GroupName:  groupName,
-			UserId:     userId,
-			Code:       int32(code),
-			Message:    message,
-			Data:       *data,
-		})
-		if err != nil {
-			log.Errorf("failed to call: %v", err)
-		}
+func (b *GrpcBackplane) invoke(ctx context.Context, addr, method string, req, reply interface{}) error {
+	conn, err := grpcConn(addr)
+	if err != nil {
+		return err
 	}
+	return conn.Invoke(ctx, grpcMethodPrefix+method, req, reply)
 }
 
-//发送系统信息
-func SendSystemBroadcast(systemId string, messageId, sendUserId string, code int, message string, data *string) {
-	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
-	for _, addr := range setting.GlobalSetting.ServerList {
-		conn := grpcConn(addr)
-		defer conn.Close()
-
-		c := pb.NewCommonServiceClient(conn)
-		_, err := c.Send2System(context.Background(), &pb.Send2SystemReq{
-			SystemId:   systemId,
-			MessageId:  messageId,
-			SendUserId: sendUserId,
-			Code:       int32(code),
-			Message:    message,
-			Data:       *data,
-		})
-		if err != nil {
-			log.Errorf("failed to call: %v", err)
+func (b *GrpcBackplane) invokeStream(ctx context.Context, addr, method string, req interface{}, newReply func() interface{}, recv func(reply interface{})) error {
+	conn, err := grpcConn(addr)
+	if err != nil {
+		return err
+	}
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{StreamName: method, ServerStreams: true}, grpcMethodPrefix+method)
+	if err != nil {
+		return err
+	}
+	if err = stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		reply := newReply()
+		if err = stream.RecvMsg(reply); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
+		recv(reply)
 	}
 }
 
-func GetOnlineListBroadcast(systemId *string, groupName *string) (clientIdList []string) {
-	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
+//启动RPC服务,将服务器地址、端口注册到etcd中并监听其他节点
+func (b *GrpcBackplane) Start() error {
+	b.server = InitGRpcServer()
 
-	serverCount := len(setting.GlobalSetting.ServerList)
-
-	onlineListChan := make(chan []string, serverCount)
-	var wg sync.WaitGroup
+	//注册租约
+	ser, err := etcd.NewServiceReg(setting.EtcdSetting.Endpoints, 5)
+	if err != nil {
+		return err
+	}
+	b.reg = ser
 
-	wg.Add(serverCount)
-	for _, addr := range setting.GlobalSetting.ServerList {
-		go func(addr string) {
-			conn := grpcConn(addr)
-			defer conn.Close()
-			c := pb.NewCommonServiceClient(conn)
-			response, err := c.GetGroupClients(context.Background(), &pb.GetGroupClientsReq{
-				SystemId:  *systemId,
-				GroupName: *groupName,
-			})
-			if err != nil {
-				log.Errorf("failed to call: %v", err)
-			} else {
-				onlineListChan <- response.List
-			}
-			wg.Done()
-
-		}(addr)
+	hostPort := localRPCAddr()
+	//添加key
+	if err = ser.PutService(define.ETcdServerList+hostPort, hostPort); err != nil {
+		return err
 	}
 
-	wg.Wait()
+	//发布和监听分组所在的节点,分组消息只发送到有成员的节点
+	Groups.Start(ser)
 
-	for i := 1; i <= serverCount; i++ {
-		list, ok := <-onlineListChan
-		if ok {
-			clientIdList = append(clientIdList, list...)
-		} else {
-			return
-		}
+	cli, err := etcd.NewClientDis(setting.EtcdSetting.Endpoints)
+	if err != nil {
+		return err
+	}
+	//服务下线时关闭连接池中到该服务的连接
+	cli.OnDelete = Nodes.Remove
+	if _, err = cli.GetService(define.ETcdServerList); err != nil {
+		return err
 	}
-	close(onlineListChan)
 
-	return
+	//定时检查到其他节点的连接
+	go Nodes.Start()
+	return nil
 }
 
-func GetUserListBroadcast(systemId, groupName, userId *string) (userList []string) {
-	setting.GlobalSetting.ServerListLock.Lock()
-	defer setting.GlobalSetting.ServerListLock.Unlock()
-
-	serverCount := len(setting.GlobalSetting.ServerList)
-
-	userListChan := make(chan []string, serverCount)
-	var wg sync.WaitGroup
-
-	wg.Add(serverCount)
-	for _, addr := range setting.GlobalSetting.ServerList {
-		go func(addr string) {
-			conn := grpcConn(addr)
-			defer conn.Close()
-			c := pb.NewCommonServiceClient(conn)
-			response, err := c.GetUserClients(context.Background(), &pb.GetUserClientsReq{
-				SystemId:  *systemId,
-				GroupName: *groupName,
-				UserId:    *userId,
-			})
-			if err != nil {
-				log.Errorf("failed to call: %v", err)
-			} else {
-				userListChan <- response.List
-			}
-			wg.Done()
-
-		}(addr)
+//撤销租约,本机的地址和分组从etcd中删除,其他节点不再调用本机
+func (b *GrpcBackplane) Leave() error {
+	if b.reg == nil {
+		return nil
 	}
+	return b.reg.RevokeLease()
+}
 
-	wg.Wait()
-
-	for i := 1; i <= serverCount; i++ {
-		list, ok := <-userListChan
-		if ok {
-			userList = append(userList, list...)
-		} else {
-			return
+//等待进行中的调用完成,超时则直接停止,然后关闭到其他节点的连接
+func (b *GrpcBackplane) Close() error {
+	if b.server != nil {
+		stopped := make(chan struct{})
+		go func() {
+			b.server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(rpcTimeout()):
+			b.server.Stop()
 		}
 	}
-	close(userListChan)
-
-	return
+	Nodes.Close()
+	return nil
 }
@@ -0,0 +1,53 @@
+package servers
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.RPCTimeout = 1
+
+	Convey("测试并发广播", t, func() {
+		setting.GlobalSetting.ServerList = map[string]string{
+			"/gws/servers/127.0.0.1:17001": "127.0.0.1:17001",
+			"/gws/servers/127.0.0.1:17002": "127.0.0.1:17002",
+			"/gws/servers/127.0.0.1:17003": "127.0.0.1:17003",
+		}
+
+		Convey("一个节点超时不影响其他节点", func() {
+			var calls int32
+			start := time.Now()
+			result := broadcastTo(serverList(), "Test", func(ctx context.Context, addr string) error {
+				//调用期间不持有服务器列表的锁,服务发现可以正常更新
+				setting.GlobalSetting.ServerListLock.Lock()
+				setting.GlobalSetting.ServerListLock.Unlock()
+
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			})
+
+			So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+			So(result.Nodes, ShouldEqual, 3)
+			So(result.Reached, ShouldEqual, 2)
+			So(len(result.Failed), ShouldEqual, 1)
+		})
+
+		Convey("没有节点", func() {
+			setting.GlobalSetting.ServerList = map[string]string{}
+			result := broadcastTo(serverList(), "Test", func(ctx context.Context, addr string) error {
+				return nil
+			})
+			So(result.Nodes, ShouldEqual, 0)
+			So(result.Failed, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"sync"
+	"time"
+)
+
+// 健康检查间隔
+var rpcHealthInterval = 10 * time.Second
+
+// 单次健康检查的超时时间
+var rpcHealthTimeout = 3 * time.Second
+
+// 连续检查失败多少次之后关闭连接,下次使用时重新建立
+const rpcMaxHealthFailures = 3
+
+// 重连的最大退避时间
+var rpcMaxBackoff = 30 * time.Second
+
+// 连接空闲时发送心跳的间隔,服务端的EnforcementPolicy不能大于该值
+var rpcKeepaliveTime = 30 * time.Second
+
+// 节点健康检查失败,广播时跳过该节点,不等待调用超时
+var ErrNodeUnhealthy = errors.New("节点健康检查失败")
+
+// 到其他节点的长连接
+type rpcNode struct {
+	conn     *grpc.ClientConn
+	healthy  bool
+	failures int
+}
+
+// 节点连接池,按地址复用grpc连接
+type NodePool struct {
+	lock      sync.RWMutex
+	nodes     map[string]*rpcNode
+	done      chan struct{} // 关闭连接池时停止健康检查
+	closeOnce sync.Once
+}
+
+var Nodes = NewNodePool()
+
+func NewNodePool() *NodePool {
+	return &NodePool{
+		nodes: make(map[string]*rpcNode),
+		done:  make(chan struct{}),
+	}
+}
+
+func dialNode(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr,
+		grpc.WithInsecure(),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  time.Second,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   rpcMaxBackoff,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                rpcKeepaliveTime,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+}
+
+// 获取到指定节点的连接,不存在则建立,健康检查失败的节点返回ErrNodeUnhealthy
+// 健康检查会继续重连,恢复之后或者连续失败被移除之后再次可用
+func (p *NodePool) Get(addr string) (*grpc.ClientConn, error) {
+	p.lock.RLock()
+	if node, ok := p.nodes[addr]; ok {
+		defer p.lock.RUnlock()
+		return node.get()
+	}
+	p.lock.RUnlock()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if node, ok := p.nodes[addr]; ok {
+		return node.get()
+	}
+
+	conn, err := dialNode(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.nodes[addr] = &rpcNode{conn: conn, healthy: true}
+	return conn, nil
+}
+
+//健康状态由check在持有连接池的锁时修改,调用方需要持有锁
+func (n *rpcNode) get() (*grpc.ClientConn, error) {
+	if !n.healthy {
+		return nil, ErrNodeUnhealthy
+	}
+	return n.conn, nil
+}
+
+// 节点下线时关闭并移除连接
+func (p *NodePool) Remove(addr string) {
+	p.lock.Lock()
+	node, ok := p.nodes[addr]
+	delete(p.nodes, addr)
+	p.lock.Unlock()
+
+	if ok {
+		_ = node.conn.Close()
+		log.WithFields(log.Fields{
+			"host": setting.GlobalSetting.LocalHost,
+			"port": setting.CommonSetting.HttpPort,
+			"addr": addr,
+		}).Info("移除节点连接")
+	}
+}
+
+// 停止健康检查并关闭所有连接
+func (p *NodePool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	p.lock.Lock()
+	nodes := p.nodes
+	p.nodes = make(map[string]*rpcNode)
+	p.lock.Unlock()
+
+	for _, node := range nodes {
+		_ = node.conn.Close()
+	}
+}
+
+// 检查所有节点的健康状态
+func (p *NodePool) check() {
+	p.lock.RLock()
+	nodes := make(map[string]*rpcNode, len(p.nodes))
+	for addr, node := range p.nodes {
+		nodes[addr] = node
+	}
+	p.lock.RUnlock()
+
+	for addr, node := range nodes {
+		healthy := checkNode(node.conn)
+
+		p.lock.Lock()
+		//检查期间连接可能已经被移除或者替换
+		if current, ok := p.nodes[addr]; !ok || current != node {
+			p.lock.Unlock()
+			continue
+		}
+		if healthy {
+			node.healthy = true
+			node.failures = 0
+			p.lock.Unlock()
+			continue
+		}
+
+		node.healthy = false
+		node.failures++
+		evict := node.failures >= rpcMaxHealthFailures
+		if evict {
+			delete(p.nodes, addr)
+		}
+		p.lock.Unlock()
+
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"addr":     addr,
+			"failures": node.failures,
+		}).Warn("节点健康检查失败")
+
+		if evict {
+			_ = node.conn.Close()
+		} else {
+			//立即重连,不等待退避时间
+			node.conn.ResetConnectBackoff()
+		}
+	}
+}
+
+func checkNode(conn *grpc.ClientConn) bool {
+	if conn.GetState() == connectivity.Shutdown {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcHealthTimeout)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	return err == nil && resp.Status == grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// 启动定时健康检查,Close之后退出
+func (p *NodePool) Start() {
+	ticker := time.NewTicker(rpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-p.done:
+			return
+		}
+	}
+}
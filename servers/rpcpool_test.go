@@ -0,0 +1,93 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"testing"
+	"time"
+)
+
+func newHealthServer(t *testing.T) (string, *grpc.Server) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String(), s
+}
+
+func TestNodePool(t *testing.T) {
+	resetSetting()
+	rpcHealthTimeout = 200 * time.Millisecond
+
+	Convey("测试节点连接池", t, func() {
+		addr, server := newHealthServer(t)
+		defer server.Stop()
+		pool := NewNodePool()
+		defer pool.Close()
+
+		conn, err := pool.Get(addr)
+		So(err, ShouldBeNil)
+
+		Convey("相同地址复用连接", func() {
+			again, err := pool.Get(addr)
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, conn)
+		})
+
+		Convey("健康检查", func() {
+			pool.check()
+			again, err := pool.Get(addr)
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, conn)
+		})
+
+		Convey("节点下线时移除连接", func() {
+			pool.Remove(addr)
+			So(conn.GetState(), ShouldEqual, connectivity.Shutdown)
+
+			again, err := pool.Get(addr)
+			So(err, ShouldBeNil)
+			So(again, ShouldNotEqual, conn)
+		})
+
+		Convey("连续检查失败之后关闭连接", func() {
+			server.Stop()
+			for i := 0; i < rpcMaxHealthFailures-1; i++ {
+				pool.check()
+			}
+			//检查失败的节点不返回连接,广播时直接记为失败
+			_, err := pool.Get(addr)
+			So(err, ShouldEqual, ErrNodeUnhealthy)
+
+			pool.check()
+			So(conn.GetState(), ShouldEqual, connectivity.Shutdown)
+			again, err := pool.Get(addr)
+			So(err, ShouldBeNil)
+			So(again, ShouldNotEqual, conn)
+		})
+
+		Convey("关闭之后停止健康检查", func() {
+			stopped := make(chan struct{})
+			go func() {
+				pool.Start()
+				close(stopped)
+			}()
+			pool.Close()
+
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				t.Fatal("健康检查没有停止")
+			}
+		})
+	})
+}
@@ -7,7 +7,11 @@ import (
 	"github.com/woodylan/go-websocket/servers/pb"
 	"github.com/woodylan/go-websocket/tools/util"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"net"
+	"time"
 )
 
 type CommonServiceServer struct{}
@@ -18,7 +22,7 @@ func (this *CommonServiceServer) Send2Client(ctx context.Context, req *pb.Send2C
 		"port":     setting.CommonSetting.HttpPort,
 		"clientId": req.ClientId,
 	}).Info("Send2Client接收到RPC指定客户端消息")
-	SendMessage2LocalClient(req.MessageId, req.ClientId, req.SendUserId, int(req.Code), req.Message, &req.Data)
+	SendSystemMessage2LocalClient(req.SystemId, req.MessageId, req.ClientId, req.SendUserId, int(req.Code), req.Message, &req.Data, req.NeedAck)
 	return &pb.Send2ClientReply{}, nil
 }
 
@@ -36,7 +40,9 @@ func (this *CommonServiceServer) CloseClient(ctx context.Context, req *pb.CloseC
 func (this *CommonServiceServer) BindGroup(ctx context.Context, req *pb.BindGroupReq) (*pb.BindGroupReply, error) {
 	if client, err := Manager.GetByClientId(req.ClientId); err == nil {
 		//添加到本地
-		Manager.AddClient2LocalGroup(req.GroupName, client, req.UserId, req.Extend)
+		if err = addLocalClient2Group(req.SystemId, req.GroupName, client, req.UserId, req.Extend); err != nil {
+			return nil, err
+		}
 	} else {
 		log.Error("BindGroup添加分组失败" + err.Error())
 	}
@@ -73,8 +79,8 @@ func (this *CommonServiceServer) Send2User(ctx context.Context, req *pb.Send2Use
 		"host": setting.GlobalSetting.LocalHost,
 		"port": setting.CommonSetting.HttpPort,
 	}).Info("Send2User接收到RPC发送用户消息")
-	Manager.SendMessage2LocalUserId(req.SystemId, req.MessageId, req.SendUserId, req.GroupName, req.UserId, int(req.Code), req.Message, &req.Data)
-	return &pb.Send2UserReply{}, nil
+	online := Manager.SendMessage2LocalUserId(req.SystemId, req.MessageId, req.SendUserId, req.GroupName, req.UserId, int(req.Code), req.Message, &req.Data)
+	return &pb.Send2UserReply{Online: int32(online)}, nil
 }
 
 //获取分组在线用户列表
@@ -84,18 +90,200 @@ func (this *CommonServiceServer) GetUserClients(ctx context.Context, req *pb.Get
 	return &response, nil
 }
 
-func InitGRpcServer() {
-	go createGRPCServer(":" + setting.CommonSetting.RPCPort)
+//获取消息投递状态
+func (this *CommonServiceServer) GetMessageStatus(ctx context.Context, req *pb.GetMessageStatusReq) (*pb.GetMessageStatusReply, error) {
+	response := pb.GetMessageStatusReply{}
+	if status, ok := getLocalMessageStatus(req.SystemId, req.ClientId, req.MessageId); ok {
+		response.MessageId = status.MessageId
+		response.ClientId = status.ClientId
+		response.Status = status.Status
+		response.Retries = int32(status.Retries)
+		response.SendTime = status.SendTime
+		response.AckTime = status.AckTime
+	}
+	return &response, nil
 }
 
-func createGRPCServer(port string) {
-	lis, err := net.Listen("tcp", port)
+//读取本机保存的用户离线消息
+func (this *CommonServiceServer) PeekOfflineMessages(ctx context.Context, req *pb.PeekOfflineMessagesReq) (*pb.PeekOfflineMessagesReply, error) {
+	response := pb.PeekOfflineMessagesReply{}
+	if OfflineStore == nil {
+		return &response, nil
+	}
+
+	messages, err := OfflineStore.Peek(req.SystemId, req.UserId)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		response.List = append(response.List, &pb.OfflineMessage{
+			MessageId:  msg.MessageId,
+			SystemId:   msg.SystemId,
+			UserId:     msg.UserId,
+			SendUserId: msg.SendUserId,
+			Code:       int32(msg.Code),
+			Message:    msg.Msg,
+			Data:       msg.Data,
+			CreateTime: msg.CreateTime,
+			ExpireTime: msg.ExpireTime,
+		})
 	}
+	return &response, nil
+}
+
+//删除本机已经投递的离线消息
+func (this *CommonServiceServer) DeleteOfflineMessages(ctx context.Context, req *pb.DeleteOfflineMessagesReq) (*pb.DeleteOfflineMessagesReply, error) {
+	if OfflineStore == nil {
+		return &pb.DeleteOfflineMessagesReply{}, nil
+	}
+	if err := OfflineStore.Delete(req.SystemId, req.UserId, req.MessageIds); err != nil {
+		return nil, err
+	}
+	return &pb.DeleteOfflineMessagesReply{}, nil
+}
+
+//统计本机各系统的连接数
+func (this *CommonServiceServer) CountSystemClients(ctx context.Context, req *pb.CountSystemClientsReq) (*pb.CountSystemClientsReply, error) {
+	response := pb.CountSystemClientsReply{Counts: make(map[string]int32)}
+	for systemId, count := range Manager.CountSystemClients(req.SystemId) {
+		response.Counts[systemId] = int32(count)
+	}
+	return &response, nil
+}
+
+//从本机分组中解绑客户端
+func (this *CommonServiceServer) UnbindGroup(ctx context.Context, req *pb.UnbindGroupReq) (*pb.UnbindGroupReply, error) {
+	log.WithFields(log.Fields{
+		"host":      setting.GlobalSetting.LocalHost,
+		"port":      setting.CommonSetting.HttpPort,
+		"clientId":  req.ClientId,
+		"groupName": req.GroupName,
+	}).Info("UnbindGroup接收到RPC解绑分组")
+	delLocalClientFromGroup(req.SystemId, req.GroupName, req.ClientId)
+	return &pb.UnbindGroupReply{}, nil
+}
+
+//本机该用户的连接离开分组
+func (this *CommonServiceServer) LeaveGroup(ctx context.Context, req *pb.LeaveGroupReq) (*pb.LeaveGroupReply, error) {
+	count := delLocalUserFromGroup(req.SystemId, req.GroupName, req.UserId)
+	return &pb.LeaveGroupReply{Count: int32(count)}, nil
+}
+
+//获取本机客户端加入的分组
+func (this *CommonServiceServer) GetClientGroups(ctx context.Context, req *pb.GetClientGroupsReq) (*pb.GetClientGroupsReply, error) {
+	response := pb.GetClientGroupsReply{}
+	response.List = getLocalClientGroupList(req.SystemId, req.ClientId)
+	return &response, nil
+}
+
+//解散本机分组
+func (this *CommonServiceServer) DissolveGroup(ctx context.Context, req *pb.DissolveGroupReq) (*pb.DissolveGroupReply, error) {
+	log.WithFields(log.Fields{
+		"host":      setting.GlobalSetting.LocalHost,
+		"port":      setting.CommonSetting.HttpPort,
+		"groupName": req.GroupName,
+	}).Info("DissolveGroup接收到RPC解散分组")
+	count := dissolveLocalGroup(req.SystemId, req.MessageId, req.SendUserId, req.GroupName, req.Notify)
+	return &pb.DissolveGroupReply{Count: int32(count)}, nil
+}
 
-	s := grpc.NewServer()
+//获取本机用户的连接数和最后在线时间
+func (this *CommonServiceServer) GetPresence(ctx context.Context, req *pb.GetPresenceReq) (*pb.GetPresenceReply, error) {
+	response := pb.GetPresenceReply{}
+	for _, item := range getLocalPresence(req.SystemId, req.UserIds) {
+		response.List = append(response.List, &pb.UserPresence{
+			UserId:   item.UserId,
+			Count:    int32(item.Count),
+			LastSeen: item.LastSeen,
+		})
+	}
+	return &response, nil
+}
+
+//获取本机用户的连接和最后在线时间
+func (this *CommonServiceServer) GetUserDevices(ctx context.Context, req *pb.GetUserDevicesReq) (*pb.GetUserDevicesReply, error) {
+	devices, lastSeen := getLocalUserDevices(req.SystemId, req.UserId)
+	response := pb.GetUserDevicesReply{LastSeen: lastSeen}
+	for _, device := range devices {
+		response.List = append(response.List, &pb.Device{
+			ClientId:    device.ClientId,
+			SystemId:    device.SystemId,
+			GroupList:   device.GroupList,
+			Extend:      device.Extend,
+			ConnectTime: device.ConnectTime,
+			Node:        device.Node,
+		})
+	}
+	return &response, nil
+}
+
+//其他节点上用户的状态变化,通知本机订阅该用户的客户端
+func (this *CommonServiceServer) PresenceChanged(ctx context.Context, req *pb.PresenceChangedReq) (*pb.PresenceChangedReply, error) {
+	Subscriptions.apply(req)
+	return &pb.PresenceChangedReply{}, nil
+}
+
+//获取本机游标之后的一页成员
+func (this *CommonServiceServer) GetGroupMembers(ctx context.Context, req *pb.GetGroupMembersReq) (*pb.GetGroupMembersReply, error) {
+	members, count, userIds := getLocalMembers(req)
+	return &pb.GetGroupMembersReply{List: membersToPb(members), Count: int32(count), UserIds: userIds}, nil
+}
+
+//分批发送本机的成员,每批最多memberChunkSize个
+func (this *CommonServiceServer) StreamGroupClients(req *pb.GetGroupMembersReq, stream pb.CommonService_StreamGroupClientsServer) error {
+	members, _, _ := getLocalMembers(req)
+	for start := 0; start < len(members); start += memberChunkSize {
+		end := start + memberChunkSize
+		if end > len(members) {
+			end = len(members)
+		}
+		if err := stream.Send(&pb.GetGroupMembersReply{List: membersToPb(members[start:end])}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//记录每个方法的处理耗时
+func rpcServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	response, err := handler(ctx, req)
+	observeRPCServer(info.FullMethod, start, err)
+	return response, err
+}
+
+func rpcStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPCServer(info.FullMethod, start, err)
+	return err
+}
+
+func InitGRpcServer() *grpc.Server {
+	s := createGRPCServer()
+	go serveGRPC(s, ":"+setting.CommonSetting.RPCPort)
+	return s
+}
+
+func createGRPCServer() *grpc.Server {
+
+	s := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		//允许其他节点的连接池在空闲时发送心跳
+		MinTime:             rpcKeepaliveTime / 2,
+		PermitWithoutStream: true,
+	}), grpc.UnaryInterceptor(rpcServerInterceptor), grpc.StreamInterceptor(rpcStreamServerInterceptor))
 	pb.RegisterCommonServiceServer(s, &CommonServiceServer{})
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	return s
+}
+
+//调用Stop或GracefulStop之后Serve返回nil
+func serveGRPC(s *grpc.Server, port string) {
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		panic(err)
+	}
 
 	err = s.Serve(lis)
 	if err != nil {
@@ -1,24 +1,27 @@
 package servers
 
 import (
+	"encoding/json"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
 	"github.com/woodylan/go-websocket/tools/util"
+	"google.golang.org/grpc/status"
 	"time"
 )
 
-//channel通道
-var ToClientChan chan clientInfo
-
-//channel通道结构体
+//发送队列中的消息结构体
 type clientInfo struct {
+	SystemId   string // 发送方的系统ID,只能发送给同一系统的客户端
 	ClientId   string
 	SendUserId string
 	MessageId  string
 	Code       int
 	Msg        string
 	Data       *string
+	NeedAck    bool                       // 是否需要客户端确认
+	prepared   *websocket.PreparedMessage // 广播时所有接收者共享的已编码消息,为空时单独编码
 }
 
 type RetData struct {
@@ -32,18 +35,28 @@ type RetData struct {
 // 心跳间隔
 var heartbeatInterval = 30 * time.Second
 
-func init() {
-	ToClientChan = make(chan clientInfo, 1000)
-}
+// 单条消息写入连接的超时时间
+var writeWait = 10 * time.Second
+
+// 默认的客户端发送队列长度
+const defaultSendQueueSize = 256
+
+// 默认的调用其他节点的超时时间
+const defaultRPCTimeout = 3 * time.Second
 
 var Manager = NewClientManager() // 管理者
 
 func StartWebSocket() {
 	go Manager.Start()
+	go Acks.Start()
+	go RateLimits.Start()
+	go Presence.Start()
+	Webhooks.Start()
 }
 
-//发送信息到指定客户端
-func SendMessage2Client(clientId string, sendUserId string, code int, msg string, data *string) (messageId string) {
+//发送信息到指定客户端,needAck为true时跟踪投递状态,客户端未确认则重新投递
+func SendMessage2Client(systemId, clientId string, sendUserId string, code int, msg string, data *string, needAck bool) (messageId string) {
+	messagesSentTotal.With("client").Inc()
 	messageId = util.GenUUID()
 	if util.IsCluster() {
 		addr, _, _, isLocal, err := util.GetAddrInfoAndIsLocal(clientId)
@@ -54,19 +67,65 @@ func SendMessage2Client(clientId string, sendUserId string, code int, msg string
 
 		//如果是本机则发送到本机
 		if isLocal {
-			SendMessage2LocalClient(messageId, clientId, sendUserId, code, msg, data)
+			SendSystemMessage2LocalClient(systemId, messageId, clientId, sendUserId, code, msg, data, needAck)
 		} else {
 			//发送到指定机器
-			SendRpc2Client(addr, messageId, sendUserId, clientId, code, msg, data)
+			_ = Cluster.Send2Client(addr, &pb.Send2ClientReq{
+				SystemId:   systemId,
+				MessageId:  messageId,
+				SendUserId: sendUserId,
+				ClientId:   clientId,
+				Code:       int32(code),
+				Message:    msg,
+				Data:       *data,
+				NeedAck:    needAck,
+			})
 		}
 	} else {
 		//如果是单机服务，则只发送到本机
-		SendMessage2LocalClient(messageId, clientId, sendUserId, code, msg, data)
+		SendSystemMessage2LocalClient(systemId, messageId, clientId, sendUserId, code, msg, data, needAck)
+	}
+
+	return
+}
+
+//获取发送给指定客户端的消息的投递状态
+func GetMessageStatus(systemId, clientId, messageId string) (status MessageStatus, ok bool) {
+	if util.IsCluster() {
+		addr, _, _, isLocal, err := util.GetAddrInfoAndIsLocal(clientId)
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+
+		//如果是本机则查询本机
+		if isLocal {
+			status, ok = getLocalMessageStatus(systemId, clientId, messageId)
+		} else {
+			//查询指定机器
+			status, ok = Cluster.GetMessageStatus(addr, &pb.GetMessageStatusReq{
+				SystemId:  systemId,
+				ClientId:  clientId,
+				MessageId: messageId,
+			})
+		}
+	} else {
+		//如果是单机服务，则只查询本机
+		status, ok = getLocalMessageStatus(systemId, clientId, messageId)
 	}
 
 	return
 }
 
+//查询本机的消息投递状态,只能查询本系统发送的消息
+func getLocalMessageStatus(systemId, clientId, messageId string) (MessageStatus, bool) {
+	status, ok := Acks.Get(messageId)
+	if !ok || status.ClientId != clientId || status.message.SystemId != systemId {
+		return MessageStatus{}, false
+	}
+	return status, true
+}
+
 //关闭客户端
 func CloseClient(clientId, systemId string) {
 	if util.IsCluster() {
@@ -81,7 +140,10 @@ func CloseClient(clientId, systemId string) {
 			CloseLocalClient(clientId, systemId)
 		} else {
 			//发送到指定机器
-			CloseRpcClient(addr, clientId, systemId)
+			_ = Cluster.CloseClient(addr, &pb.CloseClientReq{
+				SystemId: systemId,
+				ClientId: clientId,
+			})
 		}
 	} else {
 		//如果是单机服务，则只发送到本机
@@ -91,119 +153,265 @@ func CloseClient(clientId, systemId string) {
 	return
 }
 
-//添加客户端到分组
-func AddClient2Group(systemId string, groupName string, clientId string, userId string, extend string) {
+//添加客户端到分组,超过系统的分组数上限时返回ErrTooManyGroups
+func AddClient2Group(systemId string, groupName string, clientId string, userId string, extend string) error {
 	//如果是集群则用redis共享数据
 	if util.IsCluster() {
 		//判断key是否存在
 		addr, _, _, isLocal, err := util.GetAddrInfoAndIsLocal(clientId)
 		if err != nil {
 			log.Errorf("%s", err)
-			return
+			return nil
 		}
 
 		if isLocal {
 			if client, err := Manager.GetByClientId(clientId); err == nil {
 				//添加到本地
-				Manager.AddClient2LocalGroup(groupName, client, userId, extend)
+				return addLocalClient2Group(systemId, groupName, client, userId, extend)
 			} else {
 				log.Error(err)
 			}
 		} else {
 			//发送到指定的机器
-			SendRpcBindGroup(addr, systemId, groupName, clientId, userId, extend)
+			err = Cluster.BindGroup(addr, &pb.BindGroupReq{
+				SystemId:  systemId,
+				GroupName: groupName,
+				ClientId:  clientId,
+				UserId:    userId,
+				Extend:    extend,
+			})
+			//其他节点返回的错误只保留了错误信息
+			if err != nil && status.Convert(err).Message() == ErrTooManyGroups.Error() {
+				return ErrTooManyGroups
+			}
 		}
 	} else {
 		if client, err := Manager.GetByClientId(clientId); err == nil {
 			//如果是单机，就直接添加到本地group了
-			Manager.AddClient2LocalGroup(groupName, client, userId, extend)
+			return addLocalClient2Group(systemId, groupName, client, userId, extend)
 		}
 	}
+	return nil
+}
+
+//只能绑定同一系统的客户端
+func addLocalClient2Group(systemId, groupName string, client *Client, userId, extend string) error {
+	if client.SystemId != systemId {
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"systemId": systemId,
+			"clientId": client.ClientId,
+		}).Warn("客户端不属于该系统,忽略绑定分组")
+		return nil
+	}
+	if !getSystemPolicy(systemId).allowGroup(client, groupName) {
+		log.WithFields(log.Fields{
+			"host":      setting.GlobalSetting.LocalHost,
+			"port":      setting.CommonSetting.HttpPort,
+			"systemId":  systemId,
+			"clientId":  client.ClientId,
+			"groupName": groupName,
+		}).Warn("客户端的分组数超过系统上限,忽略绑定分组")
+		return ErrTooManyGroups
+	}
+	Manager.AddClient2LocalGroup(groupName, client, userId, extend)
+	return nil
 }
 
-//发送信息到指定分组
-func SendMessage2Group(systemId, sendUserId, groupName string, code int, msg string, data *string) (messageId string) {
+//发送信息到指定分组,返回各节点的发送结果
+func SendMessage2Group(systemId, sendUserId, groupName string, code int, msg string, data *string) (messageId string, result BroadcastResult) {
+	messagesSentTotal.With("group").Inc()
 	messageId = util.GenUUID()
 	if util.IsCluster() {
 		//发送分组消息给指定广播
-		go SendGroupBroadcast(systemId, messageId, sendUserId, groupName, code, msg, data)
+		result = Cluster.Send2Group(&pb.Send2GroupReq{
+			SystemId:   systemId,
+			MessageId:  messageId,
+			SendUserId: sendUserId,
+			GroupName:  groupName,
+			Code:       int32(code),
+			Message:    msg,
+			Data:       *data,
+		})
 	} else {
 		//如果是单机服务，则只发送到本机
 		Manager.SendMessage2LocalGroup(systemId, messageId, sendUserId, groupName, code, msg, data)
+		result = localResult()
 	}
 	return
 }
 
-//发送信息到指定用户
-func SendMessage2User(systemId, sendUserId, groupName, userId string, code int, msg string, data *string) (messageId string) {
+//发送信息到指定用户,返回各节点的发送结果
+func SendMessage2User(systemId, sendUserId, groupName, userId string, code int, msg string, data *string) (messageId string, result BroadcastResult) {
+	messagesSentTotal.With("user").Inc()
 	messageId = util.GenUUID()
 	if util.IsCluster() {
-		//发送用户消息给指定广播
-		go SendUserBroadcast(systemId, messageId, sendUserId, groupName, userId, code, msg, data)
+		//发送用户消息给指定广播,所有机器上都没有该用户的连接则保存为离线消息
+		var online int
+		online, result = Cluster.Send2User(&pb.Send2UserReq{
+			SystemId:   systemId,
+			MessageId:  messageId,
+			SendUserId: sendUserId,
+			GroupName:  groupName,
+			UserId:     userId,
+			Code:       int32(code),
+			Message:    msg,
+			Data:       *data,
+		})
+		//有节点调用失败时无法确定用户是否在线,不保存离线消息
+		if online == 0 && len(result.Failed) == 0 {
+			saveOfflineMessage(systemId, userId, messageId, sendUserId, code, msg, data)
+		}
 	} else {
 		//如果是单机服务，则只发送到本机
-		Manager.SendMessage2LocalUserId(systemId, messageId, sendUserId, groupName, userId, code, msg, data)
+		if Manager.SendMessage2LocalUserId(systemId, messageId, sendUserId, groupName, userId, code, msg, data) == 0 {
+			saveOfflineMessage(systemId, userId, messageId, sendUserId, code, msg, data)
+		}
+		result = localResult()
 	}
 	return
 }
 
-//发送信息到指定系统
-func SendMessage2System(systemId, sendUserId string, code int, msg string, data string) {
+//发送信息到指定系统,返回各节点的发送结果
+func SendMessage2System(systemId, sendUserId string, code int, msg string, data string) (result BroadcastResult) {
+	messagesSentTotal.With("system").Inc()
 	messageId := util.GenUUID()
 	if util.IsCluster() {
 		//发送到系统广播
-		SendSystemBroadcast(systemId, messageId, sendUserId, code, msg, &data)
+		result = Cluster.Send2System(&pb.Send2SystemReq{
+			SystemId:   systemId,
+			MessageId:  messageId,
+			SendUserId: sendUserId,
+			Code:       int32(code),
+			Message:    msg,
+			Data:       data,
+		})
 	} else {
 		//如果是单机服务，则只发送到本机
 		Manager.SendMessage2LocalSystem(systemId, messageId, sendUserId, code, msg, &data)
+		result = localResult()
 	}
+	return
 }
 
-//获取分组列表
-func GetOnlineList(systemId *string, groupName *string) map[string]interface{} {
-	var clientList []string
-	if util.IsCluster() {
-		//发送到系统广播
-		clientList = GetOnlineListBroadcast(systemId, groupName)
-	} else {
-		//如果是单机服务，则只发送到本机
-		retList := Manager.GetGroupClientList(util.GenGroupKey(*systemId, *groupName))
-		clientList = append(clientList, retList...)
-	}
+//获取分组列表,detail为false时列表中只返回clientId
+func GetOnlineList(query MemberQuery, detail bool) map[string]interface{} {
+	page := GetMembers(query)
 
+	var list interface{} = page.List
+	if !detail {
+		clientList := make([]string, 0, len(page.List))
+		for _, member := range page.List {
+			clientList = append(clientList, member.ClientId)
+		}
+		list = clientList
+	}
 	return map[string]interface{}{
-		"count": len(clientList),
-		"list":  clientList,
+		"count":      page.Count,
+		"list":       list,
+		"nextCursor": page.NextCursor,
 	}
 }
 
-//获取用户客户端连接列表
-func GetUserList(systemId, groupName, userId *string) map[string]interface{} {
-	var clientList []string
+//获取分组中所有在线的客户端
+func getGroupClients(systemId, groupName string) (clientList []string) {
 	if util.IsCluster() {
 		//发送到系统广播
-		clientList = GetUserListBroadcast(systemId, groupName, userId)
+		clientList = Cluster.GetGroupClients(&pb.GetGroupClientsReq{
+			SystemId:  systemId,
+			GroupName: groupName,
+		})
 	} else {
 		//如果是单机服务，则只发送到本机
-		retList := Manager.GetSystemGroupUserClients(*systemId, *groupName, *userId)
+		retList := Manager.GetGroupClientList(util.GenGroupKey(systemId, groupName))
 		clientList = append(clientList, retList...)
 	}
+	return
+}
 
+//获取用户客户端连接列表,detail为false时列表中返回systemId:groupName:clientId
+func GetUserList(query MemberQuery, detail bool) map[string]interface{} {
+	page := GetMembers(query)
+
+	var list interface{} = page.List
+	if !detail {
+		clientList := make([]string, 0, len(page.List))
+		for _, member := range page.List {
+			groupList := member.GroupList
+			if len(query.GroupName) > 0 {
+				groupList = []string{query.GroupName}
+			}
+			if len(groupList) == 0 {
+				clientList = append(clientList, util.GenUserClientKey(query.SystemId, "", member.ClientId))
+			}
+			for _, groupName := range groupList {
+				clientList = append(clientList, util.GenUserClientKey(query.SystemId, groupName, member.ClientId))
+			}
+		}
+		list = clientList
+	}
 	return map[string]interface{}{
-		"count": len(clientList),
-		"list":  clientList,
+		"count":      page.Count,
+		"list":       list,
+		"nextCursor": page.NextCursor,
 	}
 }
 
 //通过本服务器发送信息
 func SendMessage2LocalClient(messageId, clientId string, sendUserId string, code int, msg string, data *string) {
+	send2LocalClient(clientInfo{ClientId: clientId, MessageId: messageId, SendUserId: sendUserId, Code: code, Msg: msg, Data: data})
+}
+
+//通过本服务器发送指定系统的信息,needAck为true时需要客户端确认
+func SendSystemMessage2LocalClient(systemId, messageId, clientId string, sendUserId string, code int, msg string, data *string, needAck bool) {
+	if !checkClientSystem(clientId, systemId) {
+		log.WithFields(log.Fields{
+			"host":      setting.GlobalSetting.LocalHost,
+			"port":      setting.CommonSetting.HttpPort,
+			"systemId":  systemId,
+			"clientId":  clientId,
+			"messageId": messageId,
+		}).Warn("客户端不属于该系统,拒绝发送")
+		return
+	}
+
+	info := clientInfo{SystemId: systemId, ClientId: clientId, MessageId: messageId, SendUserId: sendUserId, Code: code, Msg: msg, Data: data, NeedAck: needAck}
+	if needAck {
+		Acks.Track(info)
+	}
+	send2LocalClient(info)
+}
+
+func send2LocalClient(info clientInfo) {
 	log.WithFields(log.Fields{
 		"host":     setting.GlobalSetting.LocalHost,
 		"port":     setting.CommonSetting.HttpPort,
-		"clientId": clientId,
-	}).Info("SendMessage2LocalClient发送到通道")
-	ToClientChan <- clientInfo{ClientId: clientId, MessageId: messageId, SendUserId: sendUserId, Code: code, Msg: msg, Data: data}
-	return
+		"clientId": info.ClientId,
+	}).Info("SendMessage2LocalClient发送到客户端队列")
+	if conn, err := Manager.GetByClientId(info.ClientId); err == nil && conn != nil {
+		conn.Send(info)
+	} else if len(info.SystemId) > 0 {
+		if info.NeedAck {
+			Acks.Offline(info.MessageId)
+		}
+		//发送给指定客户端的消息,客户端刚刚断开,则保存为该用户的离线消息
+		if recent, ok := recentClients.Load(info.ClientId); ok {
+			recent := recent.(recentClient)
+			saveOfflineMessage(recent.SystemId, recent.UserId, info.MessageId, info.SendUserId, info.Code, info.Msg, info.Data)
+		}
+	}
+}
+
+//客户端是否属于该系统,刚刚断开的客户端按断开前的系统判断
+func checkClientSystem(clientId, systemId string) bool {
+	if conn, err := Manager.GetByClientId(clientId); err == nil && conn != nil {
+		return conn.SystemId == systemId
+	}
+	if recent, ok := recentClients.Load(clientId); ok {
+		return recent.(recentClient).SystemId == systemId
+	}
+	return true
 }
 
 //发送关闭信号
@@ -212,7 +420,7 @@ func CloseLocalClient(clientId, systemId string) {
 		if conn.SystemId != systemId {
 			return
 		}
-		Manager.DisConnect <- conn
+		conn.Kick()
 		log.WithFields(log.Fields{
 			"host":     setting.GlobalSetting.LocalHost,
 			"port":     setting.CommonSetting.HttpPort,
@@ -222,34 +430,6 @@ func CloseLocalClient(clientId, systemId string) {
 	return
 }
 
-//监听并发送给客户端信息
-func WriteMessage() {
-	for {
-		clientInfo := <-ToClientChan
-		log.WithFields(log.Fields{
-			"host":       setting.GlobalSetting.LocalHost,
-			"port":       setting.CommonSetting.HttpPort,
-			"clientId":   clientInfo.ClientId,
-			"messageId":  clientInfo.MessageId,
-			"sendUserId": clientInfo.SendUserId,
-			"code":       clientInfo.Code,
-			"msg":        clientInfo.Msg,
-			"data":       clientInfo.Data,
-		}).Info("WriteMessage发送到本机")
-		if conn, err := Manager.GetByClientId(clientInfo.ClientId); err == nil && conn != nil {
-			if err := Render(conn.Socket, clientInfo.MessageId, clientInfo.SendUserId, clientInfo.Code, clientInfo.Msg, clientInfo.Data); err != nil {
-				Manager.DisConnect <- conn
-				log.WithFields(log.Fields{
-					"host":     setting.GlobalSetting.LocalHost,
-					"port":     setting.CommonSetting.HttpPort,
-					"clientId": clientInfo.ClientId,
-					"msg":      clientInfo.Msg,
-				}).Error("WriteMessage客户端异常离线：" + err.Error())
-			}
-		}
-	}
-}
-
 func Render(conn *websocket.Conn, messageId string, sendUserId string, code int, message string, data interface{}) error {
 	return conn.WriteJSON(RetData{
 		Code:       code,
@@ -260,6 +440,28 @@ func Render(conn *websocket.Conn, messageId string, sendUserId string, code int,
 	})
 }
 
+//广播的消息只编码一次,压缩后的帧也由所有开启压缩的连接共享
+func prepareMessage(messageId string, sendUserId string, code int, message string, data interface{}) *websocket.PreparedMessage {
+	payload, err := json.Marshal(RetData{
+		Code:       code,
+		MessageId:  messageId,
+		SendUserId: sendUserId,
+		Msg:        message,
+		Data:       data,
+	})
+	if err != nil {
+		return nil
+	}
+	//与WriteJSON的输出保持一致
+	payload = append(payload, '\n')
+
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, payload)
+	if err != nil {
+		return nil
+	}
+	return prepared
+}
+
 //启动定时器进行心跳检测
 func PingTimer() {
 	go func() {
@@ -269,9 +471,13 @@ func PingTimer() {
 			<-ticker.C
 			//发送心跳
 			for clientId, conn := range Manager.AllClient() {
+				if conn.isSuspended() {
+					continue //跳过,连接已断开等待恢复会话
+				}
 				if err := conn.Socket.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(heartbeatInterval/2)); err != nil {
 					//发送心跳请求,如果心跳请求在心跳间隔时间的一半时间之内还没有成功响应，则关闭连接
-					Manager.DisConnect <- conn
+					heartbeatFailuresTotal.With().Inc()
+					conn.disconnect(DisconnectHeartbeat)
 					log.Errorf("PingTimer发送心跳失败,和客户端[ %s ]的连接将主动关闭; 当前总连接数：%d", clientId, Manager.Count())
 				} //else {
 				//	log.Infof("PingTimer发送心跳成功: %s 总连接数：%d", clientId, Manager.Count())
@@ -0,0 +1,134 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 默认的客户端重连的最大随机延迟
+const defaultDrainWindow = 10 * time.Second
+
+// 关闭过程中检查客户端和发送队列的间隔
+var drainPollInterval = 100 * time.Millisecond
+
+// 是否正在关闭,关闭期间拒绝新的连接,断开的连接不保留会话
+var draining int32
+
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+//重连通知中的数据
+type reconnectData struct {
+	Delay int64 `json:"delay"` // 客户端等待多少毫秒之后重连
+}
+
+//客户端重连的最大随机延迟,避免所有客户端同时重连到其他服务器
+func drainWindow() time.Duration {
+	if setting.CommonSetting.DrainWindow > 0 {
+		return time.Duration(setting.CommonSetting.DrainWindow) * time.Second
+	}
+	return defaultDrainWindow
+}
+
+//本机还在连接中的客户端,不包括等待恢复会话的
+func activeClients() []*Client {
+	Manager.ClientIdMapLock.RLock()
+	defer Manager.ClientIdMapLock.RUnlock()
+
+	clients := make([]*Client, 0, len(Manager.ClientIdMap))
+	for _, client := range Manager.ClientIdMap {
+		if !client.isSuspended() {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+//等待条件成立,超时返回false
+func waitUntil(ctx context.Context, deadline time.Time, done func() bool) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+//开始关闭:拒绝新的连接,通知所有客户端在随机延迟之后重连到其他服务器,等待客户端自行断开
+func Drain(ctx context.Context) {
+	atomic.StoreInt32(&draining, 1)
+
+	window := drainWindow()
+	clients := activeClients()
+	for _, client := range clients {
+		delay := time.Duration(rand.Int63n(int64(window)))
+		data, _ := json.Marshal(reconnectData{Delay: int64(delay / time.Millisecond)})
+		message := string(data)
+		client.Send(clientInfo{
+			ClientId: client.ClientId,
+			Code:     retcode.ReconnectCode,
+			Msg:      "服务器即将关闭,请重新连接",
+			Data:     &message,
+		})
+	}
+
+	log.WithFields(log.Fields{
+		"host":   setting.GlobalSetting.LocalHost,
+		"port":   setting.CommonSetting.HttpPort,
+		"counts": len(clients),
+	}).Info("通知客户端重新连接")
+
+	//最晚的客户端也已经开始重连时不再等待
+	waitUntil(ctx, time.Now().Add(window), func() bool {
+		return len(activeClients()) == 0
+	})
+}
+
+//等待发送队列中的消息写入连接之后,以1001关闭剩余的连接
+func CloseClients(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(drainWindow())
+	}
+
+	waitUntil(ctx, deadline, func() bool {
+		for _, client := range activeClients() {
+			if len(client.sendChan) > 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	clients := activeClients()
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+	for _, client := range clients {
+		_ = client.Socket.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+		client.kick(DisconnectShutdown)
+	}
+
+	log.WithFields(log.Fields{
+		"host":   setting.GlobalSetting.LocalHost,
+		"port":   setting.CommonSetting.HttpPort,
+		"counts": len(clients),
+	}).Info("关闭所有客户端连接")
+
+	waitUntil(ctx, deadline, func() bool {
+		return Manager.Count() == 0
+	})
+}
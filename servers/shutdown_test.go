@@ -0,0 +1,75 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	resetSetting()
+	setting.CommonSetting.DrainWindow = 1
+	_, _ = Register("shutdownSystem", RegisterOptions{})
+	defer SystemMap.Delete("shutdownSystem")
+	defer atomic.StoreInt32(&draining, 0)
+	StartWebSocket()
+
+	s := httptest.NewServer(http.HandlerFunc((&Controller{}).Run))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?systemId=shutdownSystem"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var first resumeRender
+	_ = conn.ReadJSON(&first)
+
+	Convey("测试关闭服务器", t, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		Drain(ctx)
+		So(IsDraining(), ShouldBeTrue)
+
+		Convey("通知客户端在随机延迟之后重新连接", func() {
+			var message RetData
+			So(conn.ReadJSON(&message), ShouldBeNil)
+			So(message.Code, ShouldEqual, retcode.ReconnectCode)
+
+			data := reconnectData{}
+			So(json.Unmarshal([]byte(message.Data.(string)), &data), ShouldBeNil)
+			So(data.Delay, ShouldBeBetweenOrEqual, 0, 1000)
+		})
+
+		Convey("拒绝新的连接", func() {
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			So(err, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("以1001关闭剩余的连接", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			CloseClients(ctx)
+
+			var err error
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			So(websocket.IsCloseError(err, websocket.CloseGoingAway), ShouldBeTrue)
+
+			_, err = Manager.GetByClientId(first.Data.ClientId)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,228 @@
+package servers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sync"
+	"time"
+)
+
+var ErrTooManySubscriptions = errors.New("订阅的用户数超过上限")
+
+// 本机有客户端订阅的用户,以及该用户在各节点上的状态
+type watchedUser struct {
+	systemId string
+	userId   string
+	clients  map[string]struct{}     // 本机订阅该用户的clientId
+	nodes    map[string]nodePresence // 节点地址 -> 用户在该节点上的状态
+}
+
+// 用户在一个节点上是否有连接,seq用来丢弃乱序到达的旧状态
+type nodePresence struct {
+	online bool
+	seq    uint64
+}
+
+//在任意一个节点上有连接即为在线
+func (w *watchedUser) online() bool {
+	for _, n := range w.nodes {
+		if n.online {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端对用户上下线的订阅
+// 每个节点在本机第一个连接建立和最后一个连接断开时广播用户在本机的状态,
+// 订阅方所在的节点汇总各节点的状态,只在用户整体上线或下线时通知订阅的客户端
+type PresenceSubscriptions struct {
+	lock    sync.Mutex
+	watched map[string]*watchedUser    // systemId/userId -> 被订阅的用户
+	clients map[string]map[string]bool // clientId -> 订阅的systemId/userId
+	local   map[string]int             // systemId/userId -> 用户在本机的连接数
+	seq     uint64                     // 本机最后一次广播的序号
+}
+
+var Subscriptions = NewPresenceSubscriptions()
+
+func NewPresenceSubscriptions() *PresenceSubscriptions {
+	return &PresenceSubscriptions{
+		watched: make(map[string]*watchedUser),
+		clients: make(map[string]map[string]bool),
+		local:   make(map[string]int),
+	}
+}
+
+func presenceKey(systemId, userId string) string {
+	return systemId + "/" + userId
+}
+
+//订阅同一系统中用户的上下线,返回这些用户当前的在线状态
+func (s *PresenceSubscriptions) Subscribe(client *Client, userIds []string) ([]UserPresence, error) {
+	userIds = uniqueStrings(userIds)
+
+	s.lock.Lock()
+	subscribed := s.clients[client.ClientId]
+	added := 0
+	for _, userId := range userIds {
+		if !subscribed[presenceKey(client.SystemId, userId)] {
+			added++
+		}
+	}
+	if max := setting.PresenceSetting.MaxSubscriptions; max > 0 && len(subscribed)+added > max {
+		s.lock.Unlock()
+		return nil, ErrTooManySubscriptions
+	}
+
+	if subscribed == nil {
+		subscribed = make(map[string]bool)
+		s.clients[client.ClientId] = subscribed
+	}
+	for _, userId := range userIds {
+		key := presenceKey(client.SystemId, userId)
+		subscribed[key] = true
+		w := s.watched[key]
+		if w == nil {
+			w = &watchedUser{
+				systemId: client.SystemId,
+				userId:   userId,
+				clients:  make(map[string]struct{}),
+				nodes:    make(map[string]nodePresence),
+			}
+			s.watched[key] = w
+		}
+		w.clients[client.ClientId] = struct{}{}
+	}
+	s.lock.Unlock()
+
+	//先登记再查询,查询期间到达的状态变化不会丢失,查询结果只补充还没有状态的节点
+	list := queryPresence(client.SystemId, userIds)
+	s.lock.Lock()
+	for _, item := range list {
+		w := s.watched[presenceKey(client.SystemId, item.UserId)]
+		if w == nil {
+			continue //已经取消订阅
+		}
+		if _, ok := w.nodes[item.node]; !ok && item.Count > 0 {
+			w.nodes[item.node] = nodePresence{online: true}
+		}
+	}
+	s.lock.Unlock()
+
+	return mergePresence(userIds, list), nil
+}
+
+//取消订阅,userIds为空时取消该客户端所有的订阅
+func (s *PresenceSubscriptions) Unsubscribe(client *Client, userIds []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	subscribed := s.clients[client.ClientId]
+	keys := make([]string, 0, len(userIds))
+	if len(userIds) == 0 {
+		for key := range subscribed {
+			keys = append(keys, key)
+		}
+	} else {
+		for _, userId := range userIds {
+			keys = append(keys, presenceKey(client.SystemId, userId))
+		}
+	}
+
+	for _, key := range keys {
+		delete(subscribed, key)
+		if w, ok := s.watched[key]; ok {
+			delete(w.clients, client.ClientId)
+			if len(w.clients) == 0 {
+				delete(s.watched, key)
+			}
+		}
+	}
+	if len(subscribed) == 0 {
+		delete(s.clients, client.ClientId)
+	}
+}
+
+//用户在本机的连接数变化,在0和非0之间变化时广播到所有节点
+func (s *PresenceSubscriptions) localChanged(systemId, userId string, delta int) {
+	key := presenceKey(systemId, userId)
+
+	s.lock.Lock()
+	before := s.local[key]
+	after := before + delta
+	if after > 0 {
+		s.local[key] = after
+	} else {
+		delete(s.local, key)
+	}
+	if (before > 0) == (after > 0) {
+		s.lock.Unlock()
+		return
+	}
+	//使用时间作为序号,重启之后的序号也比之前的大
+	seq := uint64(time.Now().UnixNano())
+	if seq <= s.seq {
+		seq = s.seq + 1
+	}
+	s.seq = seq
+	s.lock.Unlock()
+
+	req := &pb.PresenceChangedReq{
+		SystemId: systemId,
+		UserId:   userId,
+		Node:     localRPCAddr(),
+		Online:   after > 0,
+		Seq:      seq,
+	}
+	if util.IsCluster() {
+		go Cluster.PresenceChanged(req)
+	} else {
+		s.apply(req)
+	}
+}
+
+//更新用户在一个节点上的状态,用户整体上线或下线时通知本机订阅的客户端
+func (s *PresenceSubscriptions) apply(req *pb.PresenceChangedReq) {
+	s.lock.Lock()
+	w := s.watched[presenceKey(req.SystemId, req.UserId)]
+	if w == nil {
+		s.lock.Unlock()
+		return //本机没有客户端订阅该用户
+	}
+	if last, ok := w.nodes[req.Node]; ok && last.seq >= req.Seq {
+		s.lock.Unlock()
+		return //乱序到达的旧状态
+	}
+
+	before := w.online()
+	w.nodes[req.Node] = nodePresence{online: req.Online, seq: req.Seq}
+	after := w.online()
+	clientIds := make([]string, 0, len(w.clients))
+	for clientId := range w.clients {
+		clientIds = append(clientIds, clientId)
+	}
+	s.lock.Unlock()
+
+	if before == after {
+		return
+	}
+
+	code, msg := retcode.UserOnLineCode, "用户上线"
+	if !after {
+		code, msg = retcode.UserOffLineCode, "用户下线"
+	}
+	mJson, _ := json.Marshal(map[string]string{
+		"systemId": req.SystemId,
+		"userId":   req.UserId,
+	})
+	data := string(mJson)
+	messageId := util.GenUUID()
+	for _, clientId := range clientIds {
+		SendMessage2LocalClient(messageId, clientId, "", code, msg, &data)
+	}
+}
@@ -0,0 +1,97 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/define/retcode"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"testing"
+)
+
+func TestPresenceSubscriptions(t *testing.T) {
+	resetSetting()
+
+	conn, closeServer := newTestConn(t)
+	defer closeServer()
+
+	Convey("测试订阅用户的上下线", t, func() {
+		systemId := "subSystem"
+		watcher := NewClient("subWatcher", systemId, false, conn)
+		first := NewClient("subFirst", systemId, false, conn)
+		second := NewClient("subSecond", systemId, false, conn)
+		for _, client := range []*Client{watcher, first, second} {
+			Manager.AddClient(client)
+		}
+		Manager.AddClient2LocalGroup("room", first, "subUser", "")
+
+		Convey("订阅时返回当前的在线状态", func() {
+			list, err := Subscriptions.Subscribe(watcher, []string{"subUser", "otherUser", "subUser"})
+			So(err, ShouldBeNil)
+			So(list, ShouldResemble, []UserPresence{
+				{UserId: "subUser", Online: true, Count: 1},
+				{UserId: "otherUser"},
+			})
+		})
+
+		Convey("用户的多个连接只通知一次上下线", func() {
+			_, err := Subscriptions.Subscribe(watcher, []string{"otherUser"})
+			So(err, ShouldBeNil)
+
+			Manager.AddClient2LocalGroup("room", second, "otherUser", "")
+			Manager.AddClient2LocalGroup("lobby", first, "otherUser", "")
+			So((<-watcher.sendChan).Code, ShouldEqual, retcode.UserOnLineCode)
+			So(watcher.sendChan, ShouldBeEmpty)
+
+			Manager.DelClient(second)
+			So(watcher.sendChan, ShouldBeEmpty)
+			Manager.DelClient(first)
+			So((<-watcher.sendChan).Code, ShouldEqual, retcode.UserOffLineCode)
+		})
+
+		Convey("忽略乱序到达的旧状态", func() {
+			_, err := Subscriptions.Subscribe(watcher, []string{"remoteUser"})
+			So(err, ShouldBeNil)
+
+			Subscriptions.apply(&pb.PresenceChangedReq{SystemId: systemId, UserId: "remoteUser", Node: "remote", Online: true, Seq: 5})
+			So((<-watcher.sendChan).Code, ShouldEqual, retcode.UserOnLineCode)
+			Subscriptions.apply(&pb.PresenceChangedReq{SystemId: systemId, UserId: "remoteUser", Node: "remote", Online: false, Seq: 3})
+			So(watcher.sendChan, ShouldBeEmpty)
+			Subscriptions.apply(&pb.PresenceChangedReq{SystemId: systemId, UserId: "remoteUser", Node: "remote", Online: false, Seq: 6})
+			So((<-watcher.sendChan).Code, ShouldEqual, retcode.UserOffLineCode)
+		})
+
+		Convey("订阅的用户数", func() {
+			setting.PresenceSetting.MaxSubscriptions = 2
+			_, err := Subscriptions.Subscribe(watcher, []string{"a", "b"})
+			So(err, ShouldBeNil)
+			//重复订阅不计数
+			_, err = Subscriptions.Subscribe(watcher, []string{"a"})
+			So(err, ShouldBeNil)
+			_, err = Subscriptions.Subscribe(watcher, []string{"c"})
+			So(err, ShouldEqual, ErrTooManySubscriptions)
+		})
+
+		Convey("取消订阅后不再通知", func() {
+			_, err := Subscriptions.Subscribe(watcher, []string{"remoteUser", "otherUser"})
+			So(err, ShouldBeNil)
+			Subscriptions.Unsubscribe(watcher, []string{"remoteUser"})
+			Subscriptions.apply(&pb.PresenceChangedReq{SystemId: systemId, UserId: "remoteUser", Node: "remote", Online: true, Seq: 1})
+			So(watcher.sendChan, ShouldBeEmpty)
+
+			//连接断开时取消所有的订阅
+			Manager.DelClient(watcher)
+			So(Subscriptions.clients, ShouldNotContainKey, "subWatcher")
+			So(Subscriptions.watched, ShouldNotContainKey, presenceKey(systemId, "otherUser"))
+		})
+
+		Reset(func() {
+			for _, client := range []*Client{watcher, first, second} {
+				Manager.DelClient(client)
+			}
+			for len(watcher.sendChan) > 0 {
+				<-watcher.sendChan
+			}
+			resetSetting()
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package servers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/etcd"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/servers/pb"
+	"github.com/woodylan/go-websocket/tools/util"
+	"sort"
+	"time"
+)
+
+// 管理接口返回的系统信息,不包含密钥
+type SystemInfo struct {
+	SystemId       string       `json:"systemId"`
+	Status         string       `json:"status"`
+	RegisterTime   int64        `json:"registerTime"`
+	OfflineMessage bool         `json:"offlineMessage"`
+	OfflineTTL     int64        `json:"offlineTTL"`
+	RequireToken   bool         `json:"requireToken"`
+	Policy         SystemPolicy `json:"policy"`
+	Webhook        Webhook      `json:"webhook"`
+	ApiKeys        []ApiKeyInfo `json:"apiKeys,omitempty"` // 只在查询单个系统时返回
+	Clients        int          `json:"clients"`           // 集群中的在线连接数
+}
+
+// API密钥的公开信息
+type ApiKeyInfo struct {
+	ApiKey     string `json:"apiKey"`
+	CreateTime int64  `json:"createTime"`
+	ExpireTime int64  `json:"expireTime"`
+}
+
+// 修改系统配置,为nil的字段保持不变
+type UpdateOptions struct {
+	OfflineMessage *bool
+	OfflineTTL     *int64
+	RequireToken   *bool
+	Policy         *SystemPolicy // 整体替换系统的策略
+	Webhook        *Webhook      // 整体替换回调配置,密钥为空时保留原来的密钥
+}
+
+func (a accountInfo) info(clients int) SystemInfo {
+	status := a.Status
+	if len(status) == 0 {
+		status = SystemStatusActive
+	}
+	return SystemInfo{
+		SystemId:       a.SystemId,
+		Status:         status,
+		RegisterTime:   a.RegisterTime,
+		OfflineMessage: a.OfflineMessage,
+		OfflineTTL:     a.OfflineTTL,
+		RequireToken:   a.RequireToken,
+		Policy:         a.Policy,
+		Webhook:        a.Webhook,
+		Clients:        clients,
+	}
+}
+
+//统计各系统的在线连接数,集群模式下汇总所有节点
+func countSystemClients(systemId string) map[string]int {
+	if util.IsCluster() {
+		return Cluster.CountSystemClients(&pb.CountSystemClientsReq{SystemId: systemId})
+	}
+	return Manager.CountSystemClients(systemId)
+}
+
+//获取所有系统,按系统ID排序
+func ListSystems() ([]SystemInfo, error) {
+	var accounts []accountInfo
+	if util.IsCluster() {
+		resp, err := etcd.GetPrefix(define.ETcdPrefixAccountInfo)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			if account, ok := parseAccount(kv); ok {
+				accounts = append(accounts, account)
+			}
+		}
+	} else {
+		SystemMap.Range(func(key, value interface{}) bool {
+			accounts = append(accounts, value.(accountInfo))
+			return true
+		})
+	}
+
+	counts := countSystemClients("")
+	systems := make([]SystemInfo, 0, len(accounts))
+	for _, account := range accounts {
+		systems = append(systems, account.info(counts[account.SystemId]))
+	}
+	sort.Slice(systems, func(i, j int) bool {
+		return systems[i].SystemId < systems[j].SystemId
+	})
+	return systems, nil
+}
+
+//获取系统的详细信息和API密钥列表
+func DescribeSystem(systemId string) (SystemInfo, error) {
+	account, err := loadAccountInfo(systemId)
+	if err != nil {
+		return SystemInfo{}, err
+	}
+
+	info := account.info(countSystemClients(systemId)[systemId])
+	now := time.Now().Unix()
+	for _, key := range account.ApiKeys {
+		if !key.expired(now) {
+			info.ApiKeys = append(info.ApiKeys, ApiKeyInfo{ApiKey: key.Key, CreateTime: key.CreateTime, ExpireTime: key.ExpireTime})
+		}
+	}
+	return info, nil
+}
+
+//修改系统的配置
+func UpdateSystem(systemId string, options UpdateOptions) (SystemInfo, error) {
+	if options.Policy != nil {
+		if err := options.Policy.validate(); err != nil {
+			return SystemInfo{}, err
+		}
+	}
+	if options.Webhook != nil {
+		if err := options.Webhook.validate(); err != nil {
+			return SystemInfo{}, err
+		}
+	}
+	return modifySystem(systemId, func(account *accountInfo) {
+		if options.OfflineMessage != nil {
+			account.OfflineMessage = *options.OfflineMessage
+		}
+		if options.OfflineTTL != nil {
+			account.OfflineTTL = *options.OfflineTTL
+		}
+		if options.RequireToken != nil {
+			account.RequireToken = *options.RequireToken
+		}
+		if options.Policy != nil {
+			account.Policy = *options.Policy
+		}
+		if options.Webhook != nil {
+			webhook := *options.Webhook
+			if len(webhook.Secret) == 0 {
+				webhook.Secret = account.Webhook.Secret
+			}
+			if len(webhook.Secret) == 0 {
+				webhook.Secret = util.GenSecret()
+			}
+			account.Webhook = webhook
+		}
+	})
+}
+
+//停用系统,断开该系统的所有连接,之后的连接和接口调用都会被拒绝
+func SuspendSystem(systemId string) (SystemInfo, error) {
+	info, err := modifySystem(systemId, func(account *accountInfo) {
+		account.Status = SystemStatusSuspended
+	})
+	if err == nil && !util.IsCluster() {
+		closeLocalSystemClients(systemId)
+	}
+	return info, err
+}
+
+//重新启用停用的系统
+func ActivateSystem(systemId string) (SystemInfo, error) {
+	return modifySystem(systemId, func(account *accountInfo) {
+		account.Status = SystemStatusActive
+	})
+}
+
+//删除系统并断开该系统的所有连接
+func DeleteSystem(systemId string) error {
+	accountLock.Lock()
+	defer accountLock.Unlock()
+
+	if _, err := loadAccountInfo(systemId); err != nil {
+		return err
+	}
+
+	if util.IsCluster() {
+		//各节点监听到删除后断开本机的连接
+		if err := etcd.Delete(define.ETcdPrefixAccountInfo + systemId); err != nil {
+			return err
+		}
+		Systems.delete(systemId)
+	} else {
+		SystemMap.Delete(systemId)
+		closeLocalSystemClients(systemId)
+	}
+
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"systemId": systemId,
+	}).Info("删除系统")
+	return nil
+}
+
+//读取最新的账号信息,修改后保存
+func modifySystem(systemId string, modify func(account *accountInfo)) (SystemInfo, error) {
+	account, err := updateAccountInfo(systemId, func(account *accountInfo) error {
+		modify(account)
+		return nil
+	})
+	if err != nil {
+		return SystemInfo{}, err
+	}
+	return account.info(countSystemClients(systemId)[systemId]), nil
+}
+
+//断开本机上指定系统的所有连接
+func closeLocalSystemClients(systemId string) {
+	clientIds := Manager.GetSystemClientList(systemId)
+	for _, clientId := range clientIds {
+		CloseLocalClient(clientId, systemId)
+	}
+
+	if len(clientIds) > 0 {
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"systemId": systemId,
+			"counts":   len(clientIds),
+		}).Info("断开系统的所有连接")
+	}
+}
@@ -0,0 +1,116 @@
+package servers
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSystemLifecycle(t *testing.T) {
+	resetSetting()
+	StartWebSocket()
+
+	s := httptest.NewServer(http.HandlerFunc((&Controller{}).Run))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?systemId=lifecycleSystem"
+
+	Convey("测试系统的管理", t, func() {
+		_, err := Register("lifecycleSystem", RegisterOptions{})
+		So(err, ShouldBeNil)
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		var first resumeRender
+		So(conn.ReadJSON(&first), ShouldBeNil)
+		So(first.Code, ShouldEqual, 0)
+
+		Convey("查询系统和在线连接数", func() {
+			systems, err := ListSystems()
+			So(err, ShouldBeNil)
+			var found *SystemInfo
+			for i := range systems {
+				if systems[i].SystemId == "lifecycleSystem" {
+					found = &systems[i]
+				}
+			}
+			So(found, ShouldNotBeNil)
+			So(found.Status, ShouldEqual, SystemStatusActive)
+			So(found.Clients, ShouldEqual, 1)
+
+			info, err := DescribeSystem("lifecycleSystem")
+			So(err, ShouldBeNil)
+			So(info.ApiKeys, ShouldHaveLength, 1)
+			So(info.Clients, ShouldEqual, 1)
+		})
+
+		Convey("修改系统配置", func() {
+			requireToken := true
+			info, err := UpdateSystem("lifecycleSystem", UpdateOptions{RequireToken: &requireToken})
+			So(err, ShouldBeNil)
+			So(info.RequireToken, ShouldBeTrue)
+			So(info.OfflineMessage, ShouldBeFalse)
+		})
+
+		Convey("停用后断开连接并拒绝新的连接,启用后恢复", func() {
+			_, err := SuspendSystem("lifecycleSystem")
+			So(err, ShouldBeNil)
+			So(CheckSystem("lifecycleSystem"), ShouldEqual, ErrSystemSuspended)
+
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			_, err = Manager.GetByClientId(first.Data.ClientId)
+			So(err, ShouldNotBeNil)
+
+			_, err = ActivateSystem("lifecycleSystem")
+			So(err, ShouldBeNil)
+			So(CheckSystem("lifecycleSystem"), ShouldBeNil)
+		})
+
+		Convey("删除系统", func() {
+			So(DeleteSystem("lifecycleSystem"), ShouldBeNil)
+			So(CheckSystem("lifecycleSystem"), ShouldEqual, ErrSystemNotRegistered)
+			So(DeleteSystem("lifecycleSystem"), ShouldEqual, ErrSystemNotRegistered)
+		})
+
+		Reset(func() {
+			SystemMap.Delete("lifecycleSystem")
+		})
+	})
+}
+
+func TestRegisterConcurrently(t *testing.T) {
+	resetSetting()
+
+	Convey("测试同时注册同一个系统", t, func() {
+		defer SystemMap.Delete("concurrentSystem")
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		var credentials []Credential
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if credential, err := Register("concurrentSystem", RegisterOptions{}); err == nil {
+					lock.Lock()
+					credentials = append(credentials, credential)
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		//只有一次注册成功,返回的密钥可以使用
+		So(credentials, ShouldHaveLength, 1)
+		So(HasApiKey("concurrentSystem"), ShouldBeTrue)
+		account, _ := getAccountInfo("concurrentSystem")
+		So(account.ApiKeys[0].Key, ShouldEqual, credentials[0].ApiKey)
+	})
+}
@@ -0,0 +1,172 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/define"
+	"github.com/woodylan/go-websocket/pkg/etcd"
+	"github.com/woodylan/go-websocket/tools/util"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 缓存的账号信息和对应的etcd版本号
+type systemEntry struct {
+	account  accountInfo
+	revision int64
+}
+
+// 集群模式下本地缓存的系统账号,通过监听etcd保持同步,查询时不再访问etcd
+type SystemRegistry struct {
+	lock     sync.RWMutex
+	accounts map[string]systemEntry
+	ready    bool // 监听是否正常,不正常时缓存中没有的系统需要查询etcd
+}
+
+var Systems = NewSystemRegistry()
+
+func NewSystemRegistry() *SystemRegistry {
+	return &SystemRegistry{
+		accounts: make(map[string]systemEntry),
+	}
+}
+
+// 集群模式下开始监听etcd中的系统账号
+func InitSystems() {
+	if util.IsCluster() {
+		go Systems.watch()
+	}
+}
+
+// 更新缓存,忽略比缓存更旧的版本,避免本机写入后收到较早的监听事件
+func (s *SystemRegistry) set(account accountInfo, revision int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.accounts[account.SystemId]
+	if ok && entry.revision > revision {
+		return
+	}
+	s.accounts[account.SystemId] = systemEntry{account: account, revision: revision}
+
+	//系统在任意节点被停用后,各节点断开本机的连接
+	if account.suspended() && (!ok || !entry.account.suspended()) {
+		go closeLocalSystemClients(account.SystemId)
+	}
+}
+
+func (s *SystemRegistry) delete(systemId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.accounts[systemId]; ok {
+		delete(s.accounts, systemId)
+		go closeLocalSystemClients(systemId)
+	}
+}
+
+// 获取系统的账号信息,etcd不可用时使用最后一次同步的状态
+func (s *SystemRegistry) Get(systemId string) (accountInfo, error) {
+	s.lock.RLock()
+	entry, ok := s.accounts[systemId]
+	ready := s.ready
+	s.lock.RUnlock()
+
+	if ok {
+		return entry.account, nil
+	}
+	if ready {
+		return accountInfo{}, ErrSystemNotRegistered
+	}
+
+	//还没有加载完成或者监听已断开,可能是刚注册的系统
+	resp, err := etcd.Get(define.ETcdPrefixAccountInfo + systemId)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	if resp.Count == 0 {
+		return accountInfo{}, ErrSystemNotRegistered
+	}
+
+	account := accountInfo{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &account); err != nil {
+		return accountInfo{}, err
+	}
+	s.set(account, resp.Kvs[0].ModRevision)
+	return account, nil
+}
+
+// 解析etcd中的账号信息
+func parseAccount(kv *mvccpb.KeyValue) (accountInfo, bool) {
+	account := accountInfo{}
+	if err := json.Unmarshal(kv.Value, &account); err != nil {
+		log.Errorf("解析系统账号失败: %s %v", kv.Key, err)
+		return account, false
+	}
+	return account, true
+}
+
+// 加载全部账号,返回加载时的版本号
+func (s *SystemRegistry) load() (int64, error) {
+	resp, err := etcd.GetPrefix(define.ETcdPrefixAccountInfo)
+	if err != nil {
+		return 0, err
+	}
+
+	accounts := make(map[string]systemEntry, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if account, ok := parseAccount(kv); ok {
+			accounts[account.SystemId] = systemEntry{account: account, revision: kv.ModRevision}
+		}
+	}
+
+	s.lock.Lock()
+	old := s.accounts
+	s.accounts = accounts
+	s.ready = true
+	s.lock.Unlock()
+
+	//监听断开期间被停用或删除的系统
+	for systemId, entry := range old {
+		if current, ok := accounts[systemId]; !entry.account.suspended() && (!ok || current.account.suspended()) {
+			go closeLocalSystemClients(systemId)
+		}
+	}
+	return resp.Header.Revision, nil
+}
+
+// 监听账号变化,连接断开后重新加载,期间保留已缓存的账号
+func (s *SystemRegistry) watch() {
+	for {
+		rev, err := s.load()
+		if err != nil {
+			log.Errorf("加载系统账号失败: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		for resp := range etcd.WatchPrefix(ctx, define.ETcdPrefixAccountInfo, rev+1) {
+			if resp.Err() != nil {
+				log.Errorf("监听系统账号失败: %v", resp.Err())
+				break
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == mvccpb.DELETE {
+					s.delete(strings.TrimPrefix(string(ev.Kv.Key), define.ETcdPrefixAccountInfo))
+				} else if account, ok := parseAccount(ev.Kv); ok {
+					s.set(account, ev.Kv.ModRevision)
+				}
+			}
+		}
+		cancel()
+
+		s.lock.Lock()
+		s.ready = false
+		s.lock.Unlock()
+		time.Sleep(time.Second)
+	}
+}
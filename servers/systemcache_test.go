@@ -0,0 +1,48 @@
+package servers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSystemRegistry(t *testing.T) {
+	Convey("测试系统账号的本地缓存", t, func() {
+		registry := NewSystemRegistry()
+		registry.ready = true
+
+		Convey("从缓存中查询", func() {
+			registry.set(accountInfo{SystemId: "system", RequireToken: true}, 2)
+			account, err := registry.Get("system")
+			So(err, ShouldBeNil)
+			So(account.RequireToken, ShouldBeTrue)
+
+			_, err = registry.Get("other")
+			So(err, ShouldEqual, ErrSystemNotRegistered)
+		})
+
+		Convey("忽略比缓存更旧的版本", func() {
+			registry.set(accountInfo{SystemId: "system", OfflineTTL: 20}, 5)
+			registry.set(accountInfo{SystemId: "system", OfflineTTL: 10}, 3)
+			account, _ := registry.Get("system")
+			So(account.OfflineTTL, ShouldEqual, 20)
+
+			registry.set(accountInfo{SystemId: "system", OfflineTTL: 30}, 6)
+			account, _ = registry.Get("system")
+			So(account.OfflineTTL, ShouldEqual, 30)
+		})
+
+		Convey("删除系统", func() {
+			registry.set(accountInfo{SystemId: "system"}, 1)
+			registry.delete("system")
+			_, err := registry.Get("system")
+			So(err, ShouldEqual, ErrSystemNotRegistered)
+		})
+
+		Convey("监听断开时使用最后一次同步的状态", func() {
+			registry.set(accountInfo{SystemId: "system"}, 1)
+			registry.ready = false
+			_, err := registry.Get("system")
+			So(err, ShouldBeNil)
+		})
+	})
+}
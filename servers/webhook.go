@@ -0,0 +1,218 @@
+package servers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/util"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 客户端建立连接
+	WebhookConnect = "connect"
+	// 客户端断开连接,保留会话期间重连成功不算断开
+	WebhookDisconnect = "disconnect"
+	// 客户端加入分组
+	WebhookBind = "bind"
+	// 客户端离开分组,包括解绑、离开和解散分组
+	WebhookUnbind = "unbind"
+	// 客户端发送给业务系统的消息
+	WebhookUpstream = "upstream"
+)
+
+// 回调业务系统的配置
+type Webhook struct {
+	Url    string   `json:"url"`    // 回调地址,为空则不回调
+	Events []string `json:"events"` // 需要回调的事件,为空则回调所有事件
+	Secret string   `json:"secret"` // 回调签名使用的密钥
+}
+
+// 回调的请求内容
+type webhookEvent struct {
+	EventId   string `json:"eventId"`
+	Event     string `json:"event"`
+	SystemId  string `json:"systemId"`
+	ClientId  string `json:"clientId"`
+	UserId    string `json:"userId,omitempty"`
+	GroupName string `json:"groupName,omitempty"`
+	Data      string `json:"data,omitempty"`     // 客户端发送的消息
+	Duration  uint64 `json:"duration,omitempty"` // 连接的时长，单位：秒
+	Reason    string `json:"reason,omitempty"`   // 断开的原因
+	Time      int64  `json:"time"`
+}
+
+type webhookTask struct {
+	event  webhookEvent
+	url    string
+	secret string
+	body   []byte
+}
+
+// 回调队列,由固定数量的协程发送,不阻塞客户端的读写
+type WebhookDispatcher struct {
+	startOnce sync.Once
+	queue     chan webhookTask
+	pending   int64 // 已入队还没有发送完成的回调数
+	client    *http.Client
+}
+
+var Webhooks = &WebhookDispatcher{}
+
+// 未配置时默认的发送协程数和超时时间
+const (
+	defaultWebhookWorkers = 8
+	defaultWebhookTimeout = 3 * time.Second
+)
+
+//回调是否订阅了该事件
+func (w Webhook) subscribed(event string) bool {
+	if len(w.Url) == 0 {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//校验回调地址
+func (w Webhook) validate() error {
+	if len(w.Url) == 0 {
+		return nil
+	}
+	u, err := url.Parse(w.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("回调地址无效：%s", w.Url)
+	}
+	return nil
+}
+
+//启动发送协程,可重复调用
+func (d *WebhookDispatcher) Start() {
+	d.startOnce.Do(func() {
+		conf := setting.WebhookSetting
+		timeout, workers := defaultWebhookTimeout, defaultWebhookWorkers
+		if conf.Timeout > 0 {
+			timeout = time.Duration(conf.Timeout) * time.Second
+		}
+		if conf.Workers > 0 {
+			workers = conf.Workers
+		}
+
+		d.client = &http.Client{Timeout: timeout}
+		queue := make(chan webhookTask, conf.QueueSize)
+		for i := 0; i < workers; i++ {
+			go d.work(queue)
+		}
+		d.queue = queue
+	})
+}
+
+//将事件放入回调队列,系统没有订阅该事件时忽略,队列满时丢弃
+func (d *WebhookDispatcher) Emit(event webhookEvent) {
+	account, err := getAccountInfo(event.SystemId)
+	if err != nil || !account.Webhook.subscribed(event.Event) || d.queue == nil {
+		return
+	}
+
+	event.EventId = util.GenUUID()
+	event.Time = time.Now().Unix()
+	body, _ := json.Marshal(event)
+	task := webhookTask{event: event, url: account.Webhook.Url, secret: account.Webhook.Secret, body: body}
+
+	atomic.AddInt64(&d.pending, 1)
+	select {
+	case d.queue <- task:
+	default:
+		atomic.AddInt64(&d.pending, -1)
+		webhooksTotal.With(event.Event, "dropped").Inc()
+		log.WithFields(log.Fields{
+			"host":     setting.GlobalSetting.LocalHost,
+			"port":     setting.CommonSetting.HttpPort,
+			"systemId": event.SystemId,
+			"clientId": event.ClientId,
+			"event":    event.Event,
+		}).Warn("回调队列已满,丢弃回调")
+	}
+}
+
+func (d *WebhookDispatcher) work(queue chan webhookTask) {
+	for task := range queue {
+		d.deliver(task)
+		atomic.AddInt64(&d.pending, -1)
+	}
+}
+
+//发送回调,失败后按次数递增等待时间重试
+func (d *WebhookDispatcher) deliver(task webhookTask) {
+	event := task.event
+	var err error
+	for attempt := 0; attempt <= setting.WebhookSetting.MaxRetry; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = d.post(task); err == nil {
+			webhooksTotal.With(event.Event, "success").Inc()
+			return
+		}
+	}
+
+	webhooksTotal.With(event.Event, "failed").Inc()
+	log.WithFields(log.Fields{
+		"host":     setting.GlobalSetting.LocalHost,
+		"port":     setting.CommonSetting.HttpPort,
+		"systemId": event.SystemId,
+		"clientId": event.ClientId,
+		"event":    event.Event,
+		"url":      task.url,
+	}).Error("回调业务系统失败: " + err.Error())
+}
+
+//签名方式和接口签名相同,业务系统可以使用相同的方法校验
+func (d *WebhookDispatcher) post(task webhookTask) error {
+	req, err := http.NewRequest(http.MethodPost, task.url, bytes.NewReader(task.body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, task.event.EventId)
+	req.Header.Set(HeaderSignature, GenApiSignature(task.secret, req.Method, req.URL.RequestURI(), timestamp, task.event.EventId, task.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("响应状态码：%d", resp.StatusCode)
+	}
+	return nil
+}
+
+//等待队列中的回调发送完成,超时返回false
+func (d *WebhookDispatcher) Flush(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultWebhookTimeout)
+	}
+	return waitUntil(ctx, deadline, func() bool {
+		return atomic.LoadInt64(&d.pending) == 0
+	})
+}
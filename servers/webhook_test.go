@@ -0,0 +1,95 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	resetSetting()
+	StartWebSocket()
+
+	var lock sync.Mutex
+	var events []webhookEvent
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := GenApiSignature("webhookSecret", r.Method, r.URL.RequestURI(), r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce), body)
+		if r.Header.Get(HeaderSignature) != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		//第一次返回失败,测试重试
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		event := webhookEvent{}
+		_ = json.Unmarshal(body, &event)
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	received := func() []webhookEvent {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]webhookEvent{}, events...)
+	}
+
+	Convey("测试回调业务系统", t, func() {
+		_, err := Register("webhookSystem", RegisterOptions{})
+		So(err, ShouldBeNil)
+
+		Convey("校验回调配置", func() {
+			_, err := UpdateSystem("webhookSystem", UpdateOptions{Webhook: &Webhook{Url: "ftp://example.com"}})
+			So(err, ShouldNotBeNil)
+
+			info, err := UpdateSystem("webhookSystem", UpdateOptions{Webhook: &Webhook{Url: server.URL}})
+			So(err, ShouldBeNil)
+			So(info.Webhook.Secret, ShouldNotBeEmpty)
+
+			//不传密钥时保留原来的密钥
+			secret := info.Webhook.Secret
+			info, err = UpdateSystem("webhookSystem", UpdateOptions{Webhook: &Webhook{Url: server.URL + "/hook"}})
+			So(err, ShouldBeNil)
+			So(info.Webhook.Secret, ShouldEqual, secret)
+		})
+
+		Convey("只回调订阅的事件,失败后重试", func() {
+			_, err := UpdateSystem("webhookSystem", UpdateOptions{Webhook: &Webhook{
+				Url:    server.URL + "/hook",
+				Events: []string{WebhookUpstream, WebhookDisconnect},
+				Secret: "webhookSecret",
+			}})
+			So(err, ShouldBeNil)
+
+			Webhooks.Emit(webhookEvent{Event: WebhookConnect, SystemId: "webhookSystem", ClientId: "client"})
+			Webhooks.Emit(webhookEvent{Event: WebhookUpstream, SystemId: "webhookSystem", ClientId: "client", Data: "hello"})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			So(Webhooks.Flush(ctx), ShouldBeTrue)
+
+			events := received()
+			So(events, ShouldHaveLength, 1)
+			So(events[0].Event, ShouldEqual, WebhookUpstream)
+			So(events[0].Data, ShouldEqual, "hello")
+			So(events[0].EventId, ShouldNotBeEmpty)
+		})
+
+		Reset(func() {
+			SystemMap.Delete("webhookSystem")
+		})
+	})
+}
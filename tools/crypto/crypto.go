@@ -98,3 +98,39 @@ func aesCBCDncrypt(encryptData, key []byte) ([]byte, error) {
 	encryptData, err = pKCS7UnPadding(encryptData)
 	return encryptData, err
 }
+
+//AES-GCM加密,返回随机nonce和密文,additionalData不加密但参与认证
+func GCMEncrypt(rawData, key, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(rawData)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, err
+	}
+	return aead.Seal(nonce, nonce, rawData, additionalData), nil
+}
+
+//AES-GCM解密,密文或additionalData被修改时返回错误
+func GCMDecrypt(encryptData, key, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(encryptData) < aead.NonceSize()+aead.Overhead() {
+		return []byte{}, errors.New("ciphertext too short")
+	}
+	nonce := encryptData[:aead.NonceSize()]
+	return aead.Open(nil, nonce, encryptData[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
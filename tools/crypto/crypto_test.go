@@ -49,3 +49,26 @@ func Benchmark_CBCDecrypt(b *testing.B) {
 		_, _ = Decrypt(raw, key)
 	}
 }
+
+func TestGCM(t *testing.T) {
+	raw := []byte("127.0.0.1:7000")
+	key := []byte("asdf1234qwer7894")
+	data, err := GCMEncrypt(raw, key, []byte("2.1"))
+	if err != nil {
+		t.Fatal("fail", err)
+	}
+
+	str, err := GCMDecrypt(data, key, []byte("2.1"))
+	if err != nil || string(str) != string(raw) {
+		t.Fatal("fail", string(str), err)
+	}
+
+	if _, err = GCMDecrypt(data, key, []byte("2.2")); err == nil {
+		t.Fatal("additionalData被修改时应该解密失败")
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err = GCMDecrypt(data, key, []byte("2.1")); err == nil {
+		t.Fatal("密文被修改时应该解密失败")
+	}
+}
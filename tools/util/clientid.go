@@ -0,0 +1,105 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/crypto"
+	"strings"
+)
+
+//clientId的格式版本,格式为 版本.密钥ID.base64(nonce+密文),版本和密钥ID参与认证
+const clientIdVersion = "2"
+
+//生成和解析clientId的密钥
+type clientIdKey struct {
+	id     string
+	secret []byte
+}
+
+//解析配置中的密钥列表,格式为 密钥ID:密钥,第一个用于生成新的clientId
+func clientIdKeys() ([]clientIdKey, error) {
+	keys := make([]clientIdKey, 0, len(setting.CommonSetting.ClientIdKeys))
+	for _, item := range setting.CommonSetting.ClientIdKeys {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		index := strings.Index(item, ":")
+		if index <= 0 || strings.Contains(item[:index], ".") {
+			return nil, errors.New("clientId密钥格式错误,应为 密钥ID:密钥")
+		}
+		switch len(item) - index - 1 {
+		case 16, 24, 32:
+		default:
+			return nil, errors.New("clientId密钥长度必须为16、24或32：" + item[:index])
+		}
+		keys = append(keys, clientIdKey{id: item[:index], secret: []byte(item[index+1:])})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("未配置ClientIdKeys")
+	}
+	return keys, nil
+}
+
+//启动时校验密钥配置
+func CheckClientIdKeys() error {
+	_, err := clientIdKeys()
+	return err
+}
+
+//加密本机的地址生成clientId,每次生成使用新的随机nonce,同一节点的clientId也各不相同
+func GenClientId() string {
+	keys, err := clientIdKeys()
+	if err != nil {
+		panic(err)
+	}
+
+	raw := []byte(setting.GlobalSetting.LocalHost + ":" + setting.CommonSetting.RPCPort)
+	header := clientIdVersion + "." + keys[0].id
+	data, err := crypto.GCMEncrypt(raw, keys[0].secret, []byte(header))
+	if err != nil {
+		panic(err)
+	}
+
+	return header + "." + base64.RawURLEncoding.EncodeToString(data)
+}
+
+//解析clientId中的节点地址,迁移期间仍可解析CryptoKey加密的旧版clientId
+func decodeClientId(clientId string) (string, error) {
+	parts := strings.SplitN(clientId, ".", 3)
+	if len(parts) != 3 {
+		//旧版clientId为AES-CBC加密的标准base64,不包含"."
+		if len(setting.CommonSetting.CryptoKey) == 0 {
+			return "", errors.New("clientId无效")
+		}
+		return crypto.Decrypt(clientId, []byte(setting.CommonSetting.CryptoKey))
+	}
+
+	if parts[0] != clientIdVersion {
+		return "", errors.New("clientId版本不支持")
+	}
+
+	keys, err := clientIdKeys()
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key.id != parts[1] {
+			continue
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", err
+		}
+		addr, err := crypto.GCMDecrypt(data, key.secret, []byte(parts[0]+"."+parts[1]))
+		if err != nil {
+			return "", err
+		}
+		return string(addr), nil
+	}
+	return "", errors.New("clientId密钥不存在：" + parts[1])
+}
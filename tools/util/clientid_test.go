@@ -0,0 +1,84 @@
+package util
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/woodylan/go-websocket/pkg/setting"
+	"github.com/woodylan/go-websocket/tools/crypto"
+	"strings"
+	"testing"
+)
+
+func TestClientId(t *testing.T) {
+	setting.Default()
+	setting.GlobalSetting.LocalHost = "127.0.0.1"
+	setting.CommonSetting.ClientIdKeys = []string{"1:0123456789abcdef"}
+
+	Convey("测试生成和解析clientId", t, func() {
+		clientId := GenClientId()
+		So(clientId, ShouldStartWith, "2.1.")
+		So(GenClientId(), ShouldNotEqual, clientId)
+
+		addr, _, port, isLocal, err := GetAddrInfoAndIsLocal(clientId)
+		So(err, ShouldBeNil)
+		So(addr, ShouldEqual, "127.0.0.1:7000")
+		So(port, ShouldEqual, "7000")
+		So(isLocal, ShouldBeTrue)
+
+		Convey("篡改的clientId解析失败", func() {
+			tampered := []byte(clientId)
+			last := len(tampered) - 1
+			if tampered[last] == 'A' {
+				tampered[last] = 'B'
+			} else {
+				tampered[last] = 'A'
+			}
+			_, _, _, _, err := GetAddrInfoAndIsLocal(string(tampered))
+			So(err, ShouldNotBeNil)
+
+			//修改密钥ID也会导致认证失败
+			setting.CommonSetting.ClientIdKeys = []string{"1:0123456789abcdef", "9:0123456789abcdef"}
+			_, _, _, _, err = GetAddrInfoAndIsLocal(strings.Replace(clientId, "2.1.", "2.9.", 1))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("轮换密钥后仍可解析旧密钥生成的clientId", func() {
+			setting.CommonSetting.ClientIdKeys = []string{"2:fedcba9876543210", "1:0123456789abcdef"}
+			So(GenClientId(), ShouldStartWith, "2.2.")
+			_, _, _, isLocal, err := GetAddrInfoAndIsLocal(clientId)
+			So(err, ShouldBeNil)
+			So(isLocal, ShouldBeTrue)
+
+			setting.CommonSetting.ClientIdKeys = []string{"2:fedcba9876543210"}
+			_, _, _, _, err = GetAddrInfoAndIsLocal(clientId)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("迁移期间解析旧版clientId", func() {
+			legacy, err := crypto.Encrypt([]byte("127.0.0.1:7000"), []byte(setting.CommonSetting.CryptoKey))
+			So(err, ShouldBeNil)
+			_, _, _, isLocal, err := GetAddrInfoAndIsLocal(legacy)
+			So(err, ShouldBeNil)
+			So(isLocal, ShouldBeTrue)
+
+			setting.CommonSetting.CryptoKey = ""
+			_, _, _, _, err = GetAddrInfoAndIsLocal(legacy)
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			setting.CommonSetting.CryptoKey = "axRArfEfJw7V0te6"
+			setting.CommonSetting.ClientIdKeys = []string{"1:0123456789abcdef"}
+		})
+	})
+
+	Convey("校验密钥配置", t, func() {
+		setting.CommonSetting.ClientIdKeys = []string{}
+		So(CheckClientIdKeys(), ShouldNotBeNil)
+		setting.CommonSetting.ClientIdKeys = []string{"short"}
+		So(CheckClientIdKeys(), ShouldNotBeNil)
+		setting.CommonSetting.ClientIdKeys = []string{"1:short"}
+		So(CheckClientIdKeys(), ShouldNotBeNil)
+		setting.CommonSetting.ClientIdKeys = []string{" 1:0123456789abcdef "}
+		So(CheckClientIdKeys(), ShouldBeNil)
+	})
+}
@@ -1,11 +1,12 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	uuid "github.com/satori/go.uuid"
 	"github.com/woodylan/go-websocket/pkg/setting"
-	"github.com/woodylan/go-websocket/tools/crypto"
 	"strings"
 )
 
@@ -18,15 +19,13 @@ func GenUUID() string {
 	return string(uuidByt[8:24])
 }
 
-//对称加密IP和端口，当做clientId
-func GenClientId() string {
-	raw := []byte(setting.GlobalSetting.LocalHost + ":" + setting.CommonSetting.RPCPort)
-	str, err := crypto.Encrypt(raw, []byte(setting.CommonSetting.CryptoKey))
-	if err != nil {
+//生成随机密钥,返回64位十六进制字符串
+func GenSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
 		panic(err)
 	}
-
-	return str
+	return hex.EncodeToString(b)
 }
 
 //解析redis的地址格式
@@ -58,7 +57,7 @@ func IsCluster() bool {
 //获取client key地址信息
 func GetAddrInfoAndIsLocal(clientId string) (addr string, host string, port string, isLocal bool, err error) {
 	//解密ClientId
-	addr, err = crypto.Decrypt(clientId, []byte(setting.CommonSetting.CryptoKey))
+	addr, err = decodeClientId(clientId)
 	if err != nil {
 		return
 	}
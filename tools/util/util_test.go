@@ -15,3 +15,16 @@ func TestGenUUID(t *testing.T) {
 		})
 	})
 }
+
+func TestGenSecret(t *testing.T) {
+	Convey("生成随机密钥", t, func() {
+		secret := GenSecret()
+		Convey("验证长度", func() {
+			So(len(secret), ShouldEqual, 64)
+		})
+
+		Convey("每次生成的密钥不同", func() {
+			So(GenSecret(), ShouldNotEqual, secret)
+		})
+	})
+}